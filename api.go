@@ -0,0 +1,298 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const apiPath = "/api/v1/"
+
+// jobHistory is a ring buffer of the per-job IO of the last collections.
+// Entries older than the retention are skipped on reading.
+type jobHistory struct {
+	mutex     sync.RWMutex
+	entries   []jobHistoryEntry
+	next      int
+	full      bool
+	retention time.Duration
+}
+
+type jobHistoryEntry struct {
+	timestamp time.Time
+	jobs      jobIOMap
+}
+
+type apiJob struct {
+	Jobid                string             `json:"jobid"`
+	Account              string             `json:"account"`
+	User                 string             `json:"user"`
+	MetadataOperations   map[string]float64 `json:"metadata_operations"`
+	ReadThroughputBytes  float64            `json:"read_throughput_bytes"`
+	WriteThroughputBytes float64            `json:"write_throughput_bytes"`
+}
+
+type apiSample struct {
+	Timestamp            time.Time          `json:"timestamp"`
+	MetadataOperations   map[string]float64 `json:"metadata_operations"`
+	ReadThroughputBytes  float64            `json:"read_throughput_bytes"`
+	WriteThroughputBytes float64            `json:"write_throughput_bytes"`
+}
+
+type apiJobsResponse struct {
+	Timestamp time.Time `json:"timestamp"`
+	Jobs      []apiJob  `json:"jobs"`
+}
+
+type apiJobResponse struct {
+	Jobid   string      `json:"jobid"`
+	Account string      `json:"account"`
+	User    string      `json:"user"`
+	Active  bool        `json:"active"`
+	History []apiSample `json:"history"`
+}
+
+type apiUserResponse struct {
+	User      string      `json:"user"`
+	Timestamp time.Time   `json:"timestamp"`
+	Jobs      []apiJob    `json:"jobs"`
+	History   []apiSample `json:"history"`
+}
+
+type apiErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func newJobHistory(size int, retention time.Duration) (*jobHistory, error) {
+
+	if size <= 0 {
+		return nil, errors.New("history size must be greater than 0")
+	}
+
+	if retention <= 0 {
+		return nil, errors.New("history retention must be greater than 0")
+	}
+
+	return &jobHistory{entries: make([]jobHistoryEntry, size), retention: retention}, nil
+}
+
+// handleSnapshot adds the per-job IO of a successful collection to the history.
+// Failed collections are skipped, since jobs would falsely show no IO.
+func (h *jobHistory) handleSnapshot(current *snapshot) {
+
+	if !current.scrapeOK || current.jobs == nil {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.entries[h.next] = jobHistoryEntry{timestamp: current.timestamp, jobs: current.jobs}
+	h.next = (h.next + 1) % len(h.entries)
+
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// list returns the entries within the retention from the oldest to the newest.
+func (h *jobHistory) list() []jobHistoryEntry {
+
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	ordered := h.entries[:h.next]
+	if h.full {
+		ordered = append(h.entries[h.next:len(h.entries):len(h.entries)], h.entries[:h.next]...)
+	}
+
+	oldest := time.Now().Add(-h.retention)
+	list := make([]jobHistoryEntry, 0, len(ordered))
+
+	for _, entry := range ordered {
+		if entry.timestamp.After(oldest) {
+			list = append(list, entry)
+		}
+	}
+
+	return list
+}
+
+// ServeHTTP serves the current per-job IO and its history as JSON:
+//
+//	/api/v1/jobs           the jobs of the latest collection
+//	/api/v1/jobs/{jobid}   the history of a job
+//	/api/v1/users/{user}   the jobs of the latest collection and the summed history of a user
+func (h *jobHistory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "only GET is allowed")
+		return
+	}
+
+	entries := h.list()
+	if len(entries) == 0 {
+		writeAPIError(w, http.StatusServiceUnavailable, "no successful collection within the history retention")
+		return
+	}
+
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiPath), "/"), "/")
+
+	switch {
+
+	case len(path) == 1 && path[0] == "jobs":
+		latest := entries[len(entries)-1]
+		writeAPIResponse(w, apiJobsResponse{Timestamp: latest.timestamp, Jobs: newAPIJobs(latest.jobs, "")})
+
+	case len(path) == 2 && path[0] == "jobs" && path[1] != "":
+		response, ok := newAPIJobResponse(entries, path[1])
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, "job not found in history: "+path[1])
+			return
+		}
+		writeAPIResponse(w, response)
+
+	case len(path) == 2 && path[0] == "users" && path[1] != "":
+		response, ok := newAPIUserResponse(entries, path[1])
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, "user not found in history: "+path[1])
+			return
+		}
+		writeAPIResponse(w, response)
+
+	default:
+		writeAPIError(w, http.StatusNotFound, "unknown API path: "+r.URL.Path)
+	}
+}
+
+// newAPIJobs returns the jobs sorted by jobid, optionally only of the user.
+func newAPIJobs(jobs jobIOMap, user string) []apiJob {
+
+	list := make([]apiJob, 0, len(jobs))
+
+	for _, io := range jobs {
+		if user == "" || io.user == user {
+			list = append(list, apiJob{
+				Jobid:                io.jobid,
+				Account:              io.account,
+				User:                 io.user,
+				MetadataOperations:   io.metadataOperations,
+				ReadThroughputBytes:  io.readThroughput,
+				WriteThroughputBytes: io.writeThroughput,
+			})
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Jobid < list[j].Jobid })
+
+	return list
+}
+
+func newAPIJobResponse(entries []jobHistoryEntry, jobid string) (*apiJobResponse, bool) {
+
+	var response *apiJobResponse
+
+	for _, entry := range entries {
+
+		io, ok := entry.jobs[jobid]
+		if !ok {
+			continue
+		}
+
+		if response == nil {
+			response = &apiJobResponse{Jobid: jobid, Account: io.account, User: io.user}
+		}
+
+		response.History = append(response.History, apiSample{
+			Timestamp:            entry.timestamp,
+			MetadataOperations:   io.metadataOperations,
+			ReadThroughputBytes:  io.readThroughput,
+			WriteThroughputBytes: io.writeThroughput,
+		})
+	}
+
+	if response == nil {
+		return nil, false
+	}
+
+	_, response.Active = entries[len(entries)-1].jobs[jobid]
+
+	return response, true
+}
+
+func newAPIUserResponse(entries []jobHistoryEntry, user string) (*apiUserResponse, bool) {
+
+	latest := entries[len(entries)-1]
+
+	response := &apiUserResponse{
+		User:      user,
+		Timestamp: latest.timestamp,
+		Jobs:      newAPIJobs(latest.jobs, user),
+		History:   make([]apiSample, 0),
+	}
+
+	for _, entry := range entries {
+
+		sample := apiSample{Timestamp: entry.timestamp, MetadataOperations: make(map[string]float64)}
+		found := false
+
+		for _, io := range entry.jobs {
+
+			if io.user != user {
+				continue
+			}
+
+			found = true
+
+			for target, operations := range io.metadataOperations {
+				sample.MetadataOperations[target] += operations
+			}
+
+			sample.ReadThroughputBytes += io.readThroughput
+			sample.WriteThroughputBytes += io.writeThroughput
+		}
+
+		if found {
+			response.History = append(response.History, sample)
+		}
+	}
+
+	if len(response.History) == 0 {
+		return nil, false
+	}
+
+	return response, true
+}
+
+func writeAPIResponse(w http.ResponseWriter, response interface{}) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Error("Failed to write API response: ", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(apiErrorResponse{Error: message}); err != nil {
+		log.Error("Failed to write API error: ", err)
+	}
+}
@@ -0,0 +1,86 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestJobIO(jobid string, user string, read float64) *jobIO {
+	return &jobIO{
+		jobid:              jobid,
+		account:            "hpc",
+		user:               user,
+		metadataOperations: map[string]float64{"hebe-MDT0000": 10},
+		readThroughput:     read,
+	}
+}
+
+func TestJobHistory(t *testing.T) {
+
+	history, err := newJobHistory(2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+
+	history.handleSnapshot(&snapshot{timestamp: now.Add(-3 * time.Minute), scrapeOK: true, jobs: jobIOMap{"1": newTestJobIO("1", "alice", 100)}})
+	history.handleSnapshot(&snapshot{timestamp: now.Add(-2 * time.Minute), scrapeOK: true, jobs: jobIOMap{"2": newTestJobIO("2", "alice", 200)}})
+	history.handleSnapshot(&snapshot{timestamp: now.Add(-time.Minute), scrapeOK: false, jobs: jobIOMap{}})
+	history.handleSnapshot(&snapshot{timestamp: now, scrapeOK: true, jobs: jobIOMap{
+		"2": newTestJobIO("2", "alice", 300),
+		"3": newTestJobIO("3", "bob", 400),
+	}})
+
+	entries := history.list()
+
+	if len(entries) != 2 || !entries[0].timestamp.Before(entries[1].timestamp) {
+		t.Fatalf("Expected the 2 newest successful collections in order - got: %v", entries)
+	}
+
+	request := func(path string, response interface{}) int {
+
+		recorder := httptest.NewRecorder()
+		history.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+
+		if response != nil && recorder.Code == http.StatusOK {
+			if err := json.Unmarshal(recorder.Body.Bytes(), response); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return recorder.Code
+	}
+
+	jobs := apiJobsResponse{}
+	if code := request("/api/v1/jobs", &jobs); code != http.StatusOK || len(jobs.Jobs) != 2 || jobs.Jobs[0].Jobid != "2" {
+		t.Errorf("Unexpected jobs response %d: %+v", code, jobs)
+	}
+
+	job := apiJobResponse{}
+	if code := request("/api/v1/jobs/2", &job); code != http.StatusOK || !job.Active || len(job.History) != 2 || job.History[1].ReadThroughputBytes != 300 {
+		t.Errorf("Unexpected job response %d: %+v", code, job)
+	}
+
+	user := apiUserResponse{}
+	if code := request("/api/v1/users/alice", &user); code != http.StatusOK || len(user.Jobs) != 1 || len(user.History) != 2 || user.History[0].MetadataOperations["hebe-MDT0000"] != 10 {
+		t.Errorf("Unexpected user response %d: %+v", code, user)
+	}
+
+	for _, path := range []string{"/api/v1/jobs/1", "/api/v1/users/carol", "/api/v1/unknown"} {
+		if code := request(path, nil); code != http.StatusNotFound {
+			t.Errorf("Expected status 404 for %s - got: %d", path, code)
+		}
+	}
+}
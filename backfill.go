@@ -0,0 +1,285 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+)
+
+const commandBackfill = "backfill"
+
+const (
+	defaultBackfillStep  = time.Minute
+	defaultBackfillChunk = 24 * time.Hour
+)
+
+type backfillOptions struct {
+	start     string
+	end       string
+	step      time.Duration
+	chunk     time.Duration
+	outputDir string
+}
+
+// backfillQuery is a query of the exporter, whose range query result is
+// replayed at each step.
+type backfillQuery struct {
+	name   string
+	query  string
+	series []rangeSeries
+}
+
+func newBackfillFlags(flags *flag.FlagSet) *backfillOptions {
+
+	options := &backfillOptions{}
+
+	flags.StringVar(&options.start, "backfill.start", "", "[REQUIRED] Start of the backfill in local time e.g. 2023-05-01 or 2023-05-01T08:00:00")
+	flags.StringVar(&options.end, "backfill.end", "", "End of the backfill in local time e.g. 2023-06-01 - Now if empty")
+	flags.DurationVar(&options.step, "backfill.step", defaultBackfillStep, "Interval of the replayed collections, which should match the scrape interval of the exporter")
+	flags.DurationVar(&options.chunk, "backfill.chunk", defaultBackfillChunk, "Period written into a single OpenMetrics file")
+	flags.StringVar(&options.outputDir, "backfill.output-dir", "", "[REQUIRED] Directory, into which the OpenMetrics files are written")
+
+	return options
+}
+
+// runBackfill replays the collections of the period from the results of the
+// exporter queries and the jobs from sacct and writes the metrics into
+// OpenMetrics files for promtool tsdb create-blocks-from openmetrics.
+func runBackfill(settings *collectionSettings, options *backfillOptions) error {
+
+	source, ok := settings.source.(*promSource)
+	if !ok {
+		return fmt.Errorf("%s requires the %s source", commandBackfill, sourcePrometheus)
+	}
+
+	if options.outputDir == "" {
+		return errors.New("output directory is not set")
+	}
+
+	start, end, err := parseReportPeriod(options.start, options.end, time.Now())
+	if err != nil {
+		return err
+	}
+
+	records, err := runSacct("--allusers",
+		"--starttime", start.In(time.Local).Format(sacctTimeFormat),
+		"--endtime", end.In(time.Local).Format(sacctTimeFormat))
+	if err != nil {
+		return err
+	}
+
+	users, groups, err := retrieveIdentityMaps(settings)
+	if err != nil {
+		return err
+	}
+
+	return backfillPeriod(source, settings, records, users, groups, start, end, options)
+}
+
+func backfillPeriod(source *promSource, settings *collectionSettings, records []jobRecord, users userInfoMap, groups groupInfoMap,
+	start time.Time, end time.Time, options *backfillOptions) error {
+
+	if options.step <= 0 || options.chunk < options.step {
+		return errors.New("step must be greater than 0 and chunk must not be shorter than the step")
+	}
+
+	if options.chunk/options.step > maxRangeQueryPoints {
+		return fmt.Errorf("chunk must not contain more than %d steps", maxRangeQueryPoints)
+	}
+
+	chunk := options.chunk.Truncate(options.step)
+
+	for chunkStart := start; chunkStart.Before(end); chunkStart = chunkStart.Add(chunk) {
+
+		chunkEnd := chunkStart.Add(chunk)
+		if chunkEnd.After(end) {
+			chunkEnd = end
+		}
+
+		families, err := replayChunk(source, settings, records, users, groups, chunkStart, chunkEnd, options.step)
+		if err != nil {
+			return err
+		}
+
+		if len(families) == 0 {
+			log.Warning("No metrics between ", chunkStart.Format(time.RFC3339), " and ", chunkEnd.Format(time.RFC3339))
+			continue
+		}
+
+		path := filepath.Join(options.outputDir, "cluster_exporter_"+chunkStart.UTC().Format("20060102T150405Z")+".om")
+
+		if err := writeOpenMetricsFile(path, families); err != nil {
+			return err
+		}
+
+		log.Info("Written ", path)
+	}
+
+	return nil
+}
+
+// replayChunk runs the collections of the steps between start and end with
+// the results of the exporter queries at the steps.
+func replayChunk(source *promSource, settings *collectionSettings, records []jobRecord, users userInfoMap, groups groupInfoMap,
+	start time.Time, end time.Time, step time.Duration) ([]*dto.MetricFamily, error) {
+
+	// The last step is before the end, so successive chunks do not overlap.
+	last := start.Add((end.Sub(start) - 1) / step * step)
+
+	queries := []*backfillQuery{
+		{name: "backfill_metadata_operations", query: decodeQuery(source.urls.metadataOperations)},
+		{name: "backfill_read_throughput", query: decodeQuery(source.urls.jobReadBytes)},
+		{name: "backfill_write_throughput", query: decodeQuery(source.urls.jobWriteBytes)},
+	}
+
+	for _, query := range queries {
+
+		var err error
+
+		// The time range is already part of the queries of the exporter.
+		query.series, err = source.queryRange(query.name, query.query, "", start, last, step)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	inputs := make(map[int64]*attributionInputs)
+
+	input := func(timestamp time.Time) *attributionInputs {
+		if _, ok := inputs[timestamp.Unix()]; !ok {
+			inputs[timestamp.Unix()] = newAttributionInputs()
+		}
+		return inputs[timestamp.Unix()]
+	}
+
+	for _, series := range queries[0].series {
+		for _, sample := range series.samples {
+			input(sample.timestamp).addMetadataOperations(series.labels, int64(math.Round(sample.value)), source.metadataTargets)
+		}
+	}
+
+	for i, read := range []bool{true, false} {
+		for _, series := range queries[i+1].series {
+			for _, sample := range series.samples {
+				input(sample.timestamp).addThroughput(series.labels, sample.value, read)
+			}
+		}
+	}
+
+	families := make(map[string]*dto.MetricFamily)
+	skipped := 0
+
+	for timestamp := start; !timestamp.After(last); timestamp = timestamp.Add(step) {
+
+		current, ok := inputs[timestamp.Unix()]
+		if !ok {
+			continue
+		}
+
+		metrics, err := current.attribute(settings, runningJobs(records, timestamp, timestamp), users, groups)
+		if err != nil {
+			log.Debug("Skipping ", timestamp.Format(time.RFC3339), ": ", err)
+			skipped++
+			continue
+		}
+
+		replayed, err := (&snapshot{metrics: metrics.gather()}).metricFamilies()
+		if err != nil {
+			return nil, err
+		}
+
+		timestampMs := timestamp.UnixNano() / int64(time.Millisecond)
+
+		for _, family := range replayed {
+
+			// The internal metrics describe the exporter and not the cluster at the time.
+			if strings.HasPrefix(family.GetName(), namespaceInternals+"_") {
+				continue
+			}
+
+			for _, metric := range family.Metric {
+				metric.TimestampMs = &timestampMs
+			}
+
+			if existing, ok := families[family.GetName()]; ok {
+				existing.Metric = append(existing.Metric, family.Metric...)
+			} else {
+				families[family.GetName()] = family
+			}
+		}
+	}
+
+	// Failed steps leave holes in the backfilled series.
+	if skipped > 0 {
+		log.Warning("Skipped ", skipped, " steps between ", start.Format(time.RFC3339), " and ", end.Format(time.RFC3339), ", whose attribution failed")
+	}
+
+	sorted := make([]*dto.MetricFamily, 0, len(families))
+	for _, family := range families {
+		sorted = append(sorted, family)
+	}
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].GetName() < sorted[j].GetName() })
+
+	return sorted, nil
+}
+
+// writeOpenMetricsFile writes the metric families atomically into the file.
+func writeOpenMetricsFile(path string, families []*dto.MetricFamily) error {
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if err := writeOpenMetrics(tmp, families); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func writeOpenMetrics(output io.Writer, families []*dto.MetricFamily) error {
+
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToOpenMetrics(output, family); err != nil {
+			return err
+		}
+	}
+
+	_, err := expfmt.FinalizeOpenMetrics(output)
+
+	return err
+}
@@ -0,0 +1,123 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackfillPeriod(t *testing.T) {
+
+	start := time.Unix(1700000000, 0)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		query := r.URL.Query().Get("query")
+		first, _ := strconv.ParseInt(r.URL.Query().Get("start"), 10, 64)
+		last, _ := strconv.ParseInt(r.URL.Query().Get("end"), 10, 64)
+
+		values := func(value string) string {
+			samples := make([]string, 0)
+			for timestamp := first; timestamp <= last; timestamp += 60 {
+				samples = append(samples, fmt.Sprintf(`[%d,"%s"]`, timestamp, value))
+			}
+			return strings.Join(samples, ",")
+		}
+
+		series := ""
+
+		switch {
+		case strings.Contains(query, "lustre_job_stats_total[1m]"):
+			series = `{"metric":{"jobid":"1001","target":"hebe-MDT0000"},"values":[` + values("10") + `]}`
+		case strings.Contains(query, "lustre_job_read_bytes_total[1m]"):
+			series = `{"metric":{"jobid":"cp.1001"},"values":[` + values("5") + `]}`
+		}
+
+		w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[` + series + `]}}`))
+	}))
+	defer server.Close()
+
+	client, err := newPromClient([]promClientConfig{{url: server.URL}}, 5, 64*testMaxResponseSize, promRetryConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := promQueryOptions{flavor: flavorPrometheus}
+	validateQueryOptions(&options)
+
+	urls, err := newUrlExportLustreMetrics(&queriesConfig{
+		TimeRange:          "1m",
+		MetadataOperations: queryMetadataOperations,
+		ReadThroughput:     queryJobReadBytes,
+		WriteThroughput:    queryJobWriteBytes,
+	}, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := newPromSource(client, urls, options, regexMetadataMDT)
+	settings := &collectionSettings{source: source, filters: &collectionFilters{}}
+
+	// The IO of the array job 1000_1 is recorded under its raw jobid 1001.
+	records, err := parseSacctRecords([]byte("1000_1|1001|hpc|alice|"+start.Add(-time.Hour).Format(sacctTimeFormat)+"|"+
+		start.Add(time.Hour).Format(sacctTimeFormat)+"|COMPLETED\n"), start)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := userInfoMap{1001: userInfo{user: "alice", uid: 1001, gid: 100}}
+	groups := groupInfoMap{100: groupInfo{group: "staff", gid: 100}}
+
+	dir := t.TempDir()
+
+	backfill := &backfillOptions{step: time.Minute, chunk: 3 * time.Minute, outputDir: dir}
+
+	if err := backfillPeriod(source, settings, records, users, groups, start, start.Add(5*time.Minute), backfill); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.om"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 OpenMetrics files - got: %v", files)
+	}
+
+	content, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`cluster_job_metadata_operations{account="hpc",target="hebe-MDT0000",user="alice"} 10.0 1.7e+09`,
+		`cluster_job_metadata_operations{account="hpc",target="hebe-MDT0000",user="alice"} 10.0 1.70000012e+09`,
+		`cluster_proc_read_throughput_bytes{group_name="staff",proc_name="cp",user_name="alice"} 5.0 1.70000006e+09`,
+		"# EOF\n",
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(string(content), line) {
+			t.Errorf("Expected line %s in OpenMetrics file:\n%s", line, content)
+		}
+	}
+
+	if strings.Contains(string(content), namespaceInternals+"_") || strings.Contains(string(content), "1.7000018e+09") {
+		t.Errorf("Unexpected internal metrics or samples of the next chunk in OpenMetrics file:\n%s", content)
+	}
+}
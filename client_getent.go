@@ -12,7 +12,6 @@ import (
 	"bytes"
 	"errors"
 	"io/ioutil"
-	"os/exec"
 	"strconv"
 	"strings"
 	"time"
@@ -20,6 +19,19 @@ import (
 
 const GETENT = "getent"
 
+// Supported backends for resolving the user and group names.
+const (
+	identityBackendGetent = "getent"
+	identityBackendFile   = "file"
+)
+
+// identityBackend reads the passwd or group database either with getent,
+// which includes NSS sources like LDAP or SSSD, or from a file in the same format.
+type identityBackend struct {
+	backend string
+	file    string
+}
+
 type userInfo struct {
 	user string
 	uid  int
@@ -37,54 +49,48 @@ type groupInfoMap map[int]groupInfo
 type userInfoMapResult struct {
 	elapsed float64
 	users   userInfoMap
+	content []byte
 	err     error
 }
 
 type groupInfoMapResult struct {
 	elapsed float64
 	groups  groupInfoMap
+	content []byte
 	err     error
 }
 
-func createUserInfoMap(channel chan<- userInfoMapResult) {
+func createUserInfoMap(channel chan<- userInfoMapResult, backend identityBackend) {
 
 	start := time.Now()
 
-	userInfoMap := make(userInfoMap)
-
-	cmd := exec.Command(GETENT, "passwd")
-
-	pipe, err := cmd.StdoutPipe()
-
+	out, err := readIdentityDatabase(backend, "passwd")
 	if err != nil {
-		channel <- userInfoMapResult{0, nil, err}
+		channel <- userInfoMapResult{0, nil, nil, err}
 		return
 	}
 
-	if err := cmd.Start(); err != nil {
-		channel <- userInfoMapResult{0, nil, err}
+	userInfoMap, err := parseUserInfoMap(out)
+	if err != nil {
+		channel <- userInfoMapResult{0, nil, out, err}
 		return
 	}
 
-	out, err := ioutil.ReadAll(pipe)
+	elapsed := time.Since(start).Seconds()
 
-	if err != nil {
-		channel <- userInfoMapResult{0, nil, err}
-		return
-	}
+	channel <- userInfoMapResult{elapsed, userInfoMap, out, nil}
+}
 
-	// TODO Timeout handling?
-	if err := cmd.Wait(); err != nil {
-		channel <- userInfoMapResult{0, nil, err}
-		return
-	}
+// parseUserInfoMap parses the passwd database in the format of getent passwd.
+func parseUserInfoMap(out []byte) (userInfoMap, error) {
+
+	userInfoMap := make(userInfoMap)
 
 	// TrimSpace on []bytes is more efficient than calling TrimSpace on a string since it creates a copy
 	content := string(bytes.TrimSpace(out))
 
 	if len(content) == 0 {
-		channel <- userInfoMapResult{0, nil, errors.New("retrieved content in createUserInfoMap() is empty")}
-		return
+		return nil, errors.New("retrieved content in createUserInfoMap() is empty")
 	}
 
 	lines := strings.Split(content, "\n")
@@ -94,71 +100,58 @@ func createUserInfoMap(channel chan<- userInfoMapResult) {
 		fields := strings.SplitN(line, ":", 5)
 
 		if len(fields) < 4 {
-			channel <- userInfoMapResult{0, nil, errors.New("insufficient field count found in line: " + line)}
-			return
+			return nil, errors.New("insufficient field count found in line: " + line)
 		}
 
 		user := fields[0]
 
 		uid, err := strconv.Atoi(fields[2])
 		if err != nil {
-			channel <- userInfoMapResult{0, nil, err}
-			return
+			return nil, err
 		}
 
 		gid, err := strconv.Atoi(fields[3])
 		if err != nil {
-			channel <- userInfoMapResult{0, nil, err}
-			return
+			return nil, err
 		}
 
 		userInfoMap[uid] = userInfo{user, uid, gid}
 	}
 
-	elapsed := time.Since(start).Seconds()
-
-	channel <- userInfoMapResult{elapsed, userInfoMap, nil}
+	return userInfoMap, nil
 }
 
-func createGroupInfoMap(channel chan<- groupInfoMapResult) {
+func createGroupInfoMap(channel chan<- groupInfoMapResult, backend identityBackend) {
 
 	start := time.Now()
 
-	groupInfoMap := make(groupInfoMap)
-
-	cmd := exec.Command(GETENT, "group")
-
-	pipe, err := cmd.StdoutPipe()
-
+	out, err := readIdentityDatabase(backend, "group")
 	if err != nil {
-		channel <- groupInfoMapResult{0, nil, err}
+		channel <- groupInfoMapResult{0, nil, nil, err}
 		return
 	}
 
-	if err := cmd.Start(); err != nil {
-		channel <- groupInfoMapResult{0, nil, err}
+	groupInfoMap, err := parseGroupInfoMap(out)
+	if err != nil {
+		channel <- groupInfoMapResult{0, nil, out, err}
 		return
 	}
 
-	out, err := ioutil.ReadAll(pipe)
+	elapsed := time.Since(start).Seconds()
 
-	if err != nil {
-		channel <- groupInfoMapResult{0, nil, err}
-		return
-	}
+	channel <- groupInfoMapResult{elapsed, groupInfoMap, out, nil}
+}
 
-	// TODO Timeout handling?
-	if err := cmd.Wait(); err != nil {
-		channel <- groupInfoMapResult{0, nil, err}
-		return
-	}
+// parseGroupInfoMap parses the group database in the format of getent group.
+func parseGroupInfoMap(out []byte) (groupInfoMap, error) {
+
+	groupInfoMap := make(groupInfoMap)
 
 	// TrimSpace on []bytes is more efficient than calling TrimSpace on a string since it creates a copy
 	content := string(bytes.TrimSpace(out))
 
 	if len(content) == 0 {
-		channel <- groupInfoMapResult{0, nil, errors.New("retrieved content in createGroupInfoMap() is empty")}
-		return
+		return nil, errors.New("retrieved content in createGroupInfoMap() is empty")
 	}
 
 	lines := strings.Split(content, "\n")
@@ -167,22 +160,49 @@ func createGroupInfoMap(channel chan<- groupInfoMapResult) {
 		fields := strings.SplitN(line, ":", 4)
 
 		if len(fields) < 3 {
-			channel <- groupInfoMapResult{0, nil, errors.New("insufficient field count found in line: " + line)}
-			return
+			return nil, errors.New("insufficient field count found in line: " + line)
 		}
 
 		group := fields[0]
 
 		gid, err := strconv.Atoi(fields[2])
 		if err != nil {
-			channel <- groupInfoMapResult{0, nil, err}
-			return
+			return nil, err
 		}
 
 		groupInfoMap[gid] = groupInfo{group, gid}
 	}
 
-	elapsed := time.Since(start).Seconds()
+	return groupInfoMap, nil
+}
+
+// readIdentityDatabase returns the content of the passwd or group database.
+func readIdentityDatabase(backend identityBackend, database string) ([]byte, error) {
+
+	if backend.backend == identityBackendFile {
+		return ioutil.ReadFile(backend.file)
+	}
+
+	cmd := newCommand(GETENT, database)
+
+	pipe, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	out, err := ioutil.ReadAll(pipe)
+	if err != nil {
+		return nil, err
+	}
+
+	// TODO Timeout handling?
+	if err := cmd.Wait(); err != nil {
+		return nil, err
+	}
 
-	channel <- groupInfoMapResult{elapsed, groupInfoMap, nil}
+	return out, nil
 }
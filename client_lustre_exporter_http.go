@@ -0,0 +1,260 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	lustreJobStatsTotal      = "lustre_job_stats_total"
+	lustreJobReadBytesTotal  = "lustre_job_read_bytes_total"
+	lustreJobWriteBytesTotal = "lustre_job_write_bytes_total"
+)
+
+type lustreExporterScrape struct {
+	target    string
+	timestamp time.Time
+	families  map[string]*dto.MetricFamily
+	err       error
+}
+
+// lustreExporterSource scrapes lustre_exporter targets directly and computes
+// the rates of the job counters between successive retrievals locally.
+type lustreExporterSource struct {
+	targets            []string
+	client             *http.Client
+	maxResponseSize    int64
+	metadataTargets    *regexp.Regexp
+	rates              *counterRates
+	ratesMutex         sync.Mutex
+	scrapeErrorsMetric *prometheus.CounterVec
+}
+
+func newLustreExporterSource(targets []string, requestTimeout int, maxResponseSize int64, metadataTargets *regexp.Regexp) (*lustreExporterSource, error) {
+
+	if len(targets) == 0 {
+		return nil, errors.New("no lustre_exporter target has been specified")
+	}
+
+	if requestTimeout <= 0 {
+		return nil, errors.New("request timeout must be greater then 0")
+	}
+
+	scrapeErrorsMetric := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespaceInternals,
+			Name:      "lustre_exporter_scrape_errors_total",
+			Help:      "Total failed scrapes of a lustre_exporter target.",
+		},
+		[]string{"target"})
+
+	for _, target := range targets {
+		scrapeErrorsMetric.WithLabelValues(target)
+	}
+
+	return &lustreExporterSource{
+		targets:            targets,
+		client:             &http.Client{Timeout: time.Second * time.Duration(requestTimeout)},
+		maxResponseSize:    maxResponseSize,
+		metadataTargets:    metadataTargets,
+		rates:              newCounterRates(),
+		scrapeErrorsMetric: scrapeErrorsMetric,
+	}, nil
+}
+
+func (s *lustreExporterSource) retrieve(channel chan<- lustreMetricsResult) {
+
+	start := time.Now()
+
+	scrapes := make([]lustreExporterScrape, len(s.targets))
+
+	var wg sync.WaitGroup
+
+	for i, target := range s.targets {
+		wg.Add(1)
+		go func(i int, target string) {
+			defer wg.Done()
+			families, err := s.scrape(target)
+			scrapes[i] = lustreExporterScrape{target, time.Now(), families, err}
+		}(i, target)
+	}
+
+	wg.Wait()
+
+	failed := make([]string, 0)
+
+	s.ratesMutex.Lock()
+
+	jobRates := newLustreJobRates(s.metadataTargets)
+
+	for _, scrape := range scrapes {
+
+		if scrape.err != nil {
+			log.Warning("Failed to scrape lustre_exporter target ", scrape.target, ": ", scrape.err)
+			s.scrapeErrorsMetric.WithLabelValues(scrape.target).Inc()
+			failed = append(failed, scrape.target)
+			continue
+		}
+
+		s.addJobRates(jobRates, scrape)
+	}
+
+	s.rates.advance()
+	s.ratesMutex.Unlock()
+
+	var err error
+	if len(failed) > 0 {
+		err = fmt.Errorf("failed to scrape lustre_exporter targets: %s", strings.Join(failed, ", "))
+	}
+
+	var result lustreMetricsResult
+
+	// Partially failed scrapes still provide the metrics of the other targets.
+	if len(failed) < len(scrapes) {
+		result.metadataOperations = jobRates.metadataInfos()
+		result.readThroughput = jobRates.throughputInfos(true)
+		result.writeThroughput = jobRates.throughputInfos(false)
+		result.dropped = jobRates.dropped
+	}
+
+	result.stages = []stageResult{
+		{"scrape_lustre_exporter", "LustreExporterChannel", time.Since(start).Seconds(), err},
+	}
+
+	channel <- result
+}
+
+func (s *lustreExporterSource) scrape(target string) (map[string]*dto.MetricFamily, error) {
+
+	log.Debug("Scraping lustre_exporter target: ", target)
+
+	res, err := s.client.Get(target)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status: %s", res.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, s.maxResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(body)) > s.maxResponseSize {
+		return nil, fmt.Errorf("response exceeds max size of %d bytes", s.maxResponseSize)
+	}
+
+	return parseLustreExporterMetrics(bytes.NewReader(body))
+}
+
+// parseLustreExporterMetrics parses the job metric families from the text exposition format.
+func parseLustreExporterMetrics(reader io.Reader) (map[string]*dto.MetricFamily, error) {
+
+	var parser expfmt.TextParser
+
+	families, err := parser.TextToMetricFamilies(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	for name := range families {
+		if name != lustreJobStatsTotal && name != lustreJobReadBytesTotal && name != lustreJobWriteBytesTotal {
+			delete(families, name)
+		}
+	}
+
+	return families, nil
+}
+
+// addJobRates must be called with the rates mutex held.
+func (s *lustreExporterSource) addJobRates(jobRates *lustreJobRates, scrape lustreExporterScrape) {
+
+	for name, family := range scrape.families {
+
+		for _, metric := range family.GetMetric() {
+
+			labels := make(map[string]string, len(metric.GetLabel()))
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+
+			value := metric.GetCounter().GetValue()
+			if metric.GetUntyped() != nil {
+				value = metric.GetUntyped().GetValue()
+			}
+
+			rate, ok := s.rates.rate(seriesKey(scrape.target, name, labels), value, scrape.timestamp)
+			if !ok {
+				continue
+			}
+
+			switch name {
+			case lustreJobStatsTotal:
+				jobRates.addMetadataOperations(labels["jobid"], labels["target"], rate)
+			case lustreJobReadBytesTotal:
+				jobRates.addThroughput(labels["jobid"], rate, true)
+			case lustreJobWriteBytesTotal:
+				jobRates.addThroughput(labels["jobid"], rate, false)
+			}
+		}
+	}
+}
+
+// seriesKey returns a unique key for a series of a target.
+func seriesKey(target string, name string, labels map[string]string) string {
+
+	names := make([]string, 0, len(labels))
+	for labelName := range labels {
+		names = append(names, labelName)
+	}
+	sort.Strings(names)
+
+	var builder strings.Builder
+
+	builder.WriteString(target)
+	builder.WriteByte('|')
+	builder.WriteString(name)
+
+	for _, labelName := range names {
+		builder.WriteByte('|')
+		builder.WriteString(labelName)
+		builder.WriteByte('=')
+		builder.WriteString(labels[labelName])
+	}
+
+	return builder.String()
+}
+
+func (s *lustreExporterSource) Describe(ch chan<- *prometheus.Desc) {
+	s.scrapeErrorsMetric.Describe(ch)
+}
+
+func (s *lustreExporterSource) Collect(ch chan<- prometheus.Metric) {
+	s.scrapeErrorsMetric.Collect(ch)
+}
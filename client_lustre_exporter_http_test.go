@@ -0,0 +1,114 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCounterRates(t *testing.T) {
+
+	rates := newCounterRates()
+	start := time.Now()
+
+	if _, ok := rates.rate("a", 100, start); ok {
+		t.Error("Expected no rate for the first value")
+	}
+
+	rates.advance()
+
+	rate, ok := rates.rate("a", 160, start.Add(time.Minute))
+	if !ok || rate != 1 {
+		t.Errorf("Expected rate 1 - got: %f", rate)
+	}
+
+	rates.advance()
+
+	// Counter reset
+	rate, ok = rates.rate("a", 30, start.Add(2*time.Minute))
+	if !ok || rate != 0.5 {
+		t.Errorf("Expected rate 0.5 after counter reset - got: %f", rate)
+	}
+
+	rates.advance()
+	rates.advance()
+
+	if _, ok := rates.rate("a", 60, start.Add(3*time.Minute)); ok {
+		t.Error("Expected no rate for a discarded counter")
+	}
+}
+
+func TestLustreExporterSource(t *testing.T) {
+
+	scrape := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scrape++
+		fmt.Fprintf(w, `# TYPE lustre_job_stats_total counter
+lustre_job_stats_total{component="mdt",jobid="1001",operation="open",target="hebe-MDT0000"} %d
+lustre_job_stats_total{component="mdt",jobid="1001",operation="close",target="hebe-MDT0000"} %d
+lustre_job_stats_total{component="mdt",jobid="cp.1001",operation="open",target="hebe-MDT0001"} 5
+# TYPE lustre_job_read_bytes_total counter
+lustre_job_read_bytes_total{component="ost",jobid="1001",target="hebe-OST0000"} %d
+lustre_job_read_bytes_total{component="ost",jobid="1001",target="hebe-OST0001"} %d
+# TYPE lustre_job_write_bytes_total counter
+lustre_job_write_bytes_total{component="ost",jobid="1001",target="hebe-OST0000"} 4096
+# TYPE lustre_ost_capacity_bytes gauge
+lustre_ost_capacity_bytes{target="hebe-OST0000"} 1e+12
+`, 1000*scrape, 500*scrape, 1<<20*scrape, 1<<20*scrape)
+	}))
+	defer server.Close()
+
+	source, err := newLustreExporterSource([]string{server.URL}, 5, 1<<20, regexMetadataMDT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channel := make(chan lustreMetricsResult, 1)
+
+	source.retrieve(channel)
+	result := <-channel
+
+	if len(*result.metadataOperations) != 0 {
+		t.Errorf("Expected no metadata operations for the first scrape - got: %d", len(*result.metadataOperations))
+	}
+
+	source.retrieve(channel)
+	result = <-channel
+
+	for _, stage := range result.stages {
+		if stage.err != nil {
+			t.Fatal(stage.err)
+		}
+	}
+
+	// Only series with a rate of at least 1 are kept.
+	if len(*result.metadataOperations) != 1 {
+		t.Fatalf("Expected 1 metadata operation - got: %d", len(*result.metadataOperations))
+	}
+
+	metadataInfo := (*result.metadataOperations)[0]
+
+	if metadataInfo.jobid != "1001" || metadataInfo.target != "hebe-MDT0000" || metadataInfo.operations <= 0 {
+		t.Errorf("Unexpected metadata operation: %+v", metadataInfo)
+	}
+
+	if len(*result.readThroughput) != 1 || (*result.readThroughput)[0].throughput <= 0 {
+		t.Errorf("Expected read throughput summed over targets for jobid 1001 - got: %+v", *result.readThroughput)
+	}
+
+	// Unchanged counters have a rate of 0, which is dropped.
+	if len(*result.writeThroughput) != 0 {
+		t.Errorf("Expected no write throughput - got: %+v", *result.writeThroughput)
+	}
+}
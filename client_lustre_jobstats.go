@@ -0,0 +1,370 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const LCTL = "lctl"
+
+// Default job_stats files on MDS and OSS nodes.
+const defaultJobStatsPaths = "/proc/fs/lustre/mdt/*/job_stats,/proc/fs/lustre/obdfilter/*/job_stats"
+
+var lctlJobStatsParams = []string{"mdt.*.job_stats", "obdfilter.*.job_stats"}
+
+var (
+	regexJobStatsParam  = regexp.MustCompile(`^(?:mdt|obdfilter)\.(.+)\.job_stats=`)
+	regexJobStatsJobID  = regexp.MustCompile(`^-\s+job_id:\s*(.*)$`)
+	regexJobStatsField  = regexp.MustCompile(`^\s+(\w+):\s+\{(.*)\}\s*$`)
+	regexJobStatsSample = regexp.MustCompile(`(?:^|[{,])\s*samples:\s*(\d+)`)
+	regexJobStatsSum    = regexp.MustCompile(`(?:^|[{,])\s*sum:\s*(\d+)`)
+	regexJobStatsUnit   = regexp.MustCompile(`(?:^|[{,])\s*unit:\s*(\w+)`)
+)
+
+// jobStatsEntry holds the counters of a job on a Lustre target.
+// Operations are the samples of all operations counted in requests or usecs.
+type jobStatsEntry struct {
+	jobid      string
+	target     string
+	operations float64
+	readBytes  float64
+	writeBytes float64
+}
+
+// jobStatsSource reads Lustre job_stats directly on MDS and OSS nodes
+// and computes the rates of the counters between successive retrievals.
+type jobStatsSource struct {
+	paths              []string
+	useLctl            bool
+	metadataTargets    *regexp.Regexp
+	rates              *counterRates
+	ratesMutex         sync.Mutex
+	readErrorsMetric   prometheus.Counter
+	jobStatsJobsMetric *prometheus.GaugeVec
+}
+
+func newJobStatsSource(paths []string, useLctl bool, metadataTargets *regexp.Regexp) (*jobStatsSource, error) {
+
+	if !useLctl && len(paths) == 0 {
+		return nil, errors.New("no job_stats path has been specified")
+	}
+
+	if useLctl {
+		if _, err := exec.LookPath(LCTL); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, path := range paths {
+		if _, err := filepath.Match(path, ""); err != nil {
+			return nil, fmt.Errorf("invalid job_stats path pattern %s: %w", path, err)
+		}
+	}
+
+	readErrorsMetric := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespaceInternals,
+		Name:      "jobstats_read_errors_total",
+		Help:      "Total failed reads of Lustre job_stats.",
+	})
+
+	jobStatsJobsMetric := newGaugeVecMetric(
+		namespaceInternals,
+		"jobstats_jobs",
+		"Count of jobs found in the Lustre job_stats of a target.",
+		[]string{"target"})
+
+	return &jobStatsSource{
+		paths:              paths,
+		useLctl:            useLctl,
+		metadataTargets:    metadataTargets,
+		rates:              newCounterRates(),
+		readErrorsMetric:   readErrorsMetric,
+		jobStatsJobsMetric: jobStatsJobsMetric,
+	}, nil
+}
+
+func (s *jobStatsSource) retrieve(channel chan<- lustreMetricsResult) {
+
+	start := time.Now()
+
+	var entries []jobStatsEntry
+	var err error
+
+	if s.useLctl {
+		entries, err = s.readLctl()
+	} else {
+		entries, err = s.readFiles()
+	}
+
+	timestamp := time.Now()
+
+	var result lustreMetricsResult
+
+	if err != nil {
+		s.readErrorsMetric.Inc()
+	}
+
+	if entries != nil {
+
+		s.ratesMutex.Lock()
+
+		jobRates := newLustreJobRates(s.metadataTargets)
+		jobsPerTarget := make(map[string]int)
+
+		for _, entry := range entries {
+
+			jobsPerTarget[entry.target]++
+
+			key := entry.target + "|" + entry.jobid
+
+			if rate, ok := s.rates.rate(key+"|operations", entry.operations, timestamp); ok {
+				jobRates.addMetadataOperations(entry.jobid, entry.target, rate)
+			}
+			if rate, ok := s.rates.rate(key+"|read_bytes", entry.readBytes, timestamp); ok {
+				jobRates.addThroughput(entry.jobid, rate, true)
+			}
+			if rate, ok := s.rates.rate(key+"|write_bytes", entry.writeBytes, timestamp); ok {
+				jobRates.addThroughput(entry.jobid, rate, false)
+			}
+		}
+
+		s.rates.advance()
+		s.ratesMutex.Unlock()
+
+		s.jobStatsJobsMetric.Reset()
+		for target, count := range jobsPerTarget {
+			s.jobStatsJobsMetric.WithLabelValues(target).Set(float64(count))
+		}
+
+		result.metadataOperations = jobRates.metadataInfos()
+		result.readThroughput = jobRates.throughputInfos(true)
+		result.writeThroughput = jobRates.throughputInfos(false)
+		result.dropped = jobRates.dropped
+	}
+
+	result.stages = []stageResult{
+		{"read_jobstats", "JobStatsChannel", time.Since(start).Seconds(), err},
+	}
+
+	channel <- result
+}
+
+// readFiles reads the job_stats files matching the path patterns.
+// The target name is taken from the parent directory of a file.
+func (s *jobStatsSource) readFiles() ([]jobStatsEntry, error) {
+
+	entries := make([]jobStatsEntry, 0)
+	failed := make([]string, 0)
+	found := 0
+
+	for _, pattern := range s.paths {
+
+		paths, _ := filepath.Glob(pattern)
+
+		for _, path := range paths {
+
+			found++
+
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				log.Warning("Failed to read job_stats file ", path, ": ", err)
+				failed = append(failed, path)
+				continue
+			}
+
+			target := filepath.Base(filepath.Dir(path))
+
+			fileEntries, err := parseJobStats(bytes.NewReader(content), target)
+			if err != nil {
+				log.Warning("Failed to parse job_stats file ", path, ": ", err)
+				failed = append(failed, path)
+				continue
+			}
+
+			entries = append(entries, fileEntries...)
+		}
+	}
+
+	if found == 0 {
+		return nil, errors.New("no job_stats file found for paths: " + strings.Join(s.paths, ", "))
+	}
+
+	if len(failed) == found {
+		return nil, errors.New("failed to read job_stats files: " + strings.Join(failed, ", "))
+	}
+
+	if len(failed) > 0 {
+		return entries, errors.New("failed to read job_stats files: " + strings.Join(failed, ", "))
+	}
+
+	return entries, nil
+}
+
+// readLctl reads the job_stats with lctl get_param, which prefixes the
+// job_stats of each target with the parameter name.
+func (s *jobStatsSource) readLctl() ([]jobStatsEntry, error) {
+
+	entries := make([]jobStatsEntry, 0)
+	succeeded := 0
+
+	// A node usually provides either MDT or OST job_stats,
+	// so lctl is called for each parameter separately.
+	for _, param := range lctlJobStatsParams {
+
+		cmd := newCommand(LCTL, "get_param", param)
+
+		out, err := cmd.Output()
+		if err != nil {
+			log.Debug("lctl get_param ", param, " failed: ", err)
+			continue
+		}
+
+		paramEntries, err := parseJobStats(bytes.NewReader(out), "")
+		if err != nil {
+			return nil, err
+		}
+
+		succeeded++
+		entries = append(entries, paramEntries...)
+	}
+
+	if succeeded == 0 {
+		return nil, errors.New("lctl get_param failed for all job_stats parameters")
+	}
+
+	return entries, nil
+}
+
+// parseJobStats parses the Lustre job_stats YAML format. Parameter names of
+// lctl get_param output like mdt.fs-MDT0000.job_stats= set the target.
+func parseJobStats(reader io.Reader, target string) ([]jobStatsEntry, error) {
+
+	entries := make([]jobStatsEntry, 0)
+
+	var entry *jobStatsEntry
+
+	scanner := bufio.NewScanner(reader)
+	lineNumber := 0
+
+	for scanner.Scan() {
+
+		line := scanner.Text()
+		lineNumber++
+
+		if match := regexJobStatsParam.FindStringSubmatch(line); match != nil {
+			entry = appendJobStatsEntry(&entries, entry)
+			target = match[1]
+			continue
+		}
+
+		if match := regexJobStatsJobID.FindStringSubmatch(line); match != nil {
+
+			entry = appendJobStatsEntry(&entries, entry)
+
+			jobid := strings.TrimSpace(match[1])
+
+			// Since Lustre 2.14 job IDs containing special characters are quoted.
+			if unquoted, err := strconv.Unquote(jobid); err == nil {
+				jobid = unquoted
+			}
+
+			if target == "" {
+				return nil, fmt.Errorf("no target found for job_id in line %d", lineNumber)
+			}
+
+			entry = &jobStatsEntry{jobid: jobid, target: target}
+			continue
+		}
+
+		match := regexJobStatsField.FindStringSubmatch(line)
+		if match == nil || entry == nil {
+			continue
+		}
+
+		name := match[1]
+		values := match[2]
+
+		unit := ""
+		if unitMatch := regexJobStatsUnit.FindStringSubmatch(values); unitMatch != nil {
+			unit = unitMatch[1]
+		}
+
+		switch {
+		case name == "read_bytes" || (name == "read" && unit == "bytes"):
+			sum, err := parseJobStatsValue(regexJobStatsSum, values)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+			entry.readBytes += sum
+		case name == "write_bytes" || (name == "write" && unit == "bytes"):
+			sum, err := parseJobStatsValue(regexJobStatsSum, values)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+			entry.writeBytes += sum
+		default:
+			samples, err := parseJobStatsValue(regexJobStatsSample, values)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+			entry.operations += samples
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	appendJobStatsEntry(&entries, entry)
+
+	return entries, nil
+}
+
+func appendJobStatsEntry(entries *[]jobStatsEntry, entry *jobStatsEntry) *jobStatsEntry {
+	if entry != nil {
+		*entries = append(*entries, *entry)
+	}
+	return nil
+}
+
+func parseJobStatsValue(regex *regexp.Regexp, values string) (float64, error) {
+
+	match := regex.FindStringSubmatch(values)
+	if match == nil {
+		return 0, errors.New("value not found in: " + values)
+	}
+
+	return strconv.ParseFloat(match[1], 64)
+}
+
+func (s *jobStatsSource) Describe(ch chan<- *prometheus.Desc) {
+	s.readErrorsMetric.Describe(ch)
+	s.jobStatsJobsMetric.Describe(ch)
+}
+
+func (s *jobStatsSource) Collect(ch chan<- prometheus.Metric) {
+	s.readErrorsMetric.Collect(ch)
+	s.jobStatsJobsMetric.Collect(ch)
+}
@@ -0,0 +1,118 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseJobStats(t *testing.T) {
+
+	tests := []struct {
+		file     string
+		target   string
+		expected []jobStatsEntry
+	}{
+		{"lustre-2.5-ost.txt", "hebe-OST0000", []jobStatsEntry{
+			{"35044931", "hebe-OST0000", 0, 8192, 4096},
+		}},
+		{"lustre-2.10-mdt.txt", "hebe-MDT0000", []jobStatsEntry{
+			{"cp.1001", "hebe-MDT0000", 12, 0, 0},
+			{"35044931", "hebe-MDT0000", 300, 0, 0},
+		}},
+		{"lustre-2.12-ost.txt", "hebe-OST0001", []jobStatsEntry{
+			{"35044931", "hebe-OST0001", 1, 8392704, 8192},
+			{"dd.2001", "hebe-OST0001", 0, 0, 104857600},
+		}},
+		{"lustre-2.15-ost.txt", "hebe-OST0002", []jobStatsEntry{
+			{"my app.3001", "hebe-OST0002", 5, 24576, 65536},
+		}},
+		{"lctl-get-param.txt", "", []jobStatsEntry{
+			{"35044931", "hebe-MDT0000", 17, 0, 0},
+			{"35044931", "hebe-MDT0001", 3, 0, 0},
+			{"35044931", "hebe-OST0000", 0, 4096, 0},
+		}},
+	}
+
+	for _, test := range tests {
+
+		file, err := os.Open(filepath.Join("testdata", "jobstats", test.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := parseJobStats(file, test.target)
+		file.Close()
+
+		if err != nil {
+			t.Errorf("%s: %v", test.file, err)
+			continue
+		}
+
+		if len(entries) != len(test.expected) {
+			t.Errorf("%s: Expected %d entries - got: %d", test.file, len(test.expected), len(entries))
+			continue
+		}
+
+		for i, expected := range test.expected {
+			if entries[i] != expected {
+				t.Errorf("%s: Expected entry %+v - got: %+v", test.file, expected, entries[i])
+			}
+		}
+	}
+}
+
+func TestJobStatsSource(t *testing.T) {
+
+	dir := t.TempDir()
+	targetDir := filepath.Join(dir, "mdt", "hebe-MDT0000")
+
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	writeJobStats := func(samples string) {
+		content := "job_stats:\n- job_id:          35044931\n  snapshot_time:   1537070542\n" +
+			"  open:            { samples:    " + samples + ", unit:  reqs }\n"
+		if err := os.WriteFile(filepath.Join(targetDir, "job_stats"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	source, err := newJobStatsSource([]string{filepath.Join(dir, "mdt", "*", "job_stats")}, false, regexMetadataMDT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channel := make(chan lustreMetricsResult, 1)
+
+	writeJobStats("10")
+	source.retrieve(channel)
+	<-channel
+
+	writeJobStats("1000000")
+	source.retrieve(channel)
+	result := <-channel
+
+	if result.stages[0].err != nil {
+		t.Fatal(result.stages[0].err)
+	}
+
+	if len(*result.metadataOperations) != 1 {
+		t.Fatalf("Expected 1 metadata operation - got: %d", len(*result.metadataOperations))
+	}
+
+	metadataInfo := (*result.metadataOperations)[0]
+
+	if metadataInfo.jobid != "35044931" || metadataInfo.target != "hebe-MDT0000" || metadataInfo.operations <= 0 {
+		t.Errorf("Unexpected metadata operation: %+v", metadataInfo)
+	}
+}
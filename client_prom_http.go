@@ -9,25 +9,351 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
-func httpRequest(url string, requestTimeout int) (*[]byte, error) {
+const (
+	maxIdleConnsPerHost = 8
+	idleConnTimeout     = 5 * time.Minute
+)
+
+// promClientConfig holds the URL together with the authentication and
+// transport settings used for requests against a Prometheus endpoint.
+type promClientConfig struct {
+	url                   string
+	basicAuthUser         string
+	basicAuthPasswordFile string
+	bearerTokenFile       string
+	caFile                string
+	certFile              string
+	keyFile               string
+	insecureSkipVerify    bool
+	proxyURL              string
+	headers               map[string]string
+}
+
+// promRetryConfig controls the failover between Prometheus endpoints.
+// A request is retried on all endpoints up to retries times with an
+// exponential backoff including full jitter between the attempts.
+type promRetryConfig struct {
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	recovery   time.Duration
+}
+
+type promEndpoint struct {
+	config            promClientConfig
+	basicAuthPassword string
+	client            *http.Client
+	maxResponseSize   int64
+	lastFailure       time.Time
+}
+
+type promClient struct {
+	endpoints      []*promEndpoint
+	retryConfig    promRetryConfig
+	mutex          sync.Mutex
+	requestsMetric *prometheus.CounterVec
+	errorsMetric   *prometheus.CounterVec
+	healthyMetric  *prometheus.GaugeVec
+}
+
+func newPromClient(configs []promClientConfig, requestTimeout int, maxResponseSize int64, retryConfig promRetryConfig) (*promClient, error) {
+
+	if len(configs) == 0 {
+		return nil, errors.New("no Prometheus endpoint has been specified")
+	}
+
+	if requestTimeout <= 0 {
+		return nil, errors.New("request timeout must be greater then 0")
+	}
+
+	if maxResponseSize <= 0 {
+		return nil, errors.New("max response size must be greater then 0")
+	}
+
+	if retryConfig.retries < 0 {
+		return nil, errors.New("retries must not be negative")
+	}
+
+	endpoints := make([]*promEndpoint, 0, len(configs))
+
+	for _, config := range configs {
+		endpoint, err := newPromEndpoint(config, requestTimeout, maxResponseSize)
+		if err != nil {
+			return nil, fmt.Errorf("endpoint %s: %w", config.url, err)
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+
+	requestsMetric := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespaceInternals,
+			Name:      "prometheus_requests_total",
+			Help:      "Total HTTP requests sent to a Prometheus endpoint.",
+		},
+		[]string{"endpoint"})
+
+	errorsMetric := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespaceInternals,
+			Name:      "prometheus_request_errors_total",
+			Help:      "Total failed HTTP requests sent to a Prometheus endpoint.",
+		},
+		[]string{"endpoint"})
+
+	healthyMetric := newGaugeVecMetric(
+		namespaceInternals,
+		"prometheus_endpoint_healthy",
+		"Indicates if the last request to a Prometheus endpoint was successful or not.",
+		[]string{"endpoint"})
+
+	for _, endpoint := range endpoints {
+		requestsMetric.WithLabelValues(endpoint.config.url)
+		errorsMetric.WithLabelValues(endpoint.config.url)
+		healthyMetric.WithLabelValues(endpoint.config.url).Set(1)
+	}
+
+	return &promClient{
+		endpoints:      endpoints,
+		retryConfig:    retryConfig,
+		requestsMetric: requestsMetric,
+		errorsMetric:   errorsMetric,
+		healthyMetric:  healthyMetric,
+	}, nil
+}
+
+func newPromEndpoint(config promClientConfig, requestTimeout int, maxResponseSize int64) (*promEndpoint, error) {
+
+	if config.url == "" {
+		return nil, errors.New("endpoint URL is empty")
+	}
+
+	config.url = strings.TrimRight(config.url, "/")
+
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// The transport is shared by all requests to the endpoint to reuse connections
+	// for the concurrent queries. Responses are transparently gzip compressed,
+	// as long as no Accept-Encoding header is configured.
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsConfig,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: maxIdleConnsPerHost,
+		IdleConnTimeout:     idleConnTimeout,
+	}
+
+	if config.proxyURL != "" {
+		proxyURL, err := url.Parse(config.proxyURL)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	var basicAuthPassword string
+
+	if config.basicAuthPasswordFile != "" {
+		if config.basicAuthUser == "" {
+			return nil, errors.New("basic auth password file is set without a user")
+		}
+		basicAuthPassword, err = readSecretFile(config.basicAuthPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.basicAuthUser != "" && config.bearerTokenFile != "" {
+		return nil, errors.New("basic auth and bearer token are mutually exclusive")
+	}
+
+	return &promEndpoint{
+		config:            config,
+		basicAuthPassword: basicAuthPassword,
+		client: &http.Client{
+			Timeout:   time.Second * time.Duration(requestTimeout),
+			Transport: transport,
+		},
+		maxResponseSize: maxResponseSize,
+	}, nil
+}
+
+func newTLSConfig(config promClientConfig) (*tls.Config, error) {
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.insecureSkipVerify}
+
+	if config.caFile != "" {
+		caCert, err := ioutil.ReadFile(config.caFile)
+		if err != nil {
+			return nil, err
+		}
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("no valid certificates found in CA file: " + config.caFile)
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+
+	if (config.certFile == "") != (config.keyFile == "") {
+		return nil, errors.New("client certificate and key file must be set together")
+	}
+
+	if config.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.certFile, config.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// readSecretFile returns the content of a secret file without surrounding whitespace.
+func readSecretFile(path string) (string, error) {
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
+
+// orderedEndpoints returns the healthy endpoints in configured order followed
+// by the endpoints, which failed within the recovery period.
+func (c *promClient) orderedEndpoints() []*promEndpoint {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	var client = http.Client{Timeout: time.Second * time.Duration(requestTimeout)}
+	healthy := make([]*promEndpoint, 0, len(c.endpoints))
+	failed := make([]*promEndpoint, 0, len(c.endpoints))
+
+	for _, endpoint := range c.endpoints {
+		if !endpoint.lastFailure.IsZero() && time.Since(endpoint.lastFailure) < c.retryConfig.recovery {
+			failed = append(failed, endpoint)
+		} else {
+			healthy = append(healthy, endpoint)
+		}
+	}
+
+	return append(healthy, failed...)
+}
+
+// recordResult records the result of a request on the endpoint. Client errors
+// like 401 or 400 are counted, but neither fail the endpoint over nor clear a
+// previous failure, since a misconfigured endpoint must not become preferred.
+func (c *promClient) recordResult(endpoint *promEndpoint, err error) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.requestsMetric.WithLabelValues(endpoint.config.url).Inc()
+
+	switch {
+	case err == nil:
+		endpoint.lastFailure = time.Time{}
+		c.healthyMetric.WithLabelValues(endpoint.config.url).Set(1)
+	case isEndpointFailure(err):
+		endpoint.lastFailure = time.Now()
+		c.errorsMetric.WithLabelValues(endpoint.config.url).Inc()
+		c.healthyMetric.WithLabelValues(endpoint.config.url).Set(0)
+	default:
+		c.errorsMetric.WithLabelValues(endpoint.config.url).Inc()
+	}
+}
+
+func (c *promClient) backoff(attempt int) time.Duration {
+	return retryBackoff(c.retryConfig, attempt)
+}
+
+// retryBackoff returns the full jitter exponential backoff for the given retry attempt.
+func retryBackoff(retryConfig promRetryConfig, attempt int) time.Duration {
+
+	if retryConfig.backoff <= 0 {
+		return 0
+	}
+
+	backoff := retryConfig.backoff << uint(attempt)
+
+	// A negative value indicates an overflow of the shift.
+	if backoff <= 0 || backoff > retryConfig.maxBackoff {
+		backoff = retryConfig.maxBackoff
+	}
+
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// httpRequest sends a GET request for the path relative to the endpoint URL.
+// On errors the request fails over to the next endpoint and all endpoints
+// are retried until the configured retries are exhausted.
+func (c *promClient) httpRequest(path string) (*[]byte, error) {
+
+	var err error
+
+	for attempt := 0; attempt <= c.retryConfig.retries; attempt++ {
+
+		if attempt > 0 {
+			backoff := c.backoff(attempt - 1)
+			log.Debugf("Retrying HTTP request in %s (attempt %d of %d)", backoff, attempt, c.retryConfig.retries)
+			time.Sleep(backoff)
+		}
+
+		for _, endpoint := range c.orderedEndpoints() {
+
+			var body *[]byte
+
+			body, err = endpoint.httpRequest(path)
+
+			c.recordResult(endpoint, err)
+
+			if !isEndpointFailure(err) {
+				return body, err
+			}
+
+			log.Warning("HTTP request failed on Prometheus endpoint ", endpoint.config.url, ": ", err)
+		}
+	}
+
+	return nil, err
+}
+
+func (e *promEndpoint) httpRequest(path string) (*[]byte, error) {
+
+	url := e.config.url + path
 
 	log.Debug("Trying HTTP request for URL on Prometheus server: ", url)
 
 	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+
+	if err := e.authorize(req); err != nil {
+		return nil, err
 	}
 
-	res, err := client.Do(req)
+	res, err := e.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -36,10 +362,74 @@ func httpRequest(url string, requestTimeout int) (*[]byte, error) {
 		defer res.Body.Close()
 	}
 
-	body, err := ioutil.ReadAll(res.Body)
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, e.maxResponseSize+1))
 	if err != nil {
 		return nil, err
 	}
 
+	if int64(len(body)) > e.maxResponseSize {
+		return nil, fmt.Errorf("response exceeds max size of %d bytes", e.maxResponseSize)
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, newHTTPStatusError(res.StatusCode, body)
+	}
+
 	return &body, nil
 }
+
+// authorize sets the configured headers and credentials of the endpoint on the request.
+func (e *promEndpoint) authorize(req *http.Request) error {
+
+	for name, value := range e.config.headers {
+		req.Header.Set(name, value)
+	}
+
+	if e.config.basicAuthUser != "" {
+		req.SetBasicAuth(e.config.basicAuthUser, e.basicAuthPassword)
+	}
+
+	// The token file is read on each request to pick up rotated tokens.
+	if e.config.bearerTokenFile != "" {
+		token, err := readSecretFile(e.config.bearerTokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return nil
+}
+
+// isEndpointFailure reports if an error is specific to an endpoint, which
+// causes a failover, whereas client errors such as an invalid query are not.
+func isEndpointFailure(err error) bool {
+
+	if err == nil {
+		return false
+	}
+
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.statusCode >= http.StatusInternalServerError
+	}
+
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr.statusCode >= http.StatusInternalServerError
+	}
+
+	return true
+}
+
+func (c *promClient) Describe(ch chan<- *prometheus.Desc) {
+	c.requestsMetric.Describe(ch)
+	c.errorsMetric.Describe(ch)
+	c.healthyMetric.Describe(ch)
+}
+
+func (c *promClient) Collect(ch chan<- prometheus.Metric) {
+	c.requestsMetric.Collect(ch)
+	c.errorsMetric.Collect(ch)
+	c.healthyMetric.Collect(ch)
+}
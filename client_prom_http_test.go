@@ -0,0 +1,249 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const testMaxResponseSize = 1024
+
+func writeTestFile(t *testing.T, name string, content string) string {
+
+	path := filepath.Join(t.TempDir(), name)
+
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestPromClientAuthentication(t *testing.T) {
+
+	var gotAuthorization string
+	var gotTenant string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuthorization = r.Header.Get("Authorization")
+		gotTenant = r.Header.Get("X-Scope-Orgid")
+		w.Write([]byte(`{"status":"success"}`))
+	}))
+	defer server.Close()
+
+	config := promClientConfig{
+		basicAuthUser:         "alice",
+		basicAuthPasswordFile: writeTestFile(t, "password", "secret\n"),
+		headers:               map[string]string{"X-Scope-OrgID": "lustre"},
+	}
+
+	config.url = server.URL
+
+	client, err := newPromClient([]promClientConfig{config}, 5, testMaxResponseSize, promRetryConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.httpRequest("/"); err != nil {
+		t.Fatal(err)
+	}
+
+	// alice:secret
+	if gotAuthorization != "Basic YWxpY2U6c2VjcmV0" {
+		t.Errorf("Expected basic auth header - got: %s", gotAuthorization)
+	}
+	if gotTenant != "lustre" {
+		t.Errorf("Expected tenant header 'lustre' - got: %s", gotTenant)
+	}
+
+	config = promClientConfig{url: server.URL, bearerTokenFile: writeTestFile(t, "token", "abc123")}
+
+	client, err = newPromClient([]promClientConfig{config}, 5, testMaxResponseSize, promRetryConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.httpRequest("/"); err != nil {
+		t.Fatal(err)
+	}
+
+	if gotAuthorization != "Bearer abc123" {
+		t.Errorf("Expected bearer token header - got: %s", gotAuthorization)
+	}
+
+	config.basicAuthUser = "alice"
+
+	if _, err := newPromClient([]promClientConfig{config}, 5, testMaxResponseSize, promRetryConfig{}); err == nil {
+		t.Error("Expected error for basic auth combined with bearer token")
+	}
+}
+
+func TestPromClientTLS(t *testing.T) {
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"success"}`))
+	}))
+	defer server.Close()
+
+	client, err := newPromClient([]promClientConfig{{url: server.URL}}, 5, testMaxResponseSize, promRetryConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.httpRequest("/"); err == nil {
+		t.Error("Expected certificate verification error for unknown CA")
+	}
+
+	caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	client, err = newPromClient([]promClientConfig{{url: server.URL, caFile: writeTestFile(t, "ca.pem", string(caCert))}}, 5, testMaxResponseSize, promRetryConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.httpRequest("/"); err != nil {
+		t.Errorf("Unexpected error with CA file: %v", err)
+	}
+
+	client, err = newPromClient([]promClientConfig{{url: server.URL, insecureSkipVerify: true}}, 5, testMaxResponseSize, promRetryConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.httpRequest("/"); err != nil {
+		t.Errorf("Unexpected error with insecure skip verify: %v", err)
+	}
+}
+
+func TestPromClientFailover(t *testing.T) {
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	requests := 0
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{"status":"success"}`))
+	}))
+	defer healthy.Close()
+
+	configs := []promClientConfig{{url: failing.URL}, {url: healthy.URL}}
+	retryConfig := promRetryConfig{retries: 1, backoff: time.Millisecond, maxBackoff: time.Millisecond, recovery: time.Minute}
+
+	client, err := newPromClient(configs, 5, testMaxResponseSize, retryConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		body, err := client.httpRequest("/api/v1/query")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(*body) != `{"status":"success"}` {
+			t.Errorf("Unexpected body: %s", string(*body))
+		}
+	}
+
+	if requests != 2 {
+		t.Errorf("Expected 2 requests on healthy endpoint - got: %d", requests)
+	}
+
+	// The failed endpoint is ordered last within the recovery period.
+	if got := testutil.ToFloat64(client.errorsMetric.WithLabelValues(failing.URL)); got != 1 {
+		t.Errorf("Expected 1 error on failing endpoint - got: %f", got)
+	}
+	if got := testutil.ToFloat64(client.healthyMetric.WithLabelValues(failing.URL)); got != 0 {
+		t.Errorf("Expected failing endpoint to be unhealthy - got: %f", got)
+	}
+
+	healthy.Close()
+
+	if _, err := client.httpRequest("/api/v1/query"); err == nil {
+		t.Error("Expected error if all endpoints are failing")
+	}
+
+	// Two attempts on the two endpoints after the successful requests.
+	if got := testutil.ToFloat64(client.requestsMetric.WithLabelValues(failing.URL)); got != 3 {
+		t.Errorf("Expected 3 requests on failing endpoint - got: %f", got)
+	}
+}
+
+func TestPromClientErrorKeepsFailure(t *testing.T) {
+
+	status := http.StatusServiceUnavailable
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer failing.Close()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"success"}`))
+	}))
+	defer healthy.Close()
+
+	configs := []promClientConfig{{url: failing.URL}, {url: healthy.URL}}
+
+	client, err := newPromClient(configs, 5, testMaxResponseSize, promRetryConfig{recovery: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.httpRequest("/api/v1/query"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A 403 of the failed endpoint, e.g. by a broken proxy, is returned without failover,
+	// but must not mark the endpoint healthy again.
+	status = http.StatusForbidden
+	healthy.Close()
+
+	if _, err := client.httpRequest("/api/v1/query"); err == nil || isEndpointFailure(err) {
+		t.Errorf("Expected client error - got: %v", err)
+	}
+
+	if got := testutil.ToFloat64(client.healthyMetric.WithLabelValues(failing.URL)); got != 0 {
+		t.Errorf("Expected endpoint to stay unhealthy after a client error - got: %f", got)
+	}
+	if got := testutil.ToFloat64(client.errorsMetric.WithLabelValues(failing.URL)); got != 2 {
+		t.Errorf("Expected 2 errors on failing endpoint - got: %f", got)
+	}
+	if client.endpoints[0].lastFailure.IsZero() {
+		t.Error("Expected failure of the endpoint to be kept")
+	}
+}
+
+func TestPromClientMaxResponseSize(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, testMaxResponseSize+1))
+	}))
+	defer server.Close()
+
+	client, err := newPromClient([]promClientConfig{{url: server.URL}}, 5, testMaxResponseSize, promRetryConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.httpRequest("/"); err == nil {
+		t.Error("Expected error for response exceeding max size")
+	}
+}
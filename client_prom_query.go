@@ -0,0 +1,190 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+type queryResult struct {
+	elapsed float64
+	content *[]byte
+	err     error
+}
+
+// Names of the queries of a collection, by which the errors are counted.
+const (
+	queryNameMetadataOperations = "metadata_operations"
+	queryNameReadThroughput     = "read_throughput"
+	queryNameWriteThroughput    = "write_throughput"
+)
+
+// promSource retrieves the Lustre metrics with PromQL queries from a Prometheus server.
+type promSource struct {
+	client            *promClient
+	urls              *urlExportLustreMetrics
+	options           promQueryOptions
+	metadataTargets   *regexp.Regexp
+	queryErrorsMetric *prometheus.CounterVec
+}
+
+func newPromSource(client *promClient, urls *urlExportLustreMetrics, options promQueryOptions, metadataTargets *regexp.Regexp) *promSource {
+
+	queryErrorsMetric := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespaceInternals,
+			Name:      "query_errors_total",
+			Help:      "Total errors of the Prometheus queries by query and error type.",
+		},
+		[]string{"query", "type"})
+
+	return &promSource{
+		client:            client,
+		urls:              urls,
+		options:           options,
+		metadataTargets:   metadataTargets,
+		queryErrorsMetric: queryErrorsMetric,
+	}
+}
+
+// retrieve runs the queries concurrently and parses the responses.
+// The parsing is recorded in separate stages, if the query succeeded.
+func (s *promSource) retrieve(channel chan<- lustreMetricsResult) {
+
+	channelMetadataOperations := make(chan queryResult, 1)
+	channelJobReadBytes := make(chan queryResult, 1)
+	channelJobWriteBytes := make(chan queryResult, 1)
+
+	go s.query(queryNameMetadataOperations, s.urls.metadataOperations, channelMetadataOperations)
+	go s.query(queryNameReadThroughput, s.urls.jobReadBytes, channelJobReadBytes)
+	go s.query(queryNameWriteThroughput, s.urls.jobWriteBytes, channelJobWriteBytes)
+
+	var start time.Time
+	var err error
+
+	result := lustreMetricsResult{dropped: newDroppedEntries(), responses: make(map[string][]byte)}
+
+	metadataOperationsResult := <-channelMetadataOperations
+	jobReadBytesResult := <-channelJobReadBytes
+	jobWriteBytesResult := <-channelJobWriteBytes
+
+	result.stages = []stageResult{
+		{"query_metadata_operations", "MetadataOperationsChannel", metadataOperationsResult.elapsed, metadataOperationsResult.err},
+		{"query_read_throughput", "JobReadBytesChannel", jobReadBytesResult.elapsed, jobReadBytesResult.err},
+		{"query_write_throughput", "JobWriteBytesChannel", jobWriteBytesResult.elapsed, jobWriteBytesResult.err},
+	}
+
+	if metadataOperationsResult.err == nil {
+		start = time.Now()
+		result.metadataOperations, err = parseLustreMetadataOperations(metadataOperationsResult.content, s.metadataTargets, result.dropped)
+		result.stages = append(result.stages, stageResult{"parse_metadata_operations", "ParseMetadataOperations", time.Since(start).Seconds(), err})
+	}
+
+	if jobReadBytesResult.err == nil {
+		start = time.Now()
+		result.readThroughput, err = parseLustreTotalBytes(jobReadBytesResult.content, true, result.dropped)
+		result.stages = append(result.stages, stageResult{"parse_read_throughput", "ParseReadThroughput", time.Since(start).Seconds(), err})
+	}
+
+	if jobWriteBytesResult.err == nil {
+		start = time.Now()
+		result.writeThroughput, err = parseLustreTotalBytes(jobWriteBytesResult.content, false, result.dropped)
+		result.stages = append(result.stages, stageResult{"parse_write_throughput", "ParseWriteThroughput", time.Since(start).Seconds(), err})
+	}
+
+	for name, current := range map[string]queryResult{
+		queryNameMetadataOperations: metadataOperationsResult,
+		queryNameReadThroughput:     jobReadBytesResult,
+		queryNameWriteThroughput:    jobWriteBytesResult,
+	} {
+		if current.content != nil {
+			result.responses[name] = *current.content
+		}
+	}
+
+	channel <- result
+}
+
+// query requests a Prometheus query URL, validates the response and sends
+// the response content to the channel. Errors are counted by the query name.
+func (s *promSource) query(name string, url string, channel chan<- queryResult) {
+
+	start := time.Now()
+
+	content, err := s.client.httpRequest(url)
+	if err == nil {
+		err = checkQueryResponse(content)
+	}
+
+	elapsed := time.Since(start).Seconds()
+
+	if err != nil {
+		s.queryErrorsMetric.WithLabelValues(name, queryErrorType(err)).Inc()
+
+		if isPartialResult(err) {
+			log.Warning("Query ", name, " returned ", err, " - Query: ", decodeQuery(url))
+			err = nil
+		} else {
+			err = fmt.Errorf("query %s failed: %w - Query: %s", name, err, decodeQuery(url))
+		}
+	}
+
+	channel <- queryResult{elapsed, content, err}
+}
+
+// queryRange requests a range query with the time range placeholder replaced
+// and returns the series of the validated response.
+func (s *promSource) queryRange(name string, query string, timeRange string, start time.Time, end time.Time, step time.Duration) ([]rangeSeries, error) {
+
+	url := buildRangeQueryURL(query, timeRange, &s.options, start, end, step)
+
+	content, err := s.client.httpRequest(url)
+	if err == nil {
+		err = checkRangeQueryResponse(content)
+	}
+
+	if err != nil {
+		s.queryErrorsMetric.WithLabelValues(name, queryErrorType(err)).Inc()
+
+		if !isPartialResult(err) {
+			return nil, fmt.Errorf("query %s failed: %w - Query: %s", name, err, decodeQuery(url))
+		}
+
+		log.Warning("Query ", name, " returned ", err, " - Query: ", decodeQuery(url))
+	}
+
+	return parseRangeSeries(content)
+}
+
+// decodeQuery returns the PromQL expression of a query URL for logging.
+func decodeQuery(queryURL string) string {
+
+	parsed, err := url.Parse(queryURL)
+	if err != nil {
+		return queryURL
+	}
+
+	return parsed.Query().Get("query")
+}
+
+func (s *promSource) Describe(ch chan<- *prometheus.Desc) {
+	s.queryErrorsMetric.Describe(ch)
+	s.client.Describe(ch)
+}
+
+func (s *promSource) Collect(ch chan<- prometheus.Metric) {
+	s.queryErrorsMetric.Collect(ch)
+	s.client.Collect(ch)
+}
@@ -0,0 +1,83 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPromSourceRetrieveStages(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		query := r.URL.Query().Get("query")
+
+		switch {
+		case strings.Contains(query, "lustre_job_stats_total"):
+			w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"jobid":"1001","target":"hebe-MDT0000"},"value":[1700000000,"10"]}]}}`))
+		case strings.Contains(query, "lustre_job_read_bytes_total"):
+			w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"jobid":"1001"},"value":[1700000000,"5"]}]}}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	client, err := newPromClient([]promClientConfig{{url: server.URL}}, 5, testMaxResponseSize, promRetryConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := promQueryOptions{flavor: flavorPrometheus}
+	validateQueryOptions(&options)
+
+	urls, err := newUrlExportLustreMetrics(&queriesConfig{
+		TimeRange:          "1m",
+		MetadataOperations: queryMetadataOperations,
+		ReadThroughput:     queryJobReadBytes,
+		WriteThroughput:    queryJobWriteBytes,
+	}, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channel := make(chan lustreMetricsResult, 1)
+	newPromSource(client, urls, options, regexMetadataMDT).retrieve(channel)
+	result := <-channel
+
+	failed := make(map[string]bool)
+	for _, stage := range result.stages {
+		failed[stage.name] = stage.err != nil
+	}
+
+	expected := map[string]bool{
+		"query_metadata_operations": false,
+		"query_read_throughput":     false,
+		"query_write_throughput":    true,
+		"parse_metadata_operations": false,
+		"parse_read_throughput":     false,
+	}
+
+	if len(failed) != len(expected) {
+		t.Fatalf("Expected stages %v - got: %v", expected, failed)
+	}
+
+	for name, err := range expected {
+		if current, ok := failed[name]; !ok || current != err {
+			t.Errorf("Expected stage %s with failure %t - got: %v", name, err, failed)
+		}
+	}
+
+	if result.metadataOperations == nil || len(*result.metadataOperations) != 1 {
+		t.Errorf("Expected 1 metadata operation - got: %v", result.metadataOperations)
+	}
+}
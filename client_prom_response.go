@@ -0,0 +1,294 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buger/jsonparser"
+)
+
+const maxErrorBodyLength = 256
+
+// Values of the type label for the query errors metric.
+const (
+	queryErrorTypeRequest    = "request"
+	queryErrorTypeHTTP       = "http"
+	queryErrorTypeAPI        = "api"
+	queryErrorTypePartial    = "partial"
+	queryErrorTypeResultType = "result_type"
+	queryErrorTypeInvalid    = "invalid_response"
+)
+
+// httpStatusError is returned for a non 2xx HTTP status without an API error in the body.
+type httpStatusError struct {
+	statusCode int
+	body       string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status %d with body: %s", e.statusCode, e.body)
+}
+
+// apiError is returned if the Prometheus API responded with status error.
+type apiError struct {
+	statusCode int
+	errorType  string
+	message    string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("API error of type %s: %s", e.errorType, e.message)
+}
+
+// partialResultError is returned if the query result is possibly incomplete.
+// The result can still be used, but should be reported.
+type partialResultError struct {
+	warnings []string
+}
+
+func (e *partialResultError) Error() string {
+	if len(e.warnings) == 0 {
+		return "partial result"
+	}
+	return "partial result with warnings: " + strings.Join(e.warnings, "; ")
+}
+
+// resultTypeError is returned if the query result is not an instant vector
+// or for range queries not a range vector.
+type resultTypeError struct {
+	resultType string
+	expected   string
+}
+
+func (e *resultTypeError) Error() string {
+	return fmt.Sprintf("unexpected result type %s, expected %s", e.resultType, e.expected)
+}
+
+// invalidResponseError is returned if the response is not a valid query response.
+type invalidResponseError struct {
+	reason string
+}
+
+func (e *invalidResponseError) Error() string {
+	return "invalid query response: " + e.reason
+}
+
+func newHTTPStatusError(statusCode int, body []byte) error {
+
+	if err := parseAPIError(body); err != nil {
+		err.statusCode = statusCode
+		return err
+	}
+
+	if len(body) > maxErrorBodyLength {
+		body = body[:maxErrorBodyLength]
+	}
+
+	return &httpStatusError{statusCode, strings.TrimSpace(string(body))}
+}
+
+// parseAPIError returns the API error contained in the content or nil.
+func parseAPIError(content []byte) *apiError {
+
+	status, err := jsonparser.GetString(content, "status")
+	if err != nil || status != "error" {
+		return nil
+	}
+
+	errorType, _ := jsonparser.GetString(content, "errorType")
+	message, _ := jsonparser.GetString(content, "error")
+
+	return &apiError{errorType: errorType, message: message}
+}
+
+// checkQueryResponse validates the response of an instant query.
+// A partialResultError indicates that the result can be used nevertheless.
+func checkQueryResponse(content *[]byte) error {
+	return checkResponse(content, "vector")
+}
+
+// checkRangeQueryResponse validates the response of a range query.
+func checkRangeQueryResponse(content *[]byte) error {
+	return checkResponse(content, "matrix")
+}
+
+func checkResponse(content *[]byte, expectedResultType string) error {
+
+	if err := parseAPIError(*content); err != nil {
+		return err
+	}
+
+	status, err := jsonparser.GetString(*content, "status")
+	if err != nil {
+		return &invalidResponseError{"field status not found: " + err.Error()}
+	}
+	if status != "success" {
+		return &invalidResponseError{"value success not found in field status"}
+	}
+
+	resultType, err := jsonparser.GetString(*content, "data", "resultType")
+	if err != nil {
+		return &invalidResponseError{"field resultType not found: " + err.Error()}
+	}
+	if resultType != expectedResultType {
+		return &resultTypeError{resultType, expectedResultType}
+	}
+
+	warnings := make([]string, 0)
+
+	jsonparser.ArrayEach(*content, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+		warnings = append(warnings, string(value))
+	}, "warnings")
+
+	// VictoriaMetrics cluster marks responses as partial if storage nodes are unavailable.
+	isPartial, err := jsonparser.GetBoolean(*content, "isPartial")
+
+	if len(warnings) > 0 || (err == nil && isPartial) {
+		return &partialResultError{warnings}
+	}
+
+	return nil
+}
+
+func isPartialResult(err error) bool {
+	var partialErr *partialResultError
+	return errors.As(err, &partialErr)
+}
+
+// queryErrorType returns the type label value of the query errors metric for an error.
+func queryErrorType(err error) string {
+
+	var statusErr *httpStatusError
+	var apiErr *apiError
+	var resultTypeErr *resultTypeError
+	var invalidErr *invalidResponseError
+
+	switch {
+	case errors.As(err, &statusErr):
+		return queryErrorTypeHTTP
+	case errors.As(err, &apiErr):
+		return queryErrorTypeAPI
+	case isPartialResult(err):
+		return queryErrorTypePartial
+	case errors.As(err, &resultTypeErr):
+		return queryErrorTypeResultType
+	case errors.As(err, &invalidErr):
+		return queryErrorTypeInvalid
+	default:
+		return queryErrorTypeRequest
+	}
+}
+
+// rangeSeries is a series of a range query result.
+type rangeSeries struct {
+	labels  map[string]string
+	samples []rangeSample
+}
+
+type rangeSample struct {
+	timestamp time.Time
+	value     float64
+}
+
+// parseRangeSeries parses the series of a validated range query response.
+func parseRangeSeries(content *[]byte) ([]rangeSeries, error) {
+
+	series := make([]rangeSeries, 0)
+
+	var parseErr error
+
+	_, err := jsonparser.ArrayEach(*content, func(result []byte, dataType jsonparser.ValueType, offset int, err error) {
+
+		if parseErr != nil {
+			return
+		}
+
+		current := rangeSeries{labels: make(map[string]string)}
+
+		// The label values are unescaped like by GetString for the instant queries.
+		err = jsonparser.ObjectEach(result, func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
+
+			label, err := jsonparser.ParseString(value)
+			if err != nil {
+				return err
+			}
+
+			current.labels[string(key)] = label
+
+			return nil
+		}, "metric")
+
+		if err != nil && err != jsonparser.KeyPathNotFoundError {
+			parseErr = &invalidResponseError{"invalid field metric: " + err.Error()}
+			return
+		}
+
+		_, err = jsonparser.ArrayEach(result, func(pair []byte, dataType jsonparser.ValueType, offset int, err error) {
+
+			if parseErr != nil {
+				return
+			}
+
+			sample, err := parseRangeSample(pair)
+			if err != nil {
+				parseErr = err
+				return
+			}
+
+			current.samples = append(current.samples, sample)
+
+		}, "values")
+
+		if err != nil && parseErr == nil {
+			parseErr = &invalidResponseError{"field values not found: " + err.Error()}
+		}
+
+		series = append(series, current)
+
+	}, "data", "result")
+
+	if parseErr != nil {
+		return nil, parseErr
+	}
+
+	if err != nil {
+		return nil, &invalidResponseError{"field result not found: " + err.Error()}
+	}
+
+	return series, nil
+}
+
+// parseRangeSample parses a sample given as [<unix time>, "<value>"].
+func parseRangeSample(pair []byte) (rangeSample, error) {
+
+	timestamp, err := jsonparser.GetFloat(pair, "[0]")
+	if err != nil {
+		return rangeSample{}, &invalidResponseError{"sample timestamp not found: " + err.Error()}
+	}
+
+	value, err := jsonparser.GetString(pair, "[1]")
+	if err != nil {
+		return rangeSample{}, &invalidResponseError{"sample value not found: " + err.Error()}
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return rangeSample{}, &invalidResponseError{"sample value is not a number: " + value}
+	}
+
+	seconds := int64(timestamp)
+	nanoseconds := int64((timestamp - float64(seconds)) * 1e9)
+
+	return rangeSample{time.Unix(seconds, nanoseconds), number}, nil
+}
@@ -0,0 +1,112 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckQueryResponse(t *testing.T) {
+
+	tests := []struct {
+		data              string
+		expectedErrorType string
+	}{
+		{`{"status":"success","data":{"resultType":"vector","result":[]}}`, ""},
+		{`{"status":"error","errorType":"bad_data","error":"parse error"}`, queryErrorTypeAPI},
+		{`{"status":"success","data":{"resultType":"matrix","result":[]}}`, queryErrorTypeResultType},
+		{`{"status":"success","warnings":["store unavailable"],"data":{"resultType":"vector","result":[]}}`, queryErrorTypePartial},
+		{`{"status":"success","isPartial":true,"data":{"resultType":"vector","result":[]}}`, queryErrorTypePartial},
+		{`<html>Bad Gateway</html>`, queryErrorTypeInvalid},
+	}
+
+	for _, test := range tests {
+
+		content := []byte(test.data)
+		err := checkQueryResponse(&content)
+
+		if test.expectedErrorType == "" {
+			if err != nil {
+				t.Errorf("Unexpected error for %s: %v", test.data, err)
+			}
+			continue
+		}
+
+		if err == nil {
+			t.Errorf("Expected error for %s", test.data)
+			continue
+		}
+
+		if got := queryErrorType(err); got != test.expectedErrorType {
+			t.Errorf("Expected error type %s for %s - got: %s", test.expectedErrorType, test.data, got)
+		}
+	}
+}
+
+func TestPromClientAPIError(t *testing.T) {
+
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"invalid parameter \"query\""}`))
+	}))
+	defer server.Close()
+
+	configs := []promClientConfig{{url: server.URL}, {url: server.URL}}
+
+	client, err := newPromClient(configs, 5, testMaxResponseSize, promRetryConfig{retries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.httpRequest("/api/v1/query")
+
+	apiErr, ok := err.(*apiError)
+	if !ok {
+		t.Fatalf("Expected API error - got: %v", err)
+	}
+
+	if apiErr.errorType != "bad_data" || apiErr.statusCode != http.StatusBadRequest {
+		t.Errorf("Unexpected API error: %v", apiErr)
+	}
+
+	// Client errors do not fail over to other endpoints.
+	if requests != 1 {
+		t.Errorf("Expected 1 request - got: %d", requests)
+	}
+}
+
+func TestParseRangeSeries(t *testing.T) {
+
+	content := []byte(`{"status":"success","data":{"resultType":"matrix","result":[
+		{"metric":{"jobid":"cp.1001","path":"/lustre/\"a\\b\"/\u00e9"},"values":[[1700000000,"1.5"],[1700000060,"2"]]}]}}`)
+
+	series, err := parseRangeSeries(&content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(series) != 1 || len(series[0].samples) != 2 || series[0].samples[1].value != 2 {
+		t.Fatalf("Unexpected series: %+v", series)
+	}
+
+	if got := series[0].labels["path"]; got != `/lustre/"a\b"/é` {
+		t.Errorf("Expected unescaped label value - got: %s", got)
+	}
+
+	content = []byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"jobid":"1001"}}]}}`)
+
+	if _, err := parseRangeSeries(&content); err == nil {
+		t.Error("Expected error for series without values")
+	}
+}
@@ -0,0 +1,143 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const SACCT = "sacct"
+
+// Time format of sacct without a time zone, which is the local time.
+const sacctTimeFormat = "2006-01-02T15:04:05"
+
+// jobRecord is the accounting record of a Slurm job. The end of a job,
+// which is still running, is the time the records were retrieved.
+type jobRecord struct {
+	jobInfo
+	start time.Time
+	end   time.Time
+	state string
+}
+
+// retrieveJobRecord returns the accounting record of the job allocation.
+func retrieveJobRecord(jobid string) (*jobRecord, error) {
+
+	records, err := runSacct("--jobs", jobid)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range records {
+		if records[i].jobid == jobid {
+			return &records[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("job not found in sacct: %s", jobid)
+}
+
+// runSacct runs sacct with the arguments selecting the jobs and parses the
+// records of the job allocations.
+func runSacct(args ...string) ([]jobRecord, error) {
+
+	if _, err := exec.LookPath(SACCT); err != nil {
+		return nil, err
+	}
+
+	args = append(args, "--allocations", "--noheader", "--parsable2", "--format", "JobID,JobIDRaw,Account,User,Start,End,State")
+
+	out, err := newCommand(SACCT, args...).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("sacct failed: %w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, err
+	}
+
+	return parseSacctRecords(out, time.Now())
+}
+
+// parseSacctRecords parses the parsable sacct output with the fields
+// JobID|JobIDRaw|Account|User|Start|End|State. The jobid is the raw one like
+// SLURM_JOB_ID, e.g. 1240 for the array job 1234_5. Of a heterogeneous job only
+// the first component 123+0 with the jobid of the job is kept.
+// Jobs, which did not start yet, are skipped.
+func parseSacctRecords(content []byte, now time.Time) ([]jobRecord, error) {
+
+	records := make([]jobRecord, 0)
+
+	for i, line := range strings.Split(string(bytes.TrimSpace(content)), "\n") {
+
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Split(line, "|")
+
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("expected 7 fields in sacct line %d: %s", i+1, line)
+		}
+
+		if index := strings.IndexByte(fields[0], '+'); index >= 0 && fields[0][index+1:] != "0" {
+			continue
+		}
+
+		start, ok, err := parseSacctTime(fields[4])
+		if err != nil {
+			return nil, fmt.Errorf("invalid start in sacct line %d: %w", i+1, err)
+		}
+		if !ok {
+			continue
+		}
+
+		end, ok, err := parseSacctTime(fields[5])
+		if err != nil {
+			return nil, fmt.Errorf("invalid end in sacct line %d: %w", i+1, err)
+		}
+		if !ok {
+			end = now
+		}
+
+		// States like CANCELLED by 1001 are reduced to the state.
+		state := fields[6]
+		if index := strings.IndexByte(state, ' '); index >= 0 {
+			state = state[:index]
+		}
+
+		records = append(records, jobRecord{
+			jobInfo: jobInfo{jobid: fields[1], account: fields[2], user: fields[3]},
+			start:   start,
+			end:     end,
+			state:   state,
+		})
+	}
+
+	return records, nil
+}
+
+// parseSacctTime returns false for times not set like Unknown or None.
+func parseSacctTime(value string) (time.Time, bool, error) {
+
+	switch value {
+	case "", "Unknown", "None":
+		return time.Time{}, false, nil
+	}
+
+	t, err := time.ParseInLocation(sacctTimeFormat, value, time.Local)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	return t, true, nil
+}
@@ -0,0 +1,62 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSacctRecords(t *testing.T) {
+
+	now := time.Date(2023, 5, 2, 12, 0, 0, 0, time.Local)
+
+	content := []byte(`1001|1001|hpc|alice|2023-05-02T10:00:00|2023-05-02T11:30:00|COMPLETED
+1002|1002|hpc|bob|2023-05-02T11:00:00|Unknown|RUNNING
+1003|1003|phys|carol|None|Unknown|PENDING
+1004|1004|phys|carol|2023-05-02T09:00:00|2023-05-02T09:10:00|CANCELLED by 1003
+1234_5|1240|phys|dave|2023-05-02T08:00:00|2023-05-02T08:30:00|COMPLETED
+1300+0|1300|hpc|erin|2023-05-02T07:00:00|2023-05-02T07:30:00|COMPLETED
+1300+1|1301|hpc|erin|2023-05-02T07:00:00|2023-05-02T07:30:00|COMPLETED
+`)
+
+	records, err := parseSacctRecords(content, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 5 {
+		t.Fatalf("Expected 5 started jobs - got: %d", len(records))
+	}
+
+	if records[0].jobid != "1001" || records[0].account != "hpc" || records[0].user != "alice" ||
+		records[0].end.Sub(records[0].start) != 90*time.Minute {
+		t.Errorf("Unexpected record: %+v", records[0])
+	}
+
+	if !records[1].end.Equal(now) {
+		t.Errorf("Expected end of running job at %s - got: %s", now, records[1].end)
+	}
+
+	if records[2].state != "CANCELLED" {
+		t.Errorf("Expected state CANCELLED - got: %s", records[2].state)
+	}
+
+	if records[3].jobid != "1240" || records[3].user != "dave" {
+		t.Errorf("Expected raw jobid 1240 of the array job - got: %+v", records[3])
+	}
+
+	if records[4].jobid != "1300" {
+		t.Errorf("Expected only the first component 1300 of the heterogeneous job - got: %+v", records[4])
+	}
+
+	if _, err := parseSacctRecords([]byte("1001|1001|hpc|alice\n"), now); err == nil {
+		t.Error("Expected error for missing fields")
+	}
+}
@@ -10,8 +10,8 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"os/exec"
 	"strings"
 	"time"
@@ -26,6 +26,7 @@ type jobInfo struct {
 type runningJobsResult struct {
 	elapsed float64
 	jobs    []jobInfo
+	content []byte
 	err     error
 }
 
@@ -35,51 +36,74 @@ func retrieveRunningJobs(channel chan<- runningJobsResult) {
 
 	start := time.Now()
 
+	// A missing squeue fails the stage instead of the exporter.
 	_, err := exec.LookPath(SQUEUE)
 	if err != nil {
-		log.Fatal(err)
+		channel <- runningJobsResult{0, nil, nil, err}
+		return
 	}
 
-	cmd := exec.Command(SQUEUE, "-ah", "-o", "%A %a %u")
+	cmd := newCommand(SQUEUE, "-ah", "-o", "%A %a %u")
 
 	pipe, err := cmd.StdoutPipe()
 	if err != nil {
-		channel <- runningJobsResult{0, nil, err}
+		channel <- runningJobsResult{0, nil, nil, err}
 		return
 	}
 
 	err = cmd.Start()
 	if err != nil {
-		channel <- runningJobsResult{0, nil, err}
+		channel <- runningJobsResult{0, nil, nil, err}
 		return
 	}
 
 	out, err := ioutil.ReadAll(pipe)
 	if err != nil {
-		channel <- runningJobsResult{0, nil, err}
+		channel <- runningJobsResult{0, nil, nil, err}
 		return
 	}
 
 	// TODO Timeout handling?
 	err = cmd.Wait()
 	if err != nil {
-		channel <- runningJobsResult{0, nil, err}
+		channel <- runningJobsResult{0, nil, nil, err}
+		return
+	}
+
+	jobs, err := parseRunningJobs(out)
+	if err != nil {
+		channel <- runningJobsResult{0, nil, out, err}
 		return
 	}
 
+	elapsed := time.Since(start).Seconds()
+
+	channel <- runningJobsResult{elapsed, jobs, out, nil}
+}
+
+// parseRunningJobs parses the squeue output with the fields jobid, account
+// and user. An empty output is no running jobs.
+func parseRunningJobs(out []byte) ([]jobInfo, error) {
+
 	// TrimSpace on []bytes is more efficient than calling TrimSpace on a string since it creates a copy
 	content := string(bytes.TrimSpace(out))
 
-	lines := strings.Split(content, "\n")
+	jobs := make([]jobInfo, 0)
+
+	if content == "" {
+		return jobs, nil
+	}
 
-	jobs := make([]jobInfo, len(lines))
+	for i, line := range strings.Split(content, "\n") {
 
-	for i, line := range lines {
 		fields := strings.Fields(line)
-		jobs[i] = jobInfo{fields[0], fields[1], fields[2]}
-	}
 
-	elapsed := time.Since(start).Seconds()
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("expected 3 fields in squeue line %d: %s", i+1, line)
+		}
+
+		jobs = append(jobs, jobInfo{fields[0], fields[1], fields[2]})
+	}
 
-	channel <- runningJobsResult{elapsed, jobs, nil}
+	return jobs, nil
 }
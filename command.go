@@ -0,0 +1,22 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"context"
+	"os/exec"
+)
+
+// Child processes are bound to the process context, so
+// killProcesses kills all still running ones on shutdown.
+var processContext, killProcesses = context.WithCancel(context.Background())
+
+func newCommand(name string, args ...string) *exec.Cmd {
+	return exec.CommandContext(processContext, name, args...)
+}
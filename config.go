@@ -0,0 +1,648 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Default files read by the file identity backend.
+const (
+	defaultPasswdFile = "/etc/passwd"
+	defaultGroupFile  = "/etc/group"
+)
+
+// config is the YAML configuration file of the exporter.
+// Settings not given in the file default to the command line flags.
+type config struct {
+	Source   sourceConfig   `yaml:"source"`
+	Queries  queriesConfig  `yaml:"queries"`
+	Labels   labelsConfig   `yaml:"labels"`
+	Filters  filtersConfig  `yaml:"filters"`
+	Identity identityConfig `yaml:"identity"`
+}
+
+type sourceConfig struct {
+	Type           string                     `yaml:"type"`
+	Prometheus     promSourceConfig           `yaml:"prometheus"`
+	LustreExporter lustreExporterSourceConfig `yaml:"lustre_exporter"`
+	JobStats       jobStatsSourceConfig       `yaml:"jobstats"`
+}
+
+type promSourceConfig struct {
+	Servers                            []promServerConfig `yaml:"servers"`
+	Flavor                             string             `yaml:"flavor"`
+	APIPrefix                          string             `yaml:"api_prefix"`
+	ThanosDedup                        bool               `yaml:"thanos_dedup"`
+	ThanosPartialResponse              bool               `yaml:"thanos_partial_response"`
+	VictoriaMetricsDenyPartialResponse bool               `yaml:"victoriametrics_deny_partial_response"`
+	Tenant                             string             `yaml:"tenant"`
+	TenantHeader                       string             `yaml:"tenant_header"`
+	Timeout                            int                `yaml:"timeout"`
+	MaxResponseSize                    int64              `yaml:"max_response_size"`
+	BasicAuth                          basicAuthConfig    `yaml:"basic_auth"`
+	BearerTokenFile                    string             `yaml:"bearer_token_file"`
+	TLSConfig                          tlsClientConfig    `yaml:"tls_config"`
+	ProxyURL                           string             `yaml:"proxy_url"`
+	Headers                            map[string]string  `yaml:"headers"`
+	Retries                            int                `yaml:"retries"`
+	RetryBackoff                       model.Duration     `yaml:"retry_backoff"`
+	RetryMaxBackoff                    model.Duration     `yaml:"retry_max_backoff"`
+	FailoverRecovery                   model.Duration     `yaml:"failover_recovery"`
+}
+
+// promServerConfig is a replica of the prometheus source. Its authentication and TLS
+// settings replace the shared settings of the source, if given.
+type promServerConfig struct {
+	URL             string           `yaml:"url"`
+	BasicAuth       *basicAuthConfig `yaml:"basic_auth,omitempty"`
+	BearerTokenFile string           `yaml:"bearer_token_file,omitempty"`
+	TLSConfig       *tlsClientConfig `yaml:"tls_config,omitempty"`
+}
+
+// UnmarshalYAML accepts a plain URL as well as a server object.
+func (s *promServerConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+
+	if err := unmarshal(&s.URL); err == nil {
+		return nil
+	}
+
+	type plain promServerConfig
+
+	return unmarshal((*plain)(s))
+}
+
+// newPromServerConfigs creates the servers given by URL only.
+func newPromServerConfigs(urls []string) []promServerConfig {
+
+	servers := make([]promServerConfig, 0, len(urls))
+
+	for _, url := range urls {
+		servers = append(servers, promServerConfig{URL: url})
+	}
+
+	return servers
+}
+
+type basicAuthConfig struct {
+	Username     string `yaml:"username"`
+	PasswordFile string `yaml:"password_file"`
+}
+
+type tlsClientConfig struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+type lustreExporterSourceConfig struct {
+	Targets         []string `yaml:"targets"`
+	Timeout         int      `yaml:"timeout"`
+	MaxResponseSize int64    `yaml:"max_response_size"`
+}
+
+type jobStatsSourceConfig struct {
+	Paths []string `yaml:"paths"`
+	Lctl  bool     `yaml:"lctl"`
+}
+
+// queriesConfig holds the PromQL queries of the prometheus source.
+// The placeholder __TIME_RANGE__ is replaced by the time range.
+type queriesConfig struct {
+	TimeRange          string `yaml:"time_range"`
+	MetadataOperations string `yaml:"metadata_operations"`
+	ReadThroughput     string `yaml:"read_throughput"`
+	WriteThroughput    string `yaml:"write_throughput"`
+}
+
+type labelsConfig struct {
+	External map[string]string `yaml:"external"`
+}
+
+// filtersConfig holds regular expressions, which are fully anchored.
+type filtersConfig struct {
+	MetadataTargets  string   `yaml:"metadata_targets"`
+	ExcludeAccounts  []string `yaml:"exclude_accounts"`
+	ExcludeUsers     []string `yaml:"exclude_users"`
+	ExcludeProcNames []string `yaml:"exclude_proc_names"`
+}
+
+type identityConfig struct {
+	Users  identityBackendConfig `yaml:"users"`
+	Groups identityBackendConfig `yaml:"groups"`
+}
+
+type identityBackendConfig struct {
+	Backend string `yaml:"backend"`
+	File    string `yaml:"file"`
+}
+
+// Labels set by the exporter, which must not be used as external labels.
+var reservedLabels = []string{"account", "user", "target", "proc_name", "group_name", "user_name", "metric"}
+
+// loadConfig reads the configuration file on top of a copy of the base config.
+// The base config is returned as copy, if no file is given.
+func loadConfig(path string, base *config) (*config, error) {
+
+	// Copying by marshalling keeps the base config untouched, since
+	// unmarshalling merges into maps instead of replacing them.
+	content, err := yaml.Marshal(base)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &config{}
+
+	if err := yaml.Unmarshal(content, cfg); err != nil {
+		return nil, err
+	}
+
+	if path == "" {
+		return cfg, nil
+	}
+
+	content, err = ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// loadCollectionSettings loads the configuration and creates the collection settings.
+func loadCollectionSettings(path string, base *config) (*collectionSettings, error) {
+
+	cfg, err := loadConfig(path, base)
+	if err != nil {
+		return nil, err
+	}
+
+	return newCollectionSettings(cfg)
+}
+
+// newCollectionSettings validates the configuration and creates the collection settings.
+// Errors are prefixed by the path of the invalid setting.
+func newCollectionSettings(cfg *config) (*collectionSettings, error) {
+
+	settings, err := newAttributionSettings(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	settings.sourceType = cfg.Source.Type
+	settings.sourceFingerprint = sourceFingerprint(cfg)
+
+	settings.source, err = newLustreSourceFromConfig(cfg, settings.metadataTargets)
+	if err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+// newReloadedSettings creates the collection settings of a reloaded configuration,
+// but keeps the current source, if its settings and files did not change.
+// So the counter rates and the error counters of the source survive the reload.
+func newReloadedSettings(cfg *config, current *collectionSettings) (*collectionSettings, error) {
+
+	fingerprint := sourceFingerprint(cfg)
+
+	if fingerprint == "" || fingerprint != current.sourceFingerprint {
+		return newCollectionSettings(cfg)
+	}
+
+	settings, err := newAttributionSettings(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug("Keeping the unchanged ", current.sourceType, " source")
+
+	settings.sourceType = current.sourceType
+	settings.sourceFingerprint = current.sourceFingerprint
+	settings.source = current.source
+
+	return settings, nil
+}
+
+// sourceFingerprint identifies the settings of the configured source including the
+// content of its password and certificate files. It is empty, if a file cannot be read.
+func sourceFingerprint(cfg *config) string {
+
+	source := struct {
+		Type            string
+		MetadataTargets string
+		Settings        interface{}
+		Queries         *queriesConfig
+	}{Type: cfg.Source.Type, MetadataTargets: cfg.Filters.MetadataTargets}
+
+	var files []string
+
+	switch cfg.Source.Type {
+	case sourcePrometheus:
+		source.Settings = &cfg.Source.Prometheus
+		source.Queries = &cfg.Queries
+		files = []string{cfg.Source.Prometheus.BasicAuth.PasswordFile, cfg.Source.Prometheus.TLSConfig.CAFile,
+			cfg.Source.Prometheus.TLSConfig.CertFile, cfg.Source.Prometheus.TLSConfig.KeyFile}
+		for _, server := range cfg.Source.Prometheus.Servers {
+			if server.BasicAuth != nil {
+				files = append(files, server.BasicAuth.PasswordFile)
+			}
+			if server.TLSConfig != nil {
+				files = append(files, server.TLSConfig.CAFile, server.TLSConfig.CertFile, server.TLSConfig.KeyFile)
+			}
+		}
+	case sourceLustreExporter:
+		source.Settings = &cfg.Source.LustreExporter
+	case sourceJobStats:
+		source.Settings = &cfg.Source.JobStats
+	}
+
+	content, err := yaml.Marshal(&source)
+	if err != nil {
+		return ""
+	}
+
+	hash := sha256.New()
+	hash.Write(content)
+
+	for _, file := range files {
+
+		if file == "" {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return ""
+		}
+
+		hash.Write([]byte(file))
+		hash.Write(content)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// newAttributionSettings creates the collection settings without the source,
+// which are sufficient for replaying a recorded collection.
+func newAttributionSettings(cfg *config) (*collectionSettings, error) {
+
+	metadataTargets, err := compileAnchoredRegexp(cfg.Filters.MetadataTargets)
+	if err != nil {
+		return nil, fmt.Errorf("filters.metadata_targets: %w", err)
+	}
+
+	filters, err := newCollectionFilters(&cfg.Filters)
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := newIdentityBackend(&cfg.Identity.Users, defaultPasswdFile)
+	if err != nil {
+		return nil, fmt.Errorf("identity.users: %w", err)
+	}
+
+	groups, err := newIdentityBackend(&cfg.Identity.Groups, defaultGroupFile)
+	if err != nil {
+		return nil, fmt.Errorf("identity.groups: %w", err)
+	}
+
+	externalLabels, err := newExternalLabels(cfg.Labels.External)
+	if err != nil {
+		return nil, fmt.Errorf("labels.external: %w", err)
+	}
+
+	return &collectionSettings{
+		metadataTargets: metadataTargets,
+		filters:         filters,
+		users:           users,
+		groups:          groups,
+		externalLabels:  externalLabels,
+	}, nil
+}
+
+func newLustreSourceFromConfig(cfg *config, metadataTargets *regexp.Regexp) (lustreSource, error) {
+
+	switch cfg.Source.Type {
+	case sourcePrometheus:
+		s, err := newPromSourceFromConfig(&cfg.Source.Prometheus, &cfg.Queries, metadataTargets)
+		if err != nil {
+			return nil, fmt.Errorf("source.prometheus: %w", err)
+		}
+		return s, nil
+	case sourceLustreExporter:
+		c := &cfg.Source.LustreExporter
+		s, err := newLustreExporterSource(c.Targets, c.Timeout, c.MaxResponseSize, metadataTargets)
+		if err != nil {
+			return nil, fmt.Errorf("source.lustre_exporter: %w", err)
+		}
+		return s, nil
+	case sourceJobStats:
+		s, err := newJobStatsSource(cfg.Source.JobStats.Paths, cfg.Source.JobStats.Lctl, metadataTargets)
+		if err != nil {
+			return nil, fmt.Errorf("source.jobstats: %w", err)
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("source.type: source is not supported: %s", cfg.Source.Type)
+	}
+}
+
+func newPromSourceFromConfig(cfg *promSourceConfig, queries *queriesConfig, metadataTargets *regexp.Regexp) (*promSource, error) {
+
+	if len(cfg.Servers) == 0 {
+		return nil, errors.New("no Prometheus server has been specified")
+	}
+
+	if queries.MetadataOperations == "" || queries.ReadThroughput == "" || queries.WriteThroughput == "" {
+		return nil, errors.New("queries must not be empty")
+	}
+
+	queryOptions := promQueryOptions{
+		flavor:                cfg.Flavor,
+		apiPrefix:             cfg.APIPrefix,
+		thanosDedup:           cfg.ThanosDedup,
+		thanosPartialResponse: cfg.ThanosPartialResponse,
+		vmDenyPartialResponse: cfg.VictoriaMetricsDenyPartialResponse,
+	}
+
+	urlExports, err := newUrlExportLustreMetrics(queries, &queryOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make(map[string]string, len(cfg.Headers)+1)
+
+	for name, value := range cfg.Headers {
+		headers[http.CanonicalHeaderKey(name)] = value
+	}
+
+	if cfg.Tenant != "" {
+		headers[http.CanonicalHeaderKey(cfg.TenantHeader)] = cfg.Tenant
+	}
+
+	clientConfigs := make([]promClientConfig, 0, len(cfg.Servers))
+
+	for i, server := range cfg.Servers {
+
+		if server.URL == "" {
+			return nil, fmt.Errorf("servers[%d]: url must not be empty", i)
+		}
+
+		// The authentication of a server replaces basic auth and bearer token of the
+		// source together, so both are not combined.
+		basicAuth, bearerTokenFile := cfg.BasicAuth, cfg.BearerTokenFile
+
+		if server.BasicAuth != nil || server.BearerTokenFile != "" {
+			basicAuth, bearerTokenFile = basicAuthConfig{}, server.BearerTokenFile
+			if server.BasicAuth != nil {
+				basicAuth = *server.BasicAuth
+			}
+		}
+
+		tlsConfig := cfg.TLSConfig
+
+		if server.TLSConfig != nil {
+			tlsConfig = *server.TLSConfig
+		}
+
+		clientConfigs = append(clientConfigs, promClientConfig{
+			url:                   server.URL,
+			basicAuthUser:         basicAuth.Username,
+			basicAuthPasswordFile: basicAuth.PasswordFile,
+			bearerTokenFile:       bearerTokenFile,
+			caFile:                tlsConfig.CAFile,
+			certFile:              tlsConfig.CertFile,
+			keyFile:               tlsConfig.KeyFile,
+			insecureSkipVerify:    tlsConfig.InsecureSkipVerify,
+			proxyURL:              cfg.ProxyURL,
+			headers:               headers,
+		})
+	}
+
+	retryConfig := promRetryConfig{
+		retries:    cfg.Retries,
+		backoff:    time.Duration(cfg.RetryBackoff),
+		maxBackoff: time.Duration(cfg.RetryMaxBackoff),
+		recovery:   time.Duration(cfg.FailoverRecovery),
+	}
+
+	client, err := newPromClient(clientConfigs, cfg.Timeout, cfg.MaxResponseSize, retryConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return newPromSource(client, urlExports, queryOptions, metadataTargets), nil
+}
+
+func newCollectionFilters(cfg *filtersConfig) (*collectionFilters, error) {
+
+	filters := &collectionFilters{}
+
+	lists := []struct {
+		name     string
+		exprs    []string
+		compiled *[]*regexp.Regexp
+	}{
+		{"exclude_accounts", cfg.ExcludeAccounts, &filters.excludeAccounts},
+		{"exclude_users", cfg.ExcludeUsers, &filters.excludeUsers},
+		{"exclude_proc_names", cfg.ExcludeProcNames, &filters.excludeProcNames},
+	}
+
+	for _, list := range lists {
+		for i, expr := range list.exprs {
+			regex, err := compileAnchoredRegexp(expr)
+			if err != nil {
+				return nil, fmt.Errorf("filters.%s[%d]: %w", list.name, i, err)
+			}
+			*list.compiled = append(*list.compiled, regex)
+		}
+	}
+
+	return filters, nil
+}
+
+func compileAnchoredRegexp(expr string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+func newIdentityBackend(cfg *identityBackendConfig, defaultFile string) (identityBackend, error) {
+
+	switch cfg.Backend {
+	case identityBackendGetent:
+		return identityBackend{backend: identityBackendGetent}, nil
+	case identityBackendFile:
+		file := cfg.File
+		if file == "" {
+			file = defaultFile
+		}
+		if _, err := os.Stat(file); err != nil {
+			return identityBackend{}, err
+		}
+		return identityBackend{backend: identityBackendFile, file: file}, nil
+	default:
+		return identityBackend{}, fmt.Errorf("backend is not supported: %s", cfg.Backend)
+	}
+}
+
+func newExternalLabels(labels map[string]string) (prometheus.Labels, error) {
+
+	externalLabels := make(prometheus.Labels, len(labels))
+
+	for name, value := range labels {
+
+		if !model.LabelName(name).IsValid() {
+			return nil, fmt.Errorf("invalid label name: %s", name)
+		}
+
+		for _, reserved := range reservedLabels {
+			if name == reserved {
+				return nil, fmt.Errorf("label name is reserved by the exporter: %s", name)
+			}
+		}
+
+		externalLabels[name] = value
+	}
+
+	return externalLabels, nil
+}
+
+// configReloader reloads the configuration file on SIGHUP and on POST /-/reload.
+// The secret files of the sources are read again on a reload as well, whereby
+// the source is only created again, if its settings or files changed.
+type configReloader struct {
+	path                             string
+	base                             *config
+	exporter                         *exporter
+	mutex                            sync.Mutex
+	lastReloadSuccessfulMetric       prometheus.Gauge
+	lastReloadSuccessTimestampMetric prometheus.Gauge
+}
+
+func newConfigReloader(path string, base *config, exporter *exporter) *configReloader {
+
+	lastReloadSuccessfulMetric := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespaceInternals,
+		Name:      "config_last_reload_successful",
+		Help:      "Indicates if the last configuration reload was successful or not.",
+	})
+
+	lastReloadSuccessTimestampMetric := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespaceInternals,
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Timestamp of the last successful configuration reload.",
+	})
+
+	// The initial configuration has been loaded successfully by the caller.
+	lastReloadSuccessfulMetric.Set(1)
+	lastReloadSuccessTimestampMetric.SetToCurrentTime()
+
+	return &configReloader{
+		path:                             path,
+		base:                             base,
+		exporter:                         exporter,
+		lastReloadSuccessfulMetric:       lastReloadSuccessfulMetric,
+		lastReloadSuccessTimestampMetric: lastReloadSuccessTimestampMetric,
+	}
+}
+
+// reload replaces the collection settings of the exporter. On an error the
+// previous settings are kept.
+func (r *configReloader) reload() error {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.path != "" {
+		log.Info("Reloading configuration file: ", r.path)
+	} else {
+		log.Info("Reloading configuration from flags")
+	}
+
+	cfg, err := loadConfig(r.path, r.base)
+	if err != nil {
+		r.lastReloadSuccessfulMetric.Set(0)
+		return err
+	}
+
+	settings, err := newReloadedSettings(cfg, r.exporter.currentSettings())
+	if err != nil {
+		r.lastReloadSuccessfulMetric.Set(0)
+		return err
+	}
+
+	r.exporter.updateSettings(settings)
+
+	r.lastReloadSuccessfulMetric.Set(1)
+	r.lastReloadSuccessTimestampMetric.SetToCurrentTime()
+
+	log.Info("Configuration reloaded")
+
+	return nil
+}
+
+// watchSignals reloads the configuration on each SIGHUP.
+func (r *configReloader) watchSignals() {
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		if err := r.reload(); err != nil {
+			log.Error("Failed to reload configuration: ", err)
+		}
+	}
+}
+
+func (r *configReloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.reload(); err != nil {
+		log.Error("Failed to reload configuration: ", err)
+		http.Error(w, "Failed to reload configuration: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (r *configReloader) Describe(ch chan<- *prometheus.Desc) {
+	r.lastReloadSuccessfulMetric.Describe(ch)
+	r.lastReloadSuccessTimestampMetric.Describe(ch)
+}
+
+func (r *configReloader) Collect(ch chan<- prometheus.Metric) {
+	r.lastReloadSuccessfulMetric.Collect(ch)
+	r.lastReloadSuccessTimestampMetric.Collect(ch)
+}
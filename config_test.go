@@ -0,0 +1,288 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+)
+
+func newTestBaseConfig() *config {
+	return &config{
+		Source: sourceConfig{
+			Type: sourcePrometheus,
+			Prometheus: promSourceConfig{
+				Servers:         newPromServerConfigs([]string{"http://prometheus:9090"}),
+				Flavor:          flavorPrometheus,
+				TenantHeader:    defaultTenantHeader,
+				Timeout:         defaultRequestTimeout,
+				MaxResponseSize: defaultMaxResponseSize,
+				Headers:         map[string]string{"X-Flag": "flag"},
+				RetryBackoff:    model.Duration(defaultRetryBackoff),
+			},
+		},
+		Queries: queriesConfig{
+			TimeRange:          defaultTimeRange,
+			MetadataOperations: queryMetadataOperations,
+			ReadThroughput:     queryJobReadBytes,
+			WriteThroughput:    queryJobWriteBytes,
+		},
+		Filters: filtersConfig{
+			MetadataTargets: regexMetadataMDT.String(),
+		},
+		Identity: identityConfig{
+			Users:  identityBackendConfig{Backend: identityBackendGetent},
+			Groups: identityBackendConfig{Backend: identityBackendGetent},
+		},
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+
+	base := newTestBaseConfig()
+
+	path := writeTestFile(t, "config.yml", `
+source:
+  prometheus:
+    servers: [http://replica-a:9090, http://replica-b:9090]
+    headers:
+      X-File: file
+    retry_backoff: 2s
+queries:
+  time_range: 2m
+labels:
+  external:
+    cluster: virgo
+filters:
+  exclude_accounts: [admin, "test.*"]
+`)
+
+	cfg, err := loadConfig(path, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.Source.Prometheus.Servers) != 2 {
+		t.Errorf("Expected 2 servers - got: %v", cfg.Source.Prometheus.Servers)
+	}
+	if cfg.Source.Prometheus.Flavor != flavorPrometheus {
+		t.Errorf("Expected flavor from base config - got: %s", cfg.Source.Prometheus.Flavor)
+	}
+	if cfg.Source.Prometheus.Headers["X-Flag"] != "flag" || cfg.Source.Prometheus.Headers["X-File"] != "file" {
+		t.Errorf("Expected merged headers - got: %v", cfg.Source.Prometheus.Headers)
+	}
+	if time.Duration(cfg.Source.Prometheus.RetryBackoff) != 2*time.Second {
+		t.Errorf("Expected retry backoff 2s - got: %s", cfg.Source.Prometheus.RetryBackoff)
+	}
+	if cfg.Queries.MetadataOperations != queryMetadataOperations {
+		t.Errorf("Expected default query - got: %s", cfg.Queries.MetadataOperations)
+	}
+	if _, ok := base.Source.Prometheus.Headers["X-File"]; ok {
+		t.Error("Expected base config to be untouched")
+	}
+
+	settings, err := newCollectionSettings(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if settings.externalLabels["cluster"] != "virgo" {
+		t.Errorf("Expected external label cluster - got: %v", settings.externalLabels)
+	}
+	if !settings.filters.excludeJob(&jobInfo{"1", "testing", "user"}) {
+		t.Error("Expected account testing to be excluded")
+	}
+	if settings.filters.excludeJob(&jobInfo{"1", "admins", "user"}) {
+		t.Error("Expected exclude filter to be anchored")
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+
+	tests := []struct {
+		content  string
+		expected string
+	}{
+		{"source:\n  typ: jobstats\n", "field typ not found"},
+		{"source:\n  type: slurm\n", "source.type: source is not supported: slurm"},
+		{"source:\n  prometheus:\n    flavor: cortex\n", "source.prometheus: query backend flavor is not supported: cortex"},
+		{"source:\n  prometheus:\n    servers:\n    - urll: http://prometheus:9090\n", "field urll not found"},
+		{"queries:\n  time_range: 1w\n", "source.prometheus: time range unit is not supported: w"},
+		{"filters:\n  exclude_users: [ok, \"(\"]\n", "filters.exclude_users[1]: error parsing regexp"},
+		{"labels:\n  external:\n    user: x\n", "labels.external: label name is reserved by the exporter: user"},
+		{"labels:\n  external:\n    metric: x\n", "labels.external: label name is reserved by the exporter: metric"},
+		{"identity:\n  groups:\n    backend: ldap\n", "identity.groups: backend is not supported: ldap"},
+	}
+
+	for _, test := range tests {
+
+		path := writeTestFile(t, "config.yml", test.content)
+
+		_, err := loadCollectionSettings(path, newTestBaseConfig())
+
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("Expected error containing '%s' - got: %v", test.expected, err)
+		}
+	}
+}
+
+func TestPromServerCredentials(t *testing.T) {
+
+	authorizations := make(map[string]string)
+
+	// The first replica fails, so the request is sent to both replicas.
+	replicaA := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorizations["a"] = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer replicaA.Close()
+
+	replicaB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorizations["b"] = r.Header.Get("Authorization")
+		w.Write([]byte(`{"status":"success"}`))
+	}))
+	defer replicaB.Close()
+
+	path := writeTestFile(t, "config.yml", `
+source:
+  prometheus:
+    servers:
+    - `+replicaA.URL+`
+    - url: `+replicaB.URL+`
+      bearer_token_file: `+writeTestFile(t, "token", "abc123")+`
+    basic_auth:
+      username: alice
+      password_file: `+writeTestFile(t, "password", "secret\n")+`
+`)
+
+	settings, err := loadCollectionSettings(path, newTestBaseConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := settings.source.(*promSource).client.httpRequest("/"); err != nil {
+		t.Fatal(err)
+	}
+
+	// alice:secret
+	if authorizations["a"] != "Basic YWxpY2U6c2VjcmV0" {
+		t.Errorf("Expected shared basic auth on replica a - got: %s", authorizations["a"])
+	}
+	if authorizations["b"] != "Bearer abc123" {
+		t.Errorf("Expected own bearer token on replica b - got: %s", authorizations["b"])
+	}
+
+	path = writeTestFile(t, "config.yml", "source:\n  prometheus:\n    servers:\n    - bearer_token_file: token\n")
+
+	if _, err := loadCollectionSettings(path, newTestBaseConfig()); err == nil || !strings.Contains(err.Error(), "servers[0]: url must not be empty") {
+		t.Errorf("Expected error for server without url - got: %v", err)
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+
+	path := writeTestFile(t, "config.yml", "labels:\n  external:\n    cluster: virgo\n")
+
+	base := newTestBaseConfig()
+
+	settings, err := loadCollectionSettings(path, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := newExporter(settings, 0, 0, time.Minute)
+	reloader := newConfigReloader(path, base, e)
+
+	if err := ioutil.WriteFile(path, []byte("labels:\n  external:\n    cluster: kronos\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	reloader.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/-/reload", nil))
+
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405 for GET - got: %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	reloader.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected status 200 - got: %d", recorder.Code)
+	}
+	if got := e.currentSettings().externalLabels["cluster"]; got != "kronos" {
+		t.Errorf("Expected reloaded external label kronos - got: %s", got)
+	}
+	if e.currentSettings().source != settings.source {
+		t.Error("Expected unchanged source to be kept")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("labels:\n  external:\n    cluster: kronos\nqueries:\n  time_range: 5m\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reloader.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if e.currentSettings().source == settings.source {
+		t.Error("Expected source to be created again for changed queries")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("source:\n  type: slurm\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder = httptest.NewRecorder()
+	reloader.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status 500 for invalid config - got: %d", recorder.Code)
+	}
+	if got := testutil.ToFloat64(reloader.lastReloadSuccessfulMetric); got != 0 {
+		t.Errorf("Expected config_last_reload_successful 0 - got: %f", got)
+	}
+	if got := e.currentSettings().externalLabels["cluster"]; got != "kronos" {
+		t.Errorf("Expected previous settings to be kept - got: %s", got)
+	}
+}
+
+func TestFileIdentityBackend(t *testing.T) {
+
+	passwd := writeTestFile(t, "passwd", "root:x:0:0:root:/root:/bin/bash\nalice:x:1001:2001::/home/alice:/bin/bash\n")
+	group := writeTestFile(t, "group", "root:x:0:\nhpc:x:2001:alice\n")
+
+	userChannel := make(chan userInfoMapResult, 1)
+	groupChannel := make(chan groupInfoMapResult, 1)
+
+	createUserInfoMap(userChannel, identityBackend{backend: identityBackendFile, file: passwd})
+	createGroupInfoMap(groupChannel, identityBackend{backend: identityBackendFile, file: group})
+
+	userResult := <-userChannel
+	groupResult := <-groupChannel
+
+	if userResult.err != nil || groupResult.err != nil {
+		t.Fatal(userResult.err, groupResult.err)
+	}
+
+	info, _, err := resolveProcInfo("cp.1001", userResult.users, groupResult.groups)
+	if err != nil || info == nil {
+		t.Fatal("Failed to resolve proc info: ", err)
+	}
+
+	if info.userName != "alice" || info.groupName != "hpc" {
+		t.Errorf("Expected alice and hpc - got: %s and %s", info.userName, info.groupName)
+	}
+}
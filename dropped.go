@@ -0,0 +1,151 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Reasons for dropping a Lustre job metrics entry, which could not be attributed.
+const (
+	dropReasonMissingJobID   = "missing_jobid"
+	dropReasonNonMDTTarget   = "non_mdt_target"
+	dropReasonInvalidUID     = "unparseable_uid"
+	dropReasonUnknownUID     = "unknown_uid"
+	dropReasonUnknownGID     = "unknown_gid"
+	dropReasonJobNotInSqueue = "jobid_not_in_squeue"
+)
+
+// Lustre job metrics of the dropped entries.
+const (
+	droppedMetadataOperations = "metadata_operations"
+	droppedReadThroughput     = "read_throughput"
+	droppedWriteThroughput    = "write_throughput"
+)
+
+// Each metric and reason is logged as warning at most once per interval.
+const dropLogInterval = 10 * time.Minute
+
+type dropKey struct {
+	metric string
+	reason string
+}
+
+// droppedEntries collects the entries dropped in a collection together with
+// the sum of their metadata operations or throughput and an example jobid.
+type droppedEntries struct {
+	counts   map[dropKey]int
+	values   map[dropKey]float64
+	examples map[dropKey]string
+}
+
+func newDroppedEntries() *droppedEntries {
+	return &droppedEntries{
+		counts:   make(map[dropKey]int),
+		values:   make(map[dropKey]float64),
+		examples: make(map[dropKey]string),
+	}
+}
+
+func (d *droppedEntries) add(metric string, reason string, value float64, jobid string) {
+
+	key := dropKey{metric, reason}
+
+	d.counts[key]++
+	d.values[key] += value
+
+	if _, ok := d.examples[key]; !ok {
+		d.examples[key] = jobid
+	}
+}
+
+func (d *droppedEntries) keys() []dropKey {
+
+	keys := make([]dropKey, 0, len(d.counts))
+	for key := range d.counts {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].metric != keys[j].metric {
+			return keys[i].metric < keys[j].metric
+		}
+		return keys[i].reason < keys[j].reason
+	})
+
+	return keys
+}
+
+func droppedThroughputMetric(read bool) string {
+	if read {
+		return droppedReadThroughput
+	}
+	return droppedWriteThroughput
+}
+
+// dropMetrics counts the dropped entries over all collections and logs
+// a deduplicated summary per metric and reason instead of each entry.
+type dropMetrics struct {
+	entriesMetric *prometheus.CounterVec
+	mutex         sync.Mutex
+	lastLogged    map[dropKey]time.Time
+}
+
+func newDropMetrics() *dropMetrics {
+
+	entriesMetric := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespaceInternals,
+			Name:      "dropped_entries_total",
+			Help:      "Total Lustre job metrics entries dropped by metric and reason, since they could not be attributed.",
+		},
+		[]string{"metric", "reason"})
+
+	return &dropMetrics{
+		entriesMetric: entriesMetric,
+		lastLogged:    make(map[dropKey]time.Time),
+	}
+}
+
+func (m *dropMetrics) record(dropped *droppedEntries) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+
+	for _, key := range dropped.keys() {
+
+		m.entriesMetric.WithLabelValues(key.metric, key.reason).Add(float64(dropped.counts[key]))
+
+		message := fmt.Sprintf("Dropped %d %s entries with reason %s representing %.1f per second - e.g. jobid: %s",
+			dropped.counts[key], key.metric, key.reason, dropped.values[key], dropped.examples[key])
+
+		if now.Sub(m.lastLogged[key]) >= dropLogInterval {
+			log.Warning(message)
+			m.lastLogged[key] = now
+		} else {
+			log.Debug(message)
+		}
+	}
+}
+
+func (m *dropMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.entriesMetric.Describe(ch)
+}
+
+func (m *dropMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.entriesMetric.Collect(ch)
+}
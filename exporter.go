@@ -9,31 +9,62 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"net"
+	"os"
+	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/buger/jsonparser"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	log "github.com/sirupsen/logrus"
 )
 
 var regexMetadataMDT *regexp.Regexp = regexp.MustCompile(`^.*-MDT[[:xdigit:]]{4}$`)
 
 type exporter struct {
-	channelRunningJobs           chan runningJobsResult
-	channelUserInfo              chan userInfoMapResult
-	channelGroupInfo             chan groupInfoMapResult
-	scrapeActive                 bool
-	scrapeMutex                  sync.Mutex
-	requestTimeout               int
-	urlLustreMetadataOperations  string
-	urlLustreJobReadBytes        string
-	urlLustreJobWriteBytes       string
-	scrapeOKMetric               prometheus.Gauge
+	channelRunningJobs   chan runningJobsResult
+	channelUserInfo      chan userInfoMapResult
+	channelGroupInfo     chan groupInfoMapResult
+	channelLustreMetrics chan lustreMetricsResult
+	inflight             *inflightCollection
+	scrapeMutex          sync.Mutex
+	stopped              bool
+	stopChannel          chan struct{}
+	collections          sync.WaitGroup
+	settings             atomic.Value
+	lastSuccess          atomic.Value
+	collectionInterval   time.Duration
+	collectionMaxWait    time.Duration
+	snapshotMaxAge       time.Duration
+	snapshot             atomic.Value
+	snapshotHandlers     []func(*snapshot)
+	inputHandlers        []func(*collectionInputs)
+	scrapeOKMetric       prometheus.Gauge
+	snapshotAgeMetric    prometheus.Gauge
+	stageMetrics         *stageMetrics
+	dropMetrics          *dropMetrics
+	describeMetrics      *collectionMetrics
+}
+
+// stageMetrics are counted over all collections, so stage failures
+// can be alerted on independent of a single scrape.
+type stageMetrics struct {
+	runsMetric        *prometheus.CounterVec
+	failuresMetric    *prometheus.CounterVec
+	lastSuccessMetric *prometheus.GaugeVec
+	durationMetric    *prometheus.HistogramVec
+}
+
+// collectionMetrics holds the metrics computed by a single collection.
+type collectionMetrics struct {
 	stageExecutionMetric         *prometheus.GaugeVec
 	jobMetadataOperationsMetric  *prometheus.GaugeVec
 	jobReadThroughputMetric      *prometheus.GaugeVec
@@ -41,6 +72,56 @@ type exporter struct {
 	procMetadataOperationsMetric *prometheus.GaugeVec
 	procReadThroughputMetric     *prometheus.GaugeVec
 	procWriteThroughputMetric    *prometheus.GaugeVec
+	droppedVolumeMetric          *prometheus.GaugeVec
+	unattributedMetadataMetric   *prometheus.GaugeVec
+	unattributedReadMetric       *prometheus.GaugeVec
+	unattributedWriteMetric      *prometheus.GaugeVec
+	attributionCoverageMetric    *prometheus.GaugeVec
+	jobs                         jobIOMap
+	procs                        procIOMap
+}
+
+// collectionSettings are the settings of a collection, which are replaced on a reload.
+type collectionSettings struct {
+	sourceType        string
+	sourceFingerprint string
+	source            lustreSource
+	metadataTargets   *regexp.Regexp
+	filters           *collectionFilters
+	users             identityBackend
+	groups            identityBackend
+	externalLabels    prometheus.Labels
+}
+
+// collectionFilters select the series exported by a collection.
+// The exclude filters are checked against the resolved names.
+type collectionFilters struct {
+	excludeAccounts  []*regexp.Regexp
+	excludeUsers     []*regexp.Regexp
+	excludeProcNames []*regexp.Regexp
+}
+
+// inflightCollection is shared by concurrent scrapes waiting for its snapshot.
+type inflightCollection struct {
+	done     chan struct{}
+	snapshot *snapshot
+}
+
+// snapshot is the immutable result of a collection.
+type snapshot struct {
+	timestamp time.Time
+	scrapeOK  bool
+	stages    []stageStatus
+	metrics   []prometheus.Metric
+	jobs      jobIOMap
+	procs     procIOMap
+}
+
+// stageStatus is the execution duration and error of a stage of a collection.
+type stageStatus struct {
+	name    string
+	elapsed float64
+	err     error
 }
 
 type metadataInfo struct {
@@ -54,6 +135,33 @@ type throughputInfo struct {
 	throughput float64
 }
 
+// jobIO is the Lustre IO of a single Slurm job in a collection, which is
+// only aggregated per account and user in the exported metrics.
+type jobIO struct {
+	jobid              string
+	account            string
+	user               string
+	metadataOperations map[string]float64
+	readThroughput     float64
+	writeThroughput    float64
+}
+
+// jobIOMap maps the jobid to the IO of the job.
+type jobIOMap map[string]*jobIO
+
+// procIO is the Lustre IO of a process name of a user in a collection.
+type procIO struct {
+	procName           string
+	userName           string
+	groupName          string
+	metadataOperations map[string]float64
+	readThroughput     float64
+	writeThroughput    float64
+}
+
+// procIOMap maps the Lustre jobid of the process e.g. cp.1001 to its IO.
+type procIOMap map[string]*procIO
+
 type procInfo struct {
 	procName  string
 	userName  string
@@ -61,21 +169,28 @@ type procInfo struct {
 }
 
 func newGaugeVecMetric(namespace string, metricName string, docString string, constLabels []string) *prometheus.GaugeVec {
+	return newExternalGaugeVecMetric(namespace, metricName, docString, constLabels, nil)
+}
+
+// newExternalGaugeVecMetric creates a GaugeVec with the configured external labels.
+func newExternalGaugeVecMetric(namespace string, metricName string, docString string, constLabels []string,
+	externalLabels prometheus.Labels) *prometheus.GaugeVec {
 	return prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      metricName,
-			Help:      docString,
+			Namespace:   namespace,
+			Name:        metricName,
+			Help:        docString,
+			ConstLabels: externalLabels,
 		},
 		constLabels,
 	)
 }
 
-func newExporter(requestTimeout int, urlLustreMetadataOperations string, urlLustreJobReadBytes string, urlLustreJobWriteBytes string) *exporter {
-
-	if requestTimeout <= 0 {
-		log.Fatal("Request timeout must be greater then 0")
-	}
+// newExporter creates the exporter. With a collection interval greater than 0
+// the collection runs in the background and scrapes return the latest snapshot,
+// which is withheld if it is older than the snapshot max age. Otherwise concurrent
+// scrapes share the in-flight collection and wait up to the collection max wait.
+func newExporter(settings *collectionSettings, collectionInterval time.Duration, snapshotMaxAge time.Duration, collectionMaxWait time.Duration) *exporter {
 
 	scrapeOKMetric := prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: namespaceInternals,
@@ -83,57 +198,224 @@ func newExporter(requestTimeout int, urlLustreMetadataOperations string, urlLust
 		Help:      "Indicates if the scrape of the exporter was successful or not.",
 	})
 
+	snapshotAgeMetric := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespaceInternals,
+		Name:      "snapshot_age_seconds",
+		Help:      "Age in seconds of the snapshot of the collected metrics.",
+	})
+
+	e := &exporter{
+		channelRunningJobs:   make(chan runningJobsResult),
+		channelUserInfo:      make(chan userInfoMapResult),
+		channelGroupInfo:     make(chan groupInfoMapResult),
+		channelLustreMetrics: make(chan lustreMetricsResult),
+		collectionInterval:   collectionInterval,
+		collectionMaxWait:    collectionMaxWait,
+		snapshotMaxAge:       snapshotMaxAge,
+		scrapeOKMetric:       scrapeOKMetric,
+		snapshotAgeMetric:    snapshotAgeMetric,
+		stageMetrics:         newStageMetrics(),
+		dropMetrics:          newDropMetrics(),
+		describeMetrics:      newCollectionMetrics(settings.externalLabels),
+		stopChannel:          make(chan struct{}),
+	}
+
+	e.settings.Store(settings)
+
+	return e
+}
+
+// updateSettings replaces the settings used from the next collection on.
+func (e *exporter) updateSettings(settings *collectionSettings) {
+	e.settings.Store(settings)
+}
+
+func (e *exporter) currentSettings() *collectionSettings {
+	return e.settings.Load().(*collectionSettings)
+}
+
+func newStageMetrics() *stageMetrics {
+
+	runsMetric := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespaceInternals,
+			Name:      "stage_runs_total",
+			Help:      "Total runs of a specific exporter stage.",
+		},
+		[]string{"stage"})
+
+	failuresMetric := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespaceInternals,
+			Name:      "stage_failures_total",
+			Help:      "Total failed runs of a specific exporter stage by reason.",
+		},
+		[]string{"stage", "reason"})
+
+	lastSuccessMetric := newGaugeVecMetric(
+		namespaceInternals,
+		"stage_last_success_timestamp_seconds",
+		"Timestamp of the last successful run of a specific exporter stage.",
+		[]string{"stage"})
+
+	durationMetric := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespaceInternals,
+			Name:      "stage_duration_seconds",
+			Help:      "Execution duration in seconds of a specific exporter stage.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+		},
+		[]string{"stage"})
+
+	return &stageMetrics{
+		runsMetric:        runsMetric,
+		failuresMetric:    failuresMetric,
+		lastSuccessMetric: lastSuccessMetric,
+		durationMetric:    durationMetric,
+	}
+}
+
+func (m *stageMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.runsMetric,
+		m.failuresMetric,
+		m.lastSuccessMetric,
+		m.durationMetric,
+	}
+}
+
+// record counts a run of a stage with its duration and the reason of a failure.
+func (m *stageMetrics) record(stage string, elapsed float64, err error) {
+
+	m.runsMetric.WithLabelValues(stage).Inc()
+	m.durationMetric.WithLabelValues(stage).Observe(elapsed)
+
+	if err != nil {
+		m.failuresMetric.WithLabelValues(stage, stageFailureReason(err)).Inc()
+	} else {
+		m.lastSuccessMetric.WithLabelValues(stage).SetToCurrentTime()
+	}
+}
+
+// stageFailureReason classifies the error of a stage for the failure counter.
+func stageFailureReason(err error) string {
+
+	var exitErr *exec.ExitError
+	var execErr *exec.Error
+	var pathErr *os.PathError
+	var netErr net.Error
+	var statusErr *httpStatusError
+	var apiErr *apiError
+	var resultTypeErr *resultTypeError
+	var invalidErr *invalidResponseError
+
+	switch {
+	case errors.As(err, &exitErr):
+		return "exit_status"
+	case errors.As(err, &execErr):
+		return "exec"
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		return "timeout"
+	case errors.As(err, &netErr):
+		return "network"
+	case errors.As(err, &statusErr):
+		return "http_status"
+	case errors.As(err, &apiErr):
+		return "api"
+	case errors.As(err, &resultTypeErr), errors.As(err, &invalidErr):
+		return "invalid_response"
+	case errors.As(err, &pathErr):
+		return "file"
+	default:
+		return "error"
+	}
+}
+
+func newCollectionMetrics(externalLabels prometheus.Labels) *collectionMetrics {
+
 	stageExecutionMetric := newGaugeVecMetric(
 		namespaceInternals,
 		"stage_execution_seconds",
 		"Execution duration in seconds spend in a specific exporter stage.",
 		[]string{"name"})
 
-	jobMetadataOperationsMetric := newGaugeVecMetric(
+	jobMetadataOperationsMetric := newExternalGaugeVecMetric(
 		namespace,
 		"job_metadata_operations",
 		"Total metadata operations of all jobs per account and user on a target.",
-		[]string{"account", "user", "target"})
+		[]string{"account", "user", "target"},
+		externalLabels)
 
-	jobReadThroughputMetric := newGaugeVecMetric(
+	jobReadThroughputMetric := newExternalGaugeVecMetric(
 		namespace,
 		"job_read_throughput_bytes",
 		"Total IO read throughput of all jobs per account and user in bytes per second.",
-		[]string{"account", "user"})
+		[]string{"account", "user"},
+		externalLabels)
 
-	jobWriteThroughputMetric := newGaugeVecMetric(
+	jobWriteThroughputMetric := newExternalGaugeVecMetric(
 		namespace,
 		"job_write_throughput_bytes",
 		"Total IO write throughput of all jobs per account and user in bytes per second.",
-		[]string{"account", "user"})
+		[]string{"account", "user"},
+		externalLabels)
 
-	procMetadataOperationsMetric := newGaugeVecMetric(
+	procMetadataOperationsMetric := newExternalGaugeVecMetric(
 		namespace,
 		"proc_metadata_operations",
 		"Total metadata operations of process names per group and user on a MDT.",
-		[]string{"proc_name", "group_name", "user_name", "target"})
+		[]string{"proc_name", "group_name", "user_name", "target"},
+		externalLabels)
 
-	procReadThroughputMetric := newGaugeVecMetric(
+	procReadThroughputMetric := newExternalGaugeVecMetric(
 		namespace,
 		"proc_read_throughput_bytes",
 		"Total IO read throughput of process names per group and user in bytes per second.",
-		[]string{"proc_name", "group_name", "user_name"})
+		[]string{"proc_name", "group_name", "user_name"},
+		externalLabels)
 
-	procWriteThroughputMetric := newGaugeVecMetric(
+	procWriteThroughputMetric := newExternalGaugeVecMetric(
 		namespace,
 		"proc_write_throughput_bytes",
 		"Total IO write throughput of process names per group and user in bytes per second.",
-		[]string{"proc_name", "group_name", "user_name"})
-
-	return &exporter{
-		channelRunningJobs:           make(chan runningJobsResult),
-		channelUserInfo:              make(chan userInfoMapResult),
-		channelGroupInfo:             make(chan groupInfoMapResult),
-		requestTimeout:               requestTimeout,
-		urlLustreMetadataOperations:  urlLustreMetadataOperations,
-		urlLustreJobReadBytes:        urlLustreJobReadBytes,
-		urlLustreJobWriteBytes:       urlLustreJobWriteBytes,
-		scrapeOKMetric:               scrapeOKMetric,
+		[]string{"proc_name", "group_name", "user_name"},
+		externalLabels)
+
+	unattributedMetadataMetric := newExternalGaugeVecMetric(
+		namespace,
+		"unattributed_metadata_operations",
+		"Total metadata operations of Slurm jobids not found in squeue on a target.",
+		[]string{"target"},
+		externalLabels)
+
+	unattributedReadMetric := newExternalGaugeVecMetric(
+		namespace,
+		"unattributed_read_throughput_bytes",
+		"Total IO read throughput of Slurm jobids not found in squeue in bytes per second.",
+		[]string{},
+		externalLabels)
+
+	unattributedWriteMetric := newExternalGaugeVecMetric(
+		namespace,
+		"unattributed_write_throughput_bytes",
+		"Total IO write throughput of Slurm jobids not found in squeue in bytes per second.",
+		[]string{},
+		externalLabels)
+
+	attributionCoverageMetric := newExternalGaugeVecMetric(
+		namespace,
+		"attribution_coverage_ratio",
+		"Ratio of the metadata operations or IO throughput of Slurm jobids, which is attributed to a job found in squeue.",
+		[]string{"metric"},
+		externalLabels)
+
+	droppedVolumeMetric := newGaugeVecMetric(
+		namespaceInternals,
+		"dropped_volume",
+		"Metadata operations or IO throughput in bytes per second of the entries dropped by the last collection per metric and reason.",
+		[]string{"metric", "reason"})
+
+	return &collectionMetrics{
 		stageExecutionMetric:         stageExecutionMetric,
 		jobMetadataOperationsMetric:  jobMetadataOperationsMetric,
 		jobReadThroughputMetric:      jobReadThroughputMetric,
@@ -141,82 +423,388 @@ func newExporter(requestTimeout int, urlLustreMetadataOperations string, urlLust
 		procMetadataOperationsMetric: procMetadataOperationsMetric,
 		procReadThroughputMetric:     procReadThroughputMetric,
 		procWriteThroughputMetric:    procWriteThroughputMetric,
+		droppedVolumeMetric:          droppedVolumeMetric,
+		unattributedMetadataMetric:   unattributedMetadataMetric,
+		unattributedReadMetric:       unattributedReadMetric,
+		unattributedWriteMetric:      unattributedWriteMetric,
+		attributionCoverageMetric:    attributionCoverageMetric,
+		jobs:                         make(jobIOMap),
+		procs:                        make(procIOMap),
 	}
 }
 
-func (e *exporter) Collect(ch chan<- prometheus.Metric) {
+func (m *collectionMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.stageExecutionMetric,
+		m.jobMetadataOperationsMetric,
+		m.jobReadThroughputMetric,
+		m.jobWriteThroughputMetric,
+		m.procMetadataOperationsMetric,
+		m.procReadThroughputMetric,
+		m.procWriteThroughputMetric,
+		m.droppedVolumeMetric,
+		m.unattributedMetadataMetric,
+		m.unattributedReadMetric,
+		m.unattributedWriteMetric,
+		m.attributionCoverageMetric,
+	}
+}
 
-	scrapeOK := true
-	var err error
+// gather returns all metrics of the collection.
+func (m *collectionMetrics) gather() []prometheus.Metric {
+
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+
+	metrics := make([]prometheus.Metric, 0)
+
+	go func() {
+		for metric := range ch {
+			metrics = append(metrics, metric)
+		}
+		close(done)
+	}()
+
+	for _, collector := range m.collectors() {
+		collector.Collect(ch)
+	}
+
+	close(ch)
+	<-done
+
+	return metrics
+}
+
+// failedStages returns the names of the stages, which failed in the collection.
+func (s *snapshot) failedStages() []string {
+
+	failed := make([]string, 0)
+
+	for _, stage := range s.stages {
+		if stage.err != nil {
+			failed = append(failed, stage.name)
+		}
+	}
+
+	return failed
+}
+
+// metricFamilies returns the metrics of the snapshot as sorted metric families.
+func (s *snapshot) metricFamilies() ([]*dto.MetricFamily, error) {
+
+	registry := prometheus.NewRegistry()
+
+	if err := registry.Register(snapshotCollector{s}); err != nil {
+		return nil, err
+	}
+
+	return registry.Gather()
+}
+
+// snapshotCollector is an unchecked collector of the snapshot metrics.
+type snapshotCollector struct {
+	snapshot *snapshot
+}
+
+func (c snapshotCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c snapshotCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, metric := range c.snapshot.metrics {
+		ch <- metric
+	}
+}
+
+// run collects the metrics on the collection interval in the background.
+func (e *exporter) run() {
+
+	log.Info("Background collection started with interval: ", e.collectionInterval)
+
+	ticker := time.NewTicker(e.collectionInterval)
+	defer ticker.Stop()
+
+	for {
+		if !e.beginCollection() {
+			return
+		}
+
+		e.storeSnapshot(e.collect())
+		e.collections.Done()
+
+		select {
+		case <-ticker.C:
+		case <-e.stopChannel:
+			return
+		}
+	}
+}
+
+// beginCollection registers a collection, which is awaited on shutdown.
+// Returns false if the exporter is shutting down.
+func (e *exporter) beginCollection() bool {
+
+	e.scrapeMutex.Lock()
+	defer e.scrapeMutex.Unlock()
+
+	if e.stopped {
+		return false
+	}
+
+	e.collections.Add(1)
+
+	return true
+}
+
+func (e *exporter) storeSnapshot(current *snapshot) {
+
+	e.snapshot.Store(current)
+
+	if current.scrapeOK {
+		e.lastSuccess.Store(current.timestamp)
+	}
+
+	for _, handler := range e.snapshotHandlers {
+		handler(current)
+	}
+}
+
+// onSnapshot adds a handler called with the snapshot of each collection,
+// e.g. to push the metrics. Handlers must be added before the collection
+// is started and must not block.
+func (e *exporter) onSnapshot(handler func(*snapshot)) {
+	e.snapshotHandlers = append(e.snapshotHandlers, handler)
+}
+
+// onInputs adds a handler called with the raw inputs of each collection,
+// e.g. to record them. Handlers must be added before the collection is started
+// and must not block.
+func (e *exporter) onInputs(handler func(*collectionInputs)) {
+	e.inputHandlers = append(e.inputHandlers, handler)
+}
+
+// shutdown stops starting new collections and waits for the in-flight
+// collection until the context is done.
+func (e *exporter) shutdown(ctx context.Context) error {
+
+	e.scrapeMutex.Lock()
+	if !e.stopped {
+		e.stopped = true
+		close(e.stopChannel)
+	}
+	e.scrapeMutex.Unlock()
+
+	done := make(chan struct{})
+
+	go func() {
+		e.collections.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ready returns an error if no successful collection completed yet, the last
+// collection failed to reach a source or the background snapshot is stale.
+func (e *exporter) ready() error {
+
+	e.scrapeMutex.Lock()
+	stopped := e.stopped
+	e.scrapeMutex.Unlock()
+
+	if stopped {
+		return errors.New("exporter is shutting down")
+	}
+
+	if _, ok := e.lastSuccess.Load().(time.Time); !ok {
+		return errors.New("no successful collection completed yet")
+	}
+
+	current := e.snapshot.Load().(*snapshot)
+
+	if !current.scrapeOK {
+		return errors.New("last collection failed in stages: " + strings.Join(current.failedStages(), ", "))
+	}
+
+	if age := time.Since(current.timestamp); e.collectionInterval > 0 && e.snapshotMaxAge > 0 && age > e.snapshotMaxAge {
+		return errors.New("snapshot is stale with age " + age.String())
+	}
+
+	return nil
+}
+
+// collectSynchronous runs the collection within a scrape. Concurrent scrapes
+// wait for the result of the in-flight collection instead of starting another
+// one. Returns nil if the in-flight collection did not finish within the max wait.
+func (e *exporter) collectSynchronous() *snapshot {
 
 	e.scrapeMutex.Lock() // Do mutex unlock ASAP
 
-	if e.scrapeActive {
-		scrapeOK = false
-		log.Debug("Collect is still active... - Skipping now")
+	if inflight := e.inflight; inflight != nil {
+
 		e.scrapeMutex.Unlock()
-	} else {
-		log.Debug("Collect started")
 
-		e.scrapeActive = true
+		log.Debug("Collect is still active... - Waiting for its result")
+
+		timer := time.NewTimer(e.collectionMaxWait)
+		defer timer.Stop()
+
+		select {
+		case <-inflight.done:
+			return inflight.snapshot
+		case <-timer.C:
+			log.Warning("Collect is still active after waiting ", e.collectionMaxWait, "... - Skipping now")
+			return nil
+		}
+	}
+
+	if e.stopped {
 		e.scrapeMutex.Unlock()
+		return nil
+	}
+
+	inflight := &inflightCollection{done: make(chan struct{})}
+	e.inflight = inflight
+	e.collections.Add(1)
+	e.scrapeMutex.Unlock()
+
+	inflight.snapshot = e.collect()
+	e.storeSnapshot(inflight.snapshot)
 
-		var start time.Time
-		var elapsed float64
+	e.scrapeMutex.Lock()
+	e.inflight = nil
+	e.collections.Done()
+	e.scrapeMutex.Unlock()
 
-		e.stageExecutionMetric.Reset()
-		e.jobMetadataOperationsMetric.Reset()
-		e.jobReadThroughputMetric.Reset()
-		e.jobWriteThroughputMetric.Reset()
-		e.procMetadataOperationsMetric.Reset()
-		e.procReadThroughputMetric.Reset()
-		e.procWriteThroughputMetric.Reset()
+	close(inflight.done)
 
-		go retrieveRunningJobs(e.channelRunningJobs)
-		go createUserInfoMap(e.channelUserInfo)
-		go createGroupInfoMap(e.channelGroupInfo)
+	return inflight.snapshot
+}
 
-		runningJobsResult := <-e.channelRunningJobs
-		userInfoResult := <-e.channelUserInfo
-		groupInfoResult := <-e.channelGroupInfo
+// collect runs the collection pipeline and returns the computed metrics as snapshot.
+func (e *exporter) collect() *snapshot {
 
-		recordScrapeError("RunningJobsChannel", runningJobsResult.err, &scrapeOK)
-		recordScrapeError("UserInfoChannel", userInfoResult.err, &scrapeOK)
-		recordScrapeError("GroupInfoChannel", groupInfoResult.err, &scrapeOK)
+	log.Debug("Collect started")
 
-		e.stageExecutionMetric.WithLabelValues("retrieve_running_jobs").Set(runningJobsResult.elapsed)
-		e.stageExecutionMetric.WithLabelValues("retrieve_user_name_info").Set(userInfoResult.elapsed)
-		e.stageExecutionMetric.WithLabelValues("retrieve_group_name_info").Set(groupInfoResult.elapsed)
+	settings := e.currentSettings()
 
+	scrapeOK := true
+	metrics := newCollectionMetrics(settings.externalLabels)
+	stages := make([]stageStatus, 0)
+
+	recordStage := func(name string, sender string, elapsed float64, err error) {
+		metrics.stageExecutionMetric.WithLabelValues(name).Set(elapsed)
+		e.stageMetrics.record(name, elapsed, err)
+		recordScrapeError(sender, err, &scrapeOK)
+		stages = append(stages, stageStatus{name, elapsed, err})
+	}
+
+	var err error
+	var start time.Time
+
+	go retrieveRunningJobs(e.channelRunningJobs)
+	go createUserInfoMap(e.channelUserInfo, settings.users)
+	go createGroupInfoMap(e.channelGroupInfo, settings.groups)
+	go settings.source.retrieve(e.channelLustreMetrics)
+
+	runningJobsResult := <-e.channelRunningJobs
+	userInfoResult := <-e.channelUserInfo
+	groupInfoResult := <-e.channelGroupInfo
+	lustreMetricsResult := <-e.channelLustreMetrics
+
+	if len(e.inputHandlers) > 0 {
+
+		inputs := &collectionInputs{
+			timestamp:   time.Now(),
+			runningJobs: runningJobsResult.content,
+			users:       userInfoResult.content,
+			groups:      groupInfoResult.content,
+			responses:   lustreMetricsResult.responses,
+		}
+
+		for _, handler := range e.inputHandlers {
+			handler(inputs)
+		}
+	}
+
+	recordStage("retrieve_running_jobs", "RunningJobsChannel", runningJobsResult.elapsed, runningJobsResult.err)
+	recordStage("retrieve_user_name_info", "UserInfoChannel", userInfoResult.elapsed, userInfoResult.err)
+	recordStage("retrieve_group_name_info", "GroupInfoChannel", groupInfoResult.elapsed, groupInfoResult.err)
+
+	for _, stage := range lustreMetricsResult.stages {
+		recordStage(stage.name, stage.sender, stage.elapsed, stage.err)
+	}
+
+	dropped := lustreMetricsResult.dropped
+	if dropped == nil {
+		dropped = newDroppedEntries()
+	}
+
+	if lustreMetricsResult.metadataOperations != nil {
 		start = time.Now()
-		err = e.buildLustreMetadataMetrics(runningJobsResult.jobs, userInfoResult.users, groupInfoResult.groups)
-		elapsed = time.Since(start).Seconds()
-		e.stageExecutionMetric.WithLabelValues("build_metadata_metrics").Set(elapsed)
-		recordScrapeError("BuildMetadataMetrics", err, &scrapeOK)
+		err = metrics.buildLustreMetadataMetrics(lustreMetricsResult.metadataOperations, runningJobsResult.jobs, userInfoResult.users, groupInfoResult.groups, settings.filters, dropped)
+		recordStage("build_metadata_metrics", "BuildMetadataMetrics", time.Since(start).Seconds(), err)
+	}
 
+	if lustreMetricsResult.readThroughput != nil {
 		start = time.Now()
-		err = e.buildLustreThroughputMetrics(runningJobsResult.jobs, userInfoResult.users, groupInfoResult.groups, true)
-		elapsed = time.Since(start).Seconds()
-		e.stageExecutionMetric.WithLabelValues("build_read_throughput_metrics").Set(elapsed)
-		recordScrapeError("BuildReadThroughputMetrics", err, &scrapeOK)
+		err = metrics.buildLustreThroughputMetrics(lustreMetricsResult.readThroughput, runningJobsResult.jobs, userInfoResult.users, groupInfoResult.groups, settings.filters, dropped, true)
+		recordStage("build_read_throughput_metrics", "BuildReadThroughputMetrics", time.Since(start).Seconds(), err)
+	}
 
+	if lustreMetricsResult.writeThroughput != nil {
 		start = time.Now()
-		err = e.buildLustreThroughputMetrics(runningJobsResult.jobs, userInfoResult.users, groupInfoResult.groups, false)
-		elapsed = time.Since(start).Seconds()
-		e.stageExecutionMetric.WithLabelValues("build_write_throughput_metrics").Set(elapsed)
-		recordScrapeError("BuildWriteThroughputMetrics", err, &scrapeOK)
+		err = metrics.buildLustreThroughputMetrics(lustreMetricsResult.writeThroughput, runningJobsResult.jobs, userInfoResult.users, groupInfoResult.groups, settings.filters, dropped, false)
+		recordStage("build_write_throughput_metrics", "BuildWriteThroughputMetrics", time.Since(start).Seconds(), err)
+	}
+
+	for _, key := range dropped.keys() {
+		metrics.droppedVolumeMetric.WithLabelValues(key.metric, key.reason).Set(dropped.values[key])
+	}
+
+	e.dropMetrics.record(dropped)
+
+	log.Debug("Collect finished")
+
+	return &snapshot{
+		timestamp: time.Now(),
+		scrapeOK:  scrapeOK,
+		stages:    stages,
+		metrics:   metrics.gather(),
+		jobs:      metrics.jobs,
+		procs:     metrics.procs,
+	}
+}
+
+func (e *exporter) Collect(ch chan<- prometheus.Metric) {
+
+	var current *snapshot
+	scrapeOK := false
+
+	if e.collectionInterval > 0 {
+		current, _ = e.snapshot.Load().(*snapshot)
+	} else {
+		current = e.collectSynchronous()
+	}
+
+	if current != nil {
 
-		e.stageExecutionMetric.Collect(ch)
-		e.jobMetadataOperationsMetric.Collect(ch)
-		e.jobReadThroughputMetric.Collect(ch)
-		e.jobWriteThroughputMetric.Collect(ch)
-		e.procMetadataOperationsMetric.Collect(ch)
-		e.procReadThroughputMetric.Collect(ch)
-		e.procWriteThroughputMetric.Collect(ch)
+		age := time.Since(current.timestamp)
 
-		e.scrapeActive = false
+		e.snapshotAgeMetric.Set(age.Seconds())
+		e.snapshotAgeMetric.Collect(ch)
 
-		log.Debug("Collect finished")
+		if e.collectionInterval > 0 && e.snapshotMaxAge > 0 && age > e.snapshotMaxAge {
+			log.Warning("Snapshot is stale with age ", age, "... - Withholding series")
+		} else {
+			scrapeOK = current.scrapeOK
+			for _, metric := range current.metrics {
+				ch <- metric
+			}
+		}
 	}
 
 	if scrapeOK {
@@ -226,24 +814,39 @@ func (e *exporter) Collect(ch chan<- prometheus.Metric) {
 	}
 
 	e.scrapeOKMetric.Collect(ch)
+
+	for _, collector := range e.stageMetrics.collectors() {
+		collector.Collect(ch)
+	}
+
+	e.dropMetrics.Collect(ch)
+
+	e.currentSettings().source.Collect(ch)
 }
 
 func (e *exporter) Describe(ch chan<- *prometheus.Desc) {
+
+	e.currentSettings().source.Describe(ch)
 	e.scrapeOKMetric.Describe(ch)
-	e.stageExecutionMetric.Describe(ch)
-	e.jobMetadataOperationsMetric.Describe(ch)
-	e.jobReadThroughputMetric.Describe(ch)
-	e.jobWriteThroughputMetric.Describe(ch)
-	e.procMetadataOperationsMetric.Describe(ch)
-	e.procReadThroughputMetric.Describe(ch)
-	e.procWriteThroughputMetric.Describe(ch)
+	e.snapshotAgeMetric.Describe(ch)
+
+	for _, collector := range e.stageMetrics.collectors() {
+		collector.Describe(ch)
+	}
+
+	e.dropMetrics.Describe(ch)
+
+	for _, collector := range e.describeMetrics.collectors() {
+		collector.Describe(ch)
+	}
 }
 
-func (e *exporter) buildLustreMetadataMetrics(jobs []jobInfo, users userInfoMap, groups groupInfoMap) error {
+func (m *collectionMetrics) buildLustreMetadataMetrics(lustreMetadataOperations *[]metadataInfo, jobs []jobInfo, users userInfoMap, groups groupInfoMap, filters *collectionFilters, dropped *droppedEntries) error {
 
 	log.Debug("Process metadata operations")
 
-	if len(jobs) == 0 {
+	// No running jobs are valid, e.g. on an idle cluster.
+	if jobs == nil {
 		return errors.New("parameter jobs is not set")
 	}
 
@@ -255,72 +858,79 @@ func (e *exporter) buildLustreMetadataMetrics(jobs []jobInfo, users userInfoMap,
 		return errors.New("parameter groups is not set")
 	}
 
-	content, err := httpRequest(e.urlLustreMetadataOperations, e.requestTimeout)
-	if err != nil {
-		return err
-	}
-
-	if log.IsLevelEnabled(log.TraceLevel) {
-		log.Trace("Bytes received: ", len(*content))
-	}
-
-	lustreMetadataOperations, err := parseLustreMetadataOperations(content)
-	if err != nil {
-		return err
-	}
-
 	if log.IsLevelEnabled(log.DebugLevel) {
 		log.Debug("Count Lustre Jobids with metadata operatons: ", len(*lustreMetadataOperations))
 	}
 
+	var attributed, unattributed float64
+
 	for _, metadataInfo := range *lustreMetadataOperations {
 
 		if isNumber(&metadataInfo.jobid) { // SLURM Job
 
+			found := false
+
 			for _, job := range jobs {
 				if metadataInfo.jobid == job.jobid {
-					e.jobMetadataOperationsMetric.WithLabelValues(job.account, job.user, metadataInfo.target).Add(
-						float64(metadataInfo.operations))
+					found = true
+					if !filters.excludeJob(&job) {
+						m.jobMetadataOperationsMetric.WithLabelValues(job.account, job.user, metadataInfo.target).Add(
+							float64(metadataInfo.operations))
+						m.jobs.get(&job).metadataOperations[metadataInfo.target] += float64(metadataInfo.operations)
+					}
 				}
 			}
 
+			if found {
+				attributed += float64(metadataInfo.operations)
+			} else {
+				unattributed += float64(metadataInfo.operations)
+				m.unattributedMetadataMetric.WithLabelValues(metadataInfo.target).Add(float64(metadataInfo.operations))
+				dropped.add(droppedMetadataOperations, dropReasonJobNotInSqueue, float64(metadataInfo.operations), metadataInfo.jobid)
+			}
+
 		} else { // Should look like process name with UID (proc_name.uid)
 
-			info, err := resolveProcInfo(metadataInfo.jobid, users, groups)
-			if err != nil {
+			info, reason, _ := resolveProcInfo(metadataInfo.jobid, users, groups)
+			if info == nil {
+				dropped.add(droppedMetadataOperations, reason, float64(metadataInfo.operations), metadataInfo.jobid)
 				continue
 			}
-			if info == nil {
+			if filters.excludeProc(info) {
 				continue
 			}
 
-			e.procMetadataOperationsMetric.WithLabelValues(
+			m.procMetadataOperationsMetric.WithLabelValues(
 				info.procName, info.groupName, info.userName, metadataInfo.target).Add(float64(metadataInfo.operations))
+			m.procs.get(metadataInfo.jobid, info).metadataOperations[metadataInfo.target] += float64(metadataInfo.operations)
 		}
 	}
 
+	m.setAttributionCoverage(droppedMetadataOperations, attributed, unattributed)
+
 	return nil
 }
 
-func (e *exporter) buildLustreThroughputMetrics(jobs []jobInfo, users userInfoMap, groups groupInfoMap, read bool) error {
+func (m *collectionMetrics) buildLustreThroughputMetrics(lustreThroughput *[]throughputInfo, jobs []jobInfo, users userInfoMap, groups groupInfoMap, filters *collectionFilters, dropped *droppedEntries, read bool) error {
 
-	var url string
 	var jobMetric *prometheus.GaugeVec
 	var procMetric *prometheus.GaugeVec
+	var unattributedMetric *prometheus.GaugeVec
 
 	if read {
 		log.Debug("Process read throughput")
-		url = e.urlLustreJobReadBytes
-		jobMetric = e.jobReadThroughputMetric
-		procMetric = e.procReadThroughputMetric
+		jobMetric = m.jobReadThroughputMetric
+		procMetric = m.procReadThroughputMetric
+		unattributedMetric = m.unattributedReadMetric
 	} else {
 		log.Debug("Process write throughput")
-		url = e.urlLustreJobWriteBytes
-		jobMetric = e.jobWriteThroughputMetric
-		procMetric = e.procWriteThroughputMetric
+		jobMetric = m.jobWriteThroughputMetric
+		procMetric = m.procWriteThroughputMetric
+		unattributedMetric = m.unattributedWriteMetric
 	}
 
-	if len(jobs) == 0 {
+	// No running jobs are valid, e.g. on an idle cluster.
+	if jobs == nil {
 		return errors.New("parameter jobs is not set")
 	}
 
@@ -332,63 +942,140 @@ func (e *exporter) buildLustreThroughputMetrics(jobs []jobInfo, users userInfoMa
 		return errors.New("parameter groups is not set")
 	}
 
-	content, err := httpRequest(url, e.requestTimeout)
-	if err != nil {
-		return err
-	}
-
-	if log.IsLevelEnabled(log.TraceLevel) {
-		log.Trace("Bytes received: ", len(*content))
-	}
-
-	lustreThroughput, err := parseLustreTotalBytes(content)
-	if err != nil {
-		return err
-	}
-
 	if log.IsLevelEnabled(log.DebugLevel) {
 		log.Debug("Count Lustre Jobids with throughput: ", len(*lustreThroughput))
 	}
 
+	var attributed, unattributed float64
+
+	// Exported with 0, if all Slurm jobids are attributed.
+	unattributedGauge := unattributedMetric.WithLabelValues()
+
 	for _, thInfo := range *lustreThroughput {
 
 		if isNumber(&thInfo.jobid) { // SLURM Job
 
+			found := false
+
 			for _, job := range jobs {
 				if thInfo.jobid == job.jobid {
-					jobMetric.WithLabelValues(job.account, job.user).Add(thInfo.throughput)
+					found = true
+					if !filters.excludeJob(&job) {
+						jobMetric.WithLabelValues(job.account, job.user).Add(thInfo.throughput)
+						if read {
+							m.jobs.get(&job).readThroughput += thInfo.throughput
+						} else {
+							m.jobs.get(&job).writeThroughput += thInfo.throughput
+						}
+					}
 				}
 			}
 
+			if found {
+				attributed += thInfo.throughput
+			} else {
+				unattributed += thInfo.throughput
+				unattributedGauge.Add(thInfo.throughput)
+				dropped.add(droppedThroughputMetric(read), dropReasonJobNotInSqueue, thInfo.throughput, thInfo.jobid)
+			}
+
 		} else { // Should look like process name with UID (proc_name.uid)
 
-			info, err := resolveProcInfo(thInfo.jobid, users, groups)
-			if err != nil {
+			info, reason, _ := resolveProcInfo(thInfo.jobid, users, groups)
+			if info == nil {
+				dropped.add(droppedThroughputMetric(read), reason, thInfo.throughput, thInfo.jobid)
 				continue
 			}
-			if info == nil {
+			if filters.excludeProc(info) {
 				continue
 			}
 
 			procMetric.WithLabelValues(info.procName, info.groupName, info.userName).Add(thInfo.throughput)
+			if read {
+				m.procs.get(thInfo.jobid, info).readThroughput += thInfo.throughput
+			} else {
+				m.procs.get(thInfo.jobid, info).writeThroughput += thInfo.throughput
+			}
 		}
 	}
 
+	m.setAttributionCoverage(droppedThroughputMetric(read), attributed, unattributed)
+
 	return nil
 }
 
+// get returns the IO of the job, which is added on first access.
+func (j jobIOMap) get(job *jobInfo) *jobIO {
+
+	io, ok := j[job.jobid]
+
+	if !ok {
+		io = &jobIO{
+			jobid:              job.jobid,
+			account:            job.account,
+			user:               job.user,
+			metadataOperations: make(map[string]float64),
+		}
+		j[job.jobid] = io
+	}
+
+	return io
+}
+
+// get returns the IO of the process, which is added on first access.
+func (p procIOMap) get(jobid string, info *procInfo) *procIO {
+
+	io, ok := p[jobid]
+
+	if !ok {
+		io = &procIO{
+			procName:           info.procName,
+			userName:           info.userName,
+			groupName:          info.groupName,
+			metadataOperations: make(map[string]float64),
+		}
+		p[jobid] = io
+	}
+
+	return io
+}
+
+// setAttributionCoverage sets the ratio of the attributed to the total value of Slurm jobids.
+// The ratio is omitted without Slurm jobids.
+func (m *collectionMetrics) setAttributionCoverage(metric string, attributed float64, unattributed float64) {
+	if total := attributed + unattributed; total > 0 {
+		m.attributionCoverageMetric.WithLabelValues(metric).Set(attributed / total)
+	}
+}
+
+func (f *collectionFilters) excludeJob(job *jobInfo) bool {
+	return matchAny(f.excludeAccounts, job.account) || matchAny(f.excludeUsers, job.user)
+}
+
+func (f *collectionFilters) excludeProc(info *procInfo) bool {
+	return matchAny(f.excludeProcNames, info.procName) || matchAny(f.excludeUsers, info.userName)
+}
+
+func matchAny(regexps []*regexp.Regexp, value string) bool {
+	for _, regex := range regexps {
+		if regex.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
 // resolveProcInfo parses a "procname.uid" jobid and resolves the UID to
 // user and group information via the provided lookup maps.
-// Returns (nil, nil) when the entry should be skipped (insufficient fields,
-// unknown UID or GID), and (nil, err) on fatal parse errors (malformed UID).
-func resolveProcInfo(jobid string, users userInfoMap, groups groupInfoMap) (*procInfo, error) {
+// Returns (nil, reason, nil) when the entry should be skipped (insufficient fields,
+// unknown UID or GID), and (nil, reason, err) on fatal parse errors (malformed UID).
+func resolveProcInfo(jobid string, users userInfoMap, groups groupInfoMap) (*procInfo, string, error) {
 
 	fields := strings.Split(jobid, ".")
 	lenFields := len(fields)
 
 	if lenFields < 2 {
-		log.Warning("Insufficient Lustre Jobstats procname_uid fields found in jobid: ", jobid)
-		return nil, nil
+		return nil, dropReasonInvalidUID, nil
 	}
 
 	// procName is all fields except the last, joined by "."
@@ -396,30 +1083,28 @@ func resolveProcInfo(jobid string, users userInfoMap, groups groupInfoMap) (*pro
 	// uid is the last field
 	uid, err := strconv.Atoi(fields[lenFields-1])
 	if err != nil {
-		log.Warning("Failed to parse uid from fields: ", fields)
-		return nil, err
+		return nil, dropReasonInvalidUID, err
 	}
 
 	userInfo, ok := users[uid]
 	if !ok {
-		log.Warning("uid not found in users map: ", uid)
-		return nil, nil
+		return nil, dropReasonUnknownUID, nil
 	}
 
 	groupInfo, ok := groups[userInfo.gid]
 	if !ok {
-		log.Warning("gid not found in groups map: ", userInfo.gid)
-		return nil, nil
+		return nil, dropReasonUnknownGID, nil
 	}
 
 	return &procInfo{
 		procName:  procName,
 		userName:  userInfo.user,
 		groupName: groupInfo.group,
-	}, nil
+	}, "", nil
 }
 
-func parseLustreMetadataOperations(content *[]byte) (*[]metadataInfo, error) {
+// parseLustreMetadataOperations parses a validated instant query response.
+func parseLustreMetadataOperations(content *[]byte, metadataTargets *regexp.Regexp, dropped *droppedEntries) (*[]metadataInfo, error) {
 
 	log.Debug("Parsing Lustre metadata operations")
 
@@ -427,14 +1112,6 @@ func parseLustreMetadataOperations(content *[]byte) (*[]metadataInfo, error) {
 		log.Trace(string(*content))
 	}
 
-	status, err := jsonparser.GetString(*content, "status")
-	if err != nil {
-		return nil, err
-	}
-	if status != "success" {
-		return nil, errors.New("value success not found in field status")
-	}
-
 	slice := make([]metadataInfo, 0, 1000)
 
 	jsonparser.ArrayEach(*content, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
@@ -443,17 +1120,6 @@ func parseLustreMetadataOperations(content *[]byte) (*[]metadataInfo, error) {
 		var target string
 		var operations int64
 
-		jobid, err = jsonparser.GetString(value, "metric", "jobid")
-
-		if err != nil {
-			log.Warning("Key jobid not found in value: ", string(value))
-			return
-		}
-		if jobid == "" {
-			log.Warning("Jobid is empty in value: ", string(value))
-			return
-		}
-
 		// TODO: Should be possible to avoid calling GetString multiple times?
 		operationsStr, err := jsonparser.GetString(value, "value", "[1]")
 		if err != nil {
@@ -467,6 +1133,14 @@ func parseLustreMetadataOperations(content *[]byte) (*[]metadataInfo, error) {
 			return
 		}
 
+		// The operations of entries without jobid are dropped, but accounted.
+		jobid, _ = jsonparser.GetString(value, "metric", "jobid")
+
+		if jobid == "" {
+			dropped.add(droppedMetadataOperations, dropReasonMissingJobID, float64(operations), jobid)
+			return
+		}
+
 		target, err = jsonparser.GetString(value, "metric", "target")
 		if err != nil {
 			log.Warning("Key target not found in value:", string(value))
@@ -478,10 +1152,8 @@ func parseLustreMetadataOperations(content *[]byte) (*[]metadataInfo, error) {
 			return
 		}
 
-		if !regexMetadataMDT.MatchString(target) {
-			if log.IsLevelEnabled(log.DebugLevel) {
-				log.Debug("Skipped metadata operation for non-MDT target: ", string(value))
-			}
+		if !metadataTargets.MatchString(target) {
+			dropped.add(droppedMetadataOperations, dropReasonNonMDTTarget, float64(operations), jobid)
 			return
 		}
 
@@ -492,7 +1164,8 @@ func parseLustreMetadataOperations(content *[]byte) (*[]metadataInfo, error) {
 	return &slice, nil
 }
 
-func parseLustreTotalBytes(content *[]byte) (*[]throughputInfo, error) {
+// parseLustreTotalBytes parses a validated instant query response.
+func parseLustreTotalBytes(content *[]byte, read bool, dropped *droppedEntries) (*[]throughputInfo, error) {
 
 	log.Debug("Parsing Lustre total bytes")
 
@@ -500,25 +1173,10 @@ func parseLustreTotalBytes(content *[]byte) (*[]throughputInfo, error) {
 		log.Trace(string(*content))
 	}
 
-	status, err := jsonparser.GetString(*content, "status")
-	if err != nil {
-		return nil, err
-	}
-	if status != "success" {
-		return nil, errors.New("value success not found in field status")
-	}
-
 	slice := make([]throughputInfo, 0, 1000)
 
 	jsonparser.ArrayEach(*content, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
 
-		jobid, err := jsonparser.GetString(value, "metric", "jobid")
-
-		if err != nil {
-			log.Warning("Key jobid not found in value: ", string(value))
-			return
-		}
-
 		throughputStr, err := jsonparser.GetString(value, "value", "[1]")
 		if err != nil {
 			log.Warning(err)
@@ -531,6 +1189,13 @@ func parseLustreTotalBytes(content *[]byte) (*[]throughputInfo, error) {
 			return
 		}
 
+		jobid, _ := jsonparser.GetString(value, "metric", "jobid")
+
+		if jobid == "" {
+			dropped.add(droppedThroughputMetric(read), dropReasonMissingJobID, throughput, jobid)
+			return
+		}
+
 		slice = append(slice, throughputInfo{jobid, throughput})
 
 	}, "data", "result")
@@ -9,9 +9,26 @@
 package main
 
 import (
+	"fmt"
+	"os/exec"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
+// testLustreSource is a Lustre source without any metrics.
+type testLustreSource struct{}
+
+func (s *testLustreSource) retrieve(channel chan<- lustreMetricsResult) {
+	channel <- lustreMetricsResult{}
+}
+
+func (s *testLustreSource) Describe(ch chan<- *prometheus.Desc) {}
+
+func (s *testLustreSource) Collect(ch chan<- prometheus.Metric) {}
+
 func TestParseLustreMetadataOperations(t *testing.T) {
 
 	var data string = `{"status":"success","data":{"resultType":"vector","result":[
@@ -31,7 +48,7 @@ func TestParseLustreMetadataOperations(t *testing.T) {
 	var lustreMetadataOperations *[]metadataInfo
 	var err error
 
-	lustreMetadataOperations, err = parseLustreMetadataOperations(&content)
+	lustreMetadataOperations, err = parseLustreMetadataOperations(&content, regexMetadataMDT, newDroppedEntries())
 
 	if err != nil {
 		t.Error(err)
@@ -76,7 +93,7 @@ func TestResolveProcInfo(t *testing.T) {
 	}
 
 	// Simple procname.uid — verify all returned fields
-	info, err := resolveProcInfo("cp.1001", users, groups)
+	info, _, err := resolveProcInfo("cp.1001", users, groups)
 	if err != nil {
 		t.Errorf("Unexpected error: %v", err)
 	}
@@ -94,7 +111,7 @@ func TestResolveProcInfo(t *testing.T) {
 	}
 
 	// Dotted procname — only procName parsing differs
-	info, err = resolveProcInfo("my.app.1001", users, groups)
+	info, _, err = resolveProcInfo("my.app.1001", users, groups)
 	if err != nil {
 		t.Errorf("Unexpected error: %v", err)
 	}
@@ -106,7 +123,7 @@ func TestResolveProcInfo(t *testing.T) {
 	}
 
 	// No dot separator → skip (nil, nil)
-	info, err = resolveProcInfo("nodot", users, groups)
+	info, _, err = resolveProcInfo("nodot", users, groups)
 	if err != nil {
 		t.Errorf("Unexpected error for 'nodot': %v", err)
 	}
@@ -115,7 +132,7 @@ func TestResolveProcInfo(t *testing.T) {
 	}
 
 	// Non-numeric UID → error
-	info, err = resolveProcInfo("cp.notanumber", users, groups)
+	info, _, err = resolveProcInfo("cp.notanumber", users, groups)
 	if err == nil {
 		t.Error("Expected error for non-numeric UID")
 	}
@@ -124,7 +141,7 @@ func TestResolveProcInfo(t *testing.T) {
 	}
 
 	// Unknown UID → skip (nil, nil)
-	info, err = resolveProcInfo("cp.9999", users, groups)
+	info, _, err = resolveProcInfo("cp.9999", users, groups)
 	if err != nil {
 		t.Errorf("Unexpected error for unknown UID: %v", err)
 	}
@@ -133,7 +150,7 @@ func TestResolveProcInfo(t *testing.T) {
 	}
 
 	// Known UID but unknown GID → skip (nil, nil)
-	info, err = resolveProcInfo("cp.1002", users, groups)
+	info, _, err = resolveProcInfo("cp.1002", users, groups)
 	if err != nil {
 		t.Errorf("Unexpected error for unknown GID: %v", err)
 	}
@@ -160,7 +177,7 @@ func TestParseLustreTotalBytes(t *testing.T) {
 	var lustreThroughputInfo *[]throughputInfo
 	var err error
 
-	lustreThroughputInfo, err = parseLustreTotalBytes(&content)
+	lustreThroughputInfo, err = parseLustreTotalBytes(&content, true, newDroppedEntries())
 
 	if err != nil {
 		t.Error(err)
@@ -180,3 +197,227 @@ func TestParseLustreTotalBytes(t *testing.T) {
 		t.Errorf("Expected jobid: %s - got: %s", expected_jobid, throughputInfo.jobid)
 	}
 }
+
+func newTestSettings() *collectionSettings {
+	return &collectionSettings{
+		source:  &testLustreSource{},
+		filters: &collectionFilters{},
+	}
+}
+
+func TestExporterSnapshot(t *testing.T) {
+
+	e := newExporter(newTestSettings(), time.Minute, 5*time.Minute, time.Minute)
+
+	// No snapshot has been collected yet.
+	if got := testutil.CollectAndCount(e); got != 1 {
+		t.Errorf("Expected only scrape_ok metric - got %d metrics", got)
+	}
+
+	metrics := newCollectionMetrics(nil)
+	metrics.jobReadThroughputMetric.WithLabelValues("account", "user").Set(1024)
+
+	e.snapshot.Store(&snapshot{timestamp: time.Now(), scrapeOK: true, metrics: metrics.gather()})
+
+	// scrape_ok, snapshot_age_seconds and job_read_throughput_bytes
+	if got := testutil.CollectAndCount(e); got != 3 {
+		t.Errorf("Expected 3 metrics - got %d", got)
+	}
+	if got := testutil.ToFloat64(e.scrapeOKMetric); got != 1 {
+		t.Errorf("Expected scrape_ok 1 - got %f", got)
+	}
+
+	e.snapshot.Store(&snapshot{timestamp: time.Now().Add(-10 * time.Minute), scrapeOK: true, metrics: metrics.gather()})
+
+	// The series of a stale snapshot are withheld.
+	if got := testutil.CollectAndCount(e); got != 2 {
+		t.Errorf("Expected 2 metrics for stale snapshot - got %d", got)
+	}
+	if got := testutil.ToFloat64(e.scrapeOKMetric); got != 0 {
+		t.Errorf("Expected scrape_ok 0 for stale snapshot - got %f", got)
+	}
+}
+
+func TestExporterSharedCollection(t *testing.T) {
+
+	e := newExporter(newTestSettings(), 0, 0, time.Second)
+
+	inflight := &inflightCollection{done: make(chan struct{})}
+	e.inflight = inflight
+
+	results := make(chan *snapshot, 2)
+
+	for i := 0; i < 2; i++ {
+		go func() {
+			results <- e.collectSynchronous()
+		}()
+	}
+
+	inflight.snapshot = &snapshot{timestamp: time.Now(), scrapeOK: true}
+	close(inflight.done)
+
+	for i := 0; i < 2; i++ {
+		if got := <-results; got != inflight.snapshot {
+			t.Error("Expected the snapshot of the in-flight collection")
+		}
+	}
+
+	// A stuck collection is reported after the max wait.
+	e.inflight = &inflightCollection{done: make(chan struct{})}
+	e.collectionMaxWait = 10 * time.Millisecond
+
+	if got := e.collectSynchronous(); got != nil {
+		t.Error("Expected no snapshot for a stuck collection")
+	}
+}
+
+func TestStageMetrics(t *testing.T) {
+
+	m := newStageMetrics()
+
+	m.record("retrieve_running_jobs", 0.1, nil)
+	m.record("retrieve_running_jobs", 0.2, &exec.ExitError{})
+	m.record("query_read_throughput", 1.5, fmt.Errorf("query failed: %w", &httpStatusError{statusCode: 503}))
+
+	if got := testutil.ToFloat64(m.runsMetric.WithLabelValues("retrieve_running_jobs")); got != 2 {
+		t.Errorf("Expected 2 runs - got: %f", got)
+	}
+	if got := testutil.ToFloat64(m.failuresMetric.WithLabelValues("retrieve_running_jobs", "exit_status")); got != 1 {
+		t.Errorf("Expected 1 failure with reason exit_status - got: %f", got)
+	}
+	if got := testutil.ToFloat64(m.failuresMetric.WithLabelValues("query_read_throughput", "http_status")); got != 1 {
+		t.Errorf("Expected 1 failure with reason http_status - got: %f", got)
+	}
+	if got := testutil.ToFloat64(m.lastSuccessMetric.WithLabelValues("retrieve_running_jobs")); got == 0 {
+		t.Error("Expected last success timestamp to be set")
+	}
+	if got := testutil.CollectAndCount(m.lastSuccessMetric); got != 1 {
+		t.Errorf("Expected last success timestamp only for succeeded stage - got: %d", got)
+	}
+	if got := testutil.CollectAndCount(m.durationMetric); got != 2 {
+		t.Errorf("Expected 2 duration histograms - got: %d", got)
+	}
+}
+
+func TestDroppedEntries(t *testing.T) {
+
+	content := []byte(`{"status":"success","data":{"resultType":"vector","result":[
+		{"metric":{"jobid":"35044931","target":"hebe-MDT0000"},"value":[1639743019.545,"10"]},
+		{"metric":{"jobid":"35099999","target":"hebe-MDT0000"},"value":[1639743019.545,"20"]},
+		{"metric":{"target":"hebe-MDT0000"},"value":[1639743019.545,"5"]},
+		{"metric":{"jobid":"35044931","target":"hebe-OST0000"},"value":[1639743019.545,"3"]},
+		{"metric":{"jobid":"cp.1001","target":"hebe-MDT0001"},"value":[1639743019.545,"7"]},
+		{"metric":{"jobid":"cp.9999","target":"hebe-MDT0001"},"value":[1639743019.545,"2"]},
+		{"metric":{"jobid":"cp.root","target":"hebe-MDT0001"},"value":[1639743019.545,"1"]},
+		{"metric":{"jobid":"cp.1002","target":"hebe-MDT0001"},"value":[1639743019.545,"4"]}
+		]}}`)
+
+	dropped := newDroppedEntries()
+
+	metadataInfos, err := parseLustreMetadataOperations(&content, regexMetadataMDT, dropped)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := []jobInfo{{jobid: "35044931", account: "hpc", user: "alice"}}
+	users := userInfoMap{
+		1001: userInfo{user: "alice", uid: 1001, gid: 100},
+		1002: userInfo{user: "carol", uid: 1002, gid: 999},
+	}
+	groups := groupInfoMap{100: groupInfo{group: "staff", gid: 100}}
+
+	metrics := newCollectionMetrics(nil)
+	if err := metrics.buildLustreMetadataMetrics(metadataInfos, jobs, users, groups, &collectionFilters{}, dropped); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]float64{
+		dropReasonMissingJobID:   5,
+		dropReasonNonMDTTarget:   3,
+		dropReasonJobNotInSqueue: 20,
+		dropReasonUnknownUID:     2,
+		dropReasonInvalidUID:     1,
+		dropReasonUnknownGID:     4,
+	}
+
+	if got := len(dropped.keys()); got != len(expected) {
+		t.Errorf("Expected %d drop reasons - got: %d", len(expected), got)
+	}
+
+	for reason, value := range expected {
+		key := dropKey{droppedMetadataOperations, reason}
+		if dropped.counts[key] != 1 || dropped.values[key] != value {
+			t.Errorf("Expected 1 entry with %f for reason %s - got: %d with %f",
+				value, reason, dropped.counts[key], dropped.values[key])
+		}
+	}
+
+	m := newDropMetrics()
+	m.record(dropped)
+	m.record(dropped)
+
+	if got := testutil.ToFloat64(m.entriesMetric.WithLabelValues(droppedMetadataOperations, dropReasonUnknownUID)); got != 2 {
+		t.Errorf("Expected 2 dropped entries over two collections - got: %f", got)
+	}
+}
+
+func TestUnattributedMetrics(t *testing.T) {
+
+	jobs := []jobInfo{{jobid: "1001", account: "hpc", user: "alice"}}
+	users := userInfoMap{1001: userInfo{user: "alice", uid: 1001, gid: 100}}
+	groups := groupInfoMap{100: groupInfo{group: "staff", gid: 100}}
+
+	metadataInfos := []metadataInfo{
+		{"1001", "hebe-MDT0000", 30},
+		{"1002", "hebe-MDT0000", 10},
+		{"cp.1001", "hebe-MDT0000", 50},
+	}
+
+	throughputInfos := []throughputInfo{
+		{"1001", 1000},
+		{"1002", 3000},
+	}
+
+	metrics := newCollectionMetrics(nil)
+	dropped := newDroppedEntries()
+
+	if err := metrics.buildLustreMetadataMetrics(&metadataInfos, jobs, users, groups, &collectionFilters{}, dropped); err != nil {
+		t.Fatal(err)
+	}
+	if err := metrics.buildLustreThroughputMetrics(&throughputInfos, jobs, users, groups, &collectionFilters{}, dropped, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := metrics.buildLustreThroughputMetrics(&[]throughputInfo{{"1001", 500}}, jobs, users, groups, &collectionFilters{}, dropped, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := testutil.ToFloat64(metrics.unattributedMetadataMetric.WithLabelValues("hebe-MDT0000")); got != 10 {
+		t.Errorf("Expected 10 unattributed metadata operations - got: %f", got)
+	}
+	if got := testutil.ToFloat64(metrics.unattributedReadMetric); got != 3000 {
+		t.Errorf("Expected 3000 unattributed read bytes - got: %f", got)
+	}
+	if got := testutil.ToFloat64(metrics.unattributedWriteMetric); got != 0 {
+		t.Errorf("Expected 0 unattributed write bytes - got: %f", got)
+	}
+
+	expected := map[string]float64{
+		droppedMetadataOperations: 0.75,
+		droppedReadThroughput:     0.25,
+		droppedWriteThroughput:    1,
+	}
+
+	for metric, ratio := range expected {
+		if got := testutil.ToFloat64(metrics.attributionCoverageMetric.WithLabelValues(metric)); got != ratio {
+			t.Errorf("Expected coverage ratio %f for %s - got: %f", ratio, metric, got)
+		}
+	}
+	io := metrics.jobs["1001"]
+	if io == nil || io.metadataOperations["hebe-MDT0000"] != 30 || io.readThroughput != 1000 || io.writeThroughput != 500 {
+		t.Errorf("Unexpected IO of job 1001: %+v", io)
+	}
+
+	if _, ok := metrics.jobs["1002"]; ok {
+		t.Error("Expected no IO of unattributed job 1002")
+	}
+}
@@ -0,0 +1,326 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+const commandJobReport = "job-report"
+
+// PromQL queries of a single job - __JOBID__ is replaced by the jobid and
+// __TIME_RANGE__ by the step, so the rates of the steps cover the runtime.
+const (
+	queryJobReportMetadataOperations = `sum by(target)(rate(lustre_job_stats_total{jobid="__JOBID__"}[__TIME_RANGE__]))`
+	queryJobReportReadBytes          = `sum(rate(lustre_job_read_bytes_total{jobid="__JOBID__"}[__TIME_RANGE__]))`
+	queryJobReportWriteBytes         = `sum(rate(lustre_job_write_bytes_total{jobid="__JOBID__"}[__TIME_RANGE__]))`
+)
+
+const (
+	// The step is the window of rate(), which requires two samples, so it is
+	// longer than twice the usual scrape interval of the lustre_exporter.
+	defaultJobReportStep = 5 * time.Minute
+
+	// Prometheus rejects range queries with more than 11000 points per series.
+	maxRangeQueryPoints = 10000
+)
+
+// Thresholds of the verdicts on the IO of a job.
+const (
+	verdictMetadataHeavyOperations        = 100000
+	verdictMetadataHeavyBytesPerOperation = 64 << 10
+	verdictBandwidthBytes                 = 1 << 30
+	verdictBandwidthRatio                 = 10
+)
+
+// Verdicts on the IO of a job.
+const (
+	verdictNoIO          = "no-io"
+	verdictMetadataHeavy = "metadata-heavy"
+	verdictReadHeavy     = "read-heavy"
+	verdictWriteHeavy    = "write-heavy"
+	verdictNormal        = "normal"
+)
+
+type jobReportOptions struct {
+	format        string
+	step          time.Duration
+	metadataQuery string
+	readQuery     string
+	writeQuery    string
+}
+
+// jobReport summarizes the Lustre IO of a job over its runtime.
+// The totals are integrated from the rates of the steps, so they are approximate.
+type jobReport struct {
+	Jobid                    string             `json:"jobid"`
+	Account                  string             `json:"account"`
+	User                     string             `json:"user"`
+	State                    string             `json:"state"`
+	Start                    time.Time          `json:"start"`
+	End                      time.Time          `json:"end"`
+	StepSeconds              float64            `json:"step_seconds"`
+	ReadBytes                float64            `json:"read_bytes"`
+	WriteBytes               float64            `json:"write_bytes"`
+	PeakReadThroughputBytes  float64            `json:"peak_read_throughput_bytes"`
+	PeakWriteThroughputBytes float64            `json:"peak_write_throughput_bytes"`
+	MetadataOperations       map[string]float64 `json:"metadata_operations"`
+	Verdict                  string             `json:"verdict"`
+	VerdictReason            string             `json:"verdict_reason"`
+}
+
+func newJobReportFlags(flags *flag.FlagSet) *jobReportOptions {
+
+	options := &jobReportOptions{}
+
+	flags.StringVar(&options.format, "job-report.format", outputFormatText, "Output format of the job report - text or json")
+	flags.DurationVar(&options.step, "job-report.step", defaultJobReportStep, "Step of the range queries and window of rate(), which must be at least twice the scrape interval of the lustre_exporter - Increased for long running jobs to stay below the maximum points of a query")
+	flags.StringVar(&options.metadataQuery, "job-report.metadata-query", queryJobReportMetadataOperations, "PromQL range query of the metadata operations per target of the job - __JOBID__ is replaced by the jobid and __TIME_RANGE__ by the step")
+	flags.StringVar(&options.readQuery, "job-report.read-query", queryJobReportReadBytes, "PromQL range query of the read throughput of the job in bytes per second")
+	flags.StringVar(&options.writeQuery, "job-report.write-query", queryJobReportWriteBytes, "PromQL range query of the write throughput of the job in bytes per second")
+
+	return options
+}
+
+// runJobReport writes the report of the job, whose record is retrieved from sacct.
+func runJobReport(settings *collectionSettings, jobid string, options *jobReportOptions, output io.Writer) error {
+
+	source, ok := settings.source.(*promSource)
+	if !ok {
+		return fmt.Errorf("%s requires the %s source", commandJobReport, sourcePrometheus)
+	}
+
+	if options.format != outputFormatText && options.format != outputFormatJSON {
+		return fmt.Errorf("unsupported output format: %s - expected %s or %s", options.format, outputFormatText, outputFormatJSON)
+	}
+
+	if !isNumber(&jobid) {
+		return fmt.Errorf("jobid must be a number: %s", jobid)
+	}
+
+	record, err := retrieveJobRecord(jobid)
+	if err != nil {
+		return err
+	}
+
+	report, err := newJobReport(source, record, options)
+	if err != nil {
+		return err
+	}
+
+	return writeJobReport(output, report, options.format)
+}
+
+// newJobReport queries the IO of the job over its runtime.
+func newJobReport(source *promSource, record *jobRecord, options *jobReportOptions) (*jobReport, error) {
+
+	if options.step <= 0 {
+		return nil, errors.New("step must be greater than 0")
+	}
+
+	// The jobid is put into the queries, so only Slurm jobids are allowed.
+	if !isNumber(&record.jobid) {
+		return nil, fmt.Errorf("jobid must be a number: %s", record.jobid)
+	}
+
+	step := rangeQueryStep(record.start, record.end, options.step)
+	start, end := rangeQueryBounds(record.start, record.end, step)
+	timeRange := model.Duration(step).String()
+
+	query := func(name string, query string) ([]rangeSeries, error) {
+		return source.queryRange(name, strings.ReplaceAll(query, "__JOBID__", record.jobid), timeRange, start, end, step)
+	}
+
+	report := &jobReport{
+		Jobid:              record.jobid,
+		Account:            record.account,
+		User:               record.user,
+		State:              record.state,
+		Start:              record.start,
+		End:                record.end,
+		StepSeconds:        step.Seconds(),
+		MetadataOperations: make(map[string]float64),
+	}
+
+	metadataSeries, err := query("job_metadata_operations", options.metadataQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, series := range metadataSeries {
+		if target := series.labels["target"]; source.metadataTargets.MatchString(target) {
+			total, _ := integrateSeries(series, step)
+			report.MetadataOperations[target] += total
+		}
+	}
+
+	readSeries, err := query("job_read_throughput", options.readQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	report.ReadBytes, report.PeakReadThroughputBytes = integrateAllSeries(readSeries, step)
+
+	writeSeries, err := query("job_write_throughput", options.writeQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	report.WriteBytes, report.PeakWriteThroughputBytes = integrateAllSeries(writeSeries, step)
+
+	report.Verdict, report.VerdictReason = jobVerdict(report)
+
+	return report, nil
+}
+
+// rangeQueryStep returns the step increased to whole seconds, so that the
+// range query over the time between start and end stays below the maximum points.
+func rangeQueryStep(start time.Time, end time.Time, step time.Duration) time.Duration {
+
+	if minimum := end.Sub(start) / maxRangeQueryPoints; step < minimum {
+		step = minimum.Truncate(time.Second) + time.Second
+	}
+
+	return step
+}
+
+// rangeQueryBounds returns the evaluation times of a range query, whose
+// rates over the step cover the time between start and end without overlap.
+func rangeQueryBounds(start time.Time, end time.Time, step time.Duration) (time.Time, time.Time) {
+
+	first := start.Add(step)
+
+	steps := (end.Sub(first) + step - 1) / step
+	if steps < 0 {
+		steps = 0
+	}
+
+	return first, first.Add(steps * step)
+}
+
+// integrateSeries returns the total of the rates over the steps and the peak rate.
+func integrateSeries(series rangeSeries, step time.Duration) (float64, float64) {
+
+	total, peak := 0.0, 0.0
+
+	for _, sample := range series.samples {
+
+		total += sample.value * step.Seconds()
+
+		if sample.value > peak {
+			peak = sample.value
+		}
+	}
+
+	return total, peak
+}
+
+// integrateAllSeries returns the total of the rates of all series over the
+// steps and the peak of the summed rates.
+func integrateAllSeries(series []rangeSeries, step time.Duration) (float64, float64) {
+
+	sums := make(map[int64]float64)
+
+	for _, current := range series {
+		for _, sample := range current.samples {
+			sums[sample.timestamp.Unix()] += sample.value
+		}
+	}
+
+	summed := rangeSeries{}
+	for timestamp, value := range sums {
+		summed.samples = append(summed.samples, rangeSample{time.Unix(timestamp, 0), value})
+	}
+
+	return integrateSeries(summed, step)
+}
+
+// jobVerdict classifies the IO of the job in a verdict and its reason.
+func jobVerdict(report *jobReport) (string, string) {
+
+	operations := 0.0
+	for _, value := range report.MetadataOperations {
+		operations += value
+	}
+
+	bytes := report.ReadBytes + report.WriteBytes
+
+	switch {
+
+	case operations < 1 && bytes < 1:
+		return verdictNoIO, "no Lustre IO recorded for the job"
+
+	case operations >= verdictMetadataHeavyOperations && bytes/operations < verdictMetadataHeavyBytesPerOperation:
+		return verdictMetadataHeavy, fmt.Sprintf("%s metadata operations with %s transferred per operation - e.g. many small files", formatOperations(operations), formatBytes(bytes/operations))
+
+	case report.WriteBytes >= verdictBandwidthBytes && report.WriteBytes >= verdictBandwidthRatio*report.ReadBytes:
+		return verdictWriteHeavy, fmt.Sprintf("%s written and %s read", formatBytes(report.WriteBytes), formatBytes(report.ReadBytes))
+
+	case report.ReadBytes >= verdictBandwidthBytes && report.ReadBytes >= verdictBandwidthRatio*report.WriteBytes:
+		return verdictReadHeavy, fmt.Sprintf("%s read and %s written", formatBytes(report.ReadBytes), formatBytes(report.WriteBytes))
+
+	default:
+		return verdictNormal, "no unusual Lustre IO pattern"
+	}
+}
+
+func writeJobReport(output io.Writer, report *jobReport, format string) error {
+
+	if format == outputFormatJSON {
+		encoder := json.NewEncoder(output)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+
+	writer := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(writer, "Job:\t%s\n", report.Jobid)
+	fmt.Fprintf(writer, "Account / user:\t%s / %s\n", report.Account, report.User)
+	fmt.Fprintf(writer, "Runtime:\t%s - %s (%s, %s)\n", report.Start.Format(time.RFC3339), report.End.Format(time.RFC3339),
+		report.End.Sub(report.Start).Truncate(time.Second), report.State)
+	fmt.Fprintf(writer, "Read:\t%s, peak %s/s\n", formatBytes(report.ReadBytes), formatBytes(report.PeakReadThroughputBytes))
+	fmt.Fprintf(writer, "Write:\t%s, peak %s/s\n", formatBytes(report.WriteBytes), formatBytes(report.PeakWriteThroughputBytes))
+
+	targets := make([]string, 0, len(report.MetadataOperations))
+	for target := range report.MetadataOperations {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	if len(targets) == 0 {
+		fmt.Fprintf(writer, "Metadata operations:\t0\n")
+	}
+
+	for i, target := range targets {
+		label := ""
+		if i == 0 {
+			label = "Metadata operations:"
+		}
+		fmt.Fprintf(writer, "%s\t%s on %s\n", label, formatOperations(report.MetadataOperations[target]), target)
+	}
+
+	fmt.Fprintf(writer, "Verdict:\t%s - %s\n", report.Verdict, report.VerdictReason)
+
+	return writer.Flush()
+}
+
+func formatOperations(operations float64) string {
+	return strconv.FormatFloat(operations, 'f', 0, 64)
+}
@@ -0,0 +1,143 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRangeQueryBounds(t *testing.T) {
+
+	start := time.Unix(1700000000, 0)
+
+	first, last := rangeQueryBounds(start, start.Add(150*time.Second), time.Minute)
+
+	if !first.Equal(start.Add(time.Minute)) || !last.Equal(start.Add(3*time.Minute)) {
+		t.Errorf("Expected bounds +1m and +3m - got: %s and %s", first.Sub(start), last.Sub(start))
+	}
+
+	// Jobs shorter than a step are covered by a single step.
+	first, last = rangeQueryBounds(start, start.Add(10*time.Second), time.Minute)
+
+	if !first.Equal(last) {
+		t.Errorf("Expected a single step - got: %s and %s", first.Sub(start), last.Sub(start))
+	}
+
+	if step := rangeQueryStep(start, start.Add(30*24*time.Hour), time.Minute); step != 260*time.Second {
+		t.Errorf("Expected step 4m20s for 30 days - got: %s", step)
+	}
+}
+
+func TestNewJobReport(t *testing.T) {
+
+	var queries []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		query := r.URL.Query().Get("query")
+		queries = append(queries, query)
+
+		if r.URL.Path != httpApiRange || r.URL.Query().Get("step") != "60" || r.URL.Query().Get("start") != "1700000060" {
+			t.Errorf("Unexpected range query: %s", r.URL)
+		}
+
+		switch {
+		case strings.Contains(query, "lustre_job_stats_total"):
+			w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+				{"metric":{"target":"hebe-MDT0000"},"values":[[1700000060,"2000"],[1700000120,"1000"]]},
+				{"metric":{"target":"hebe-OST0000"},"values":[[1700000060,"5000"]]}]}}`))
+		case strings.Contains(query, "lustre_job_write_bytes_total"):
+			w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+				{"metric":{},"values":[[1700000060,"10"],[1700000120,"20"]]}]}}`))
+		default:
+			w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+		}
+	}))
+	defer server.Close()
+
+	client, err := newPromClient([]promClientConfig{{url: server.URL}}, 5, testMaxResponseSize, promRetryConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := newPromSource(client, nil, promQueryOptions{}, regexMetadataMDT)
+
+	record := &jobRecord{
+		jobInfo: jobInfo{jobid: "1001", account: "hpc", user: "alice"},
+		start:   time.Unix(1700000000, 0),
+		end:     time.Unix(1700000100, 0),
+		state:   "COMPLETED",
+	}
+
+	options := &jobReportOptions{
+		format:        outputFormatText,
+		step:          time.Minute,
+		metadataQuery: queryJobReportMetadataOperations,
+		readQuery:     queryJobReportReadBytes,
+		writeQuery:    queryJobReportWriteBytes,
+	}
+
+	report, err := newJobReport(source, record, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedQuery := `sum(rate(lustre_job_read_bytes_total{jobid="1001"}[1m]))`
+	if len(queries) != 3 || queries[1] != expectedQuery {
+		t.Errorf("Expected read query %s - got: %v", expectedQuery, queries)
+	}
+
+	if len(report.MetadataOperations) != 1 || report.MetadataOperations["hebe-MDT0000"] != 180000 {
+		t.Errorf("Expected 180000 metadata operations on hebe-MDT0000 only - got: %v", report.MetadataOperations)
+	}
+
+	if report.ReadBytes != 0 || report.WriteBytes != 1800 || report.PeakWriteThroughputBytes != 20 {
+		t.Errorf("Unexpected throughput: read %f - write %f - peak write %f", report.ReadBytes, report.WriteBytes, report.PeakWriteThroughputBytes)
+	}
+
+	if report.Verdict != verdictMetadataHeavy {
+		t.Errorf("Expected verdict %s - got: %s (%s)", verdictMetadataHeavy, report.Verdict, report.VerdictReason)
+	}
+
+	var output bytes.Buffer
+
+	if err := writeJobReport(&output, report, outputFormatText); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(output.String(), "180000 on hebe-MDT0000") {
+		t.Errorf("Expected metadata operations in the report - got:\n%s", output.String())
+	}
+}
+
+func TestJobVerdict(t *testing.T) {
+
+	tests := []struct {
+		report   jobReport
+		expected string
+	}{
+		{jobReport{}, verdictNoIO},
+		{jobReport{ReadBytes: 20 << 30, WriteBytes: 1 << 30}, verdictReadHeavy},
+		{jobReport{ReadBytes: 1 << 20, WriteBytes: 2 << 30}, verdictWriteHeavy},
+		{jobReport{ReadBytes: 4 << 30, WriteBytes: 2 << 30}, verdictNormal},
+		{jobReport{ReadBytes: 1 << 30, MetadataOperations: map[string]float64{"hebe-MDT0000": 200000}}, verdictMetadataHeavy},
+		{jobReport{ReadBytes: 100 << 30, MetadataOperations: map[string]float64{"hebe-MDT0000": 200000}}, verdictReadHeavy},
+	}
+
+	for _, test := range tests {
+		if got, _ := jobVerdict(&test.report); got != test.expected {
+			t.Errorf("Expected verdict %s - got: %s", test.expected, got)
+		}
+	}
+}
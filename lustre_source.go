@@ -0,0 +1,194 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// lustreSource retrieves the rates of the Lustre job metrics per jobid.
+// Internal metrics of a source are exposed by its prometheus.Collector.
+type lustreSource interface {
+	prometheus.Collector
+	retrieve(channel chan<- lustreMetricsResult)
+}
+
+// stageResult describes a stage executed by a Lustre source.
+// The sender is used for recording the scrape error.
+type stageResult struct {
+	name    string
+	sender  string
+	elapsed float64
+	err     error
+}
+
+// lustreMetricsResult holds the retrieved Lustre metrics.
+// A metric slice is nil if it could not be retrieved.
+// The raw responses by query name are only set by the Prometheus source.
+type lustreMetricsResult struct {
+	stages             []stageResult
+	metadataOperations *[]metadataInfo
+	readThroughput     *[]throughputInfo
+	writeThroughput    *[]throughputInfo
+	dropped            *droppedEntries
+	responses          map[string][]byte
+}
+
+type counterSample struct {
+	value     float64
+	timestamp time.Time
+}
+
+// counterRates computes per second rates of counters between successive retrievals.
+type counterRates struct {
+	previous map[string]counterSample
+	current  map[string]counterSample
+}
+
+func newCounterRates() *counterRates {
+	return &counterRates{
+		previous: make(map[string]counterSample),
+		current:  make(map[string]counterSample),
+	}
+}
+
+// rate records the counter value and returns the rate since the previous
+// retrieval. False is returned, if there is no previous value for the counter.
+func (c *counterRates) rate(key string, value float64, timestamp time.Time) (float64, bool) {
+
+	c.current[key] = counterSample{value, timestamp}
+
+	previous, ok := c.previous[key]
+	if !ok {
+		return 0, false
+	}
+
+	elapsed := timestamp.Sub(previous.timestamp).Seconds()
+	if elapsed <= 0 {
+		return 0, false
+	}
+
+	delta := value - previous.value
+
+	// Counter reset, e.g. on a restart or the job_stats cleanup interval.
+	if delta < 0 {
+		delta = value
+	}
+
+	return delta / elapsed, true
+}
+
+// advance finishes a retrieval and discards counters, which were not recorded in it.
+func (c *counterRates) advance() {
+	c.previous = c.current
+	c.current = make(map[string]counterSample, len(c.previous))
+}
+
+type metadataKey struct {
+	jobid  string
+	target string
+}
+
+// lustreJobRates aggregates counter rates equal to the PromQL queries used for
+// the Prometheus source, e.g. sum by(target,jobid)(irate(...)>=1) for metadata operations.
+type lustreJobRates struct {
+	metadataTargets    *regexp.Regexp
+	metadataOperations map[metadataKey]float64
+	readThroughput     map[string]float64
+	writeThroughput    map[string]float64
+	dropped            *droppedEntries
+}
+
+func newLustreJobRates(metadataTargets *regexp.Regexp) *lustreJobRates {
+	return &lustreJobRates{
+		metadataTargets:    metadataTargets,
+		metadataOperations: make(map[metadataKey]float64),
+		readThroughput:     make(map[string]float64),
+		writeThroughput:    make(map[string]float64),
+		dropped:            newDroppedEntries(),
+	}
+}
+
+func (r *lustreJobRates) addMetadataOperations(jobid string, target string, rate float64) {
+	if rate >= 1 {
+		r.metadataOperations[metadataKey{jobid, target}] += rate
+	}
+}
+
+func (r *lustreJobRates) addThroughput(jobid string, rate float64, read bool) {
+
+	if rate == 0 {
+		return
+	}
+
+	if read {
+		r.readThroughput[jobid] += rate
+	} else {
+		r.writeThroughput[jobid] += rate
+	}
+}
+
+// metadataInfos returns the rounded metadata operations for MDT targets.
+func (r *lustreJobRates) metadataInfos() *[]metadataInfo {
+
+	slice := make([]metadataInfo, 0, len(r.metadataOperations))
+
+	for key, rate := range r.metadataOperations {
+
+		if key.jobid == "" {
+			r.dropped.add(droppedMetadataOperations, dropReasonMissingJobID, rate, key.jobid)
+			continue
+		}
+
+		if !r.metadataTargets.MatchString(key.target) {
+			r.dropped.add(droppedMetadataOperations, dropReasonNonMDTTarget, rate, key.jobid)
+			continue
+		}
+
+		slice = append(slice, metadataInfo{key.jobid, key.target, int64(math.Round(rate))})
+	}
+
+	sort.Slice(slice, func(i, j int) bool {
+		if slice[i].jobid != slice[j].jobid {
+			return slice[i].jobid < slice[j].jobid
+		}
+		return slice[i].target < slice[j].target
+	})
+
+	return &slice
+}
+
+func (r *lustreJobRates) throughputInfos(read bool) *[]throughputInfo {
+
+	rates := r.writeThroughput
+	if read {
+		rates = r.readThroughput
+	}
+
+	slice := make([]throughputInfo, 0, len(rates))
+
+	for jobid, rate := range rates {
+
+		if jobid == "" {
+			r.dropped.add(droppedThroughputMetric(read), dropReasonMissingJobID, rate, jobid)
+			continue
+		}
+
+		slice = append(slice, throughputInfo{jobid, rate})
+	}
+
+	sort.Slice(slice, func(i, j int) bool { return slice[i].jobid < slice[j].jobid })
+
+	return &slice
+}
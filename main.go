@@ -9,16 +9,23 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -28,16 +35,97 @@ const (
 	namespace               = "cluster"
 	namespaceInternals      = "cluster_exporter"
 	httpApi                 = "/api/v1/query"
-	queryParameter          = "?query=" // Query parameter are encoded in hex with % and 2 digits in the URL.
-	queryMetadataOperations = "round%28sum%20by%28target%2Cjobid%29%28irate%28lustre_job_stats_total[__TIME_RANGE__]%29%3E=1%29%29"
-	queryJobReadBytes       = "sum%20by%28jobid%29%28irate%28lustre_job_read_bytes_total[__TIME_RANGE__]%29!=0%29"
-	queryJobWriteBytes      = "sum%20by%28jobid%29%28irate%28lustre_job_write_bytes_total[__TIME_RANGE__]%29!=0%29"
+	httpApiRange            = "/api/v1/query_range"
+	queryMetadataOperations = "round(sum by(target,jobid)(irate(lustre_job_stats_total[__TIME_RANGE__])>=1))"
+	queryJobReadBytes       = "sum by(jobid)(irate(lustre_job_read_bytes_total[__TIME_RANGE__])!=0)"
+	queryJobWriteBytes      = "sum by(jobid)(irate(lustre_job_write_bytes_total[__TIME_RANGE__])!=0)"
 	defaultLogLevel         = "INFO"
 	defaultPort             = "9846"
 	defaultRequestTimeout   = 15
 	defaultTimeRange        = "1m"
+	defaultTenantHeader     = "X-Scope-OrgID"
+	defaultMimirApiPrefix   = "/prometheus"
+	defaultSource           = sourcePrometheus
+	defaultSnapshotMaxAge   = 5 * time.Minute
+	defaultCollectionWait   = time.Minute
+	defaultShutdownTimeout  = 30 * time.Second
+	defaultMaxResponseSize  = 64 << 20
+	defaultRetries          = 1
+	defaultRetryBackoff     = time.Second
+	defaultRetryMaxBackoff  = 10 * time.Second
+	defaultFailoverRecovery = time.Minute
+
+	defaultRemoteWriteTimeout         = 30
+	defaultRemoteWriteRetries         = 3
+	defaultRemoteWriteRetryMaxBackoff = 30 * time.Second
+	defaultRemoteWriteQueueCapacity   = 10
+
+	defaultOTLPProtocol        = otlpProtocolHTTP
+	defaultOTLPTimeout         = 10
+	defaultOTLPRetries         = 3
+	defaultOTLPRetryMaxBackoff = 30 * time.Second
+
+	defaultPushgatewayJob             = "cluster_exporter"
+	defaultPushgatewayMethod          = pushMethodPut
+	defaultPushgatewayTimeout         = 30
+	defaultPushgatewayRetries         = 3
+	defaultPushgatewayRetryMaxBackoff = 30 * time.Second
+
+	defaultAPIHistorySize      = 240
+	defaultAPIHistoryRetention = 2 * time.Hour
 )
 
+// Supported flavors of Prometheus compatible query backends.
+const (
+	flavorPrometheus      = "prometheus"
+	flavorThanos          = "thanos"
+	flavorMimir           = "mimir"
+	flavorVictoriaMetrics = "victoriametrics"
+)
+
+// Supported sources of the Lustre job metrics.
+const (
+	sourcePrometheus     = "prometheus"
+	sourceLustreExporter = "lustre-exporter"
+	sourceJobStats       = "jobstats"
+)
+
+// promQueryOptions controls how query URLs are built for a specific backend flavor.
+type promQueryOptions struct {
+	flavor                string
+	apiPrefix             string
+	thanosDedup           bool
+	thanosPartialResponse bool
+	vmDenyPartialResponse bool
+}
+
+// headerFlags collects repeated "Name: value" flag arguments into a header map.
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+
+	headers := make([]string, 0, len(h))
+
+	for name, value := range h {
+		headers = append(headers, name+": "+value)
+	}
+
+	return strings.Join(headers, ", ")
+}
+
+func (h headerFlags) Set(value string) error {
+
+	fields := strings.SplitN(value, ":", 2)
+
+	if len(fields) != 2 || strings.TrimSpace(fields[0]) == "" {
+		return fmt.Errorf("header must be given as 'Name: value': %s", value)
+	}
+
+	h[http.CanonicalHeaderKey(strings.TrimSpace(fields[0]))] = strings.TrimSpace(fields[1])
+
+	return nil
+}
+
 type urlExportLustreMetrics struct {
 	metadataOperations string
 	jobReadBytes       string
@@ -63,12 +151,12 @@ func initLogging(logLevel string) {
 	log.SetOutput(os.Stdout)
 }
 
-func validateTimeRange(timeRange string) {
+func validateTimeRange(timeRange string) error {
 
 	lenTimeRange := len(timeRange)
 
 	if lenTimeRange < 2 || lenTimeRange > 4 {
-		log.Fatal("Time range length is not supported: ", timeRange)
+		return fmt.Errorf("time range length is not supported: %s", timeRange)
 	}
 
 	reTimeRangeUnit := regexp.MustCompile("s|m|h|d")
@@ -77,76 +165,686 @@ func validateTimeRange(timeRange string) {
 	timeRangeNumber := timeRange[:lenTimeRange-1]
 
 	if !reTimeRangeUnit.MatchString(timeRangeUnit) {
-		log.Fatal("Time range unit is not supported: ", timeRangeUnit)
+		return fmt.Errorf("time range unit is not supported: %s", timeRangeUnit)
 	}
 
 	_, err := strconv.Atoi(timeRangeNumber)
 
 	if err != nil {
-		log.Fatal("Time range number could not be coverted to an integer: ", timeRangeNumber)
+		return fmt.Errorf("time range number could not be coverted to an integer: %s", timeRangeNumber)
+	}
+
+	return nil
+}
+
+func validateQueryOptions(options *promQueryOptions) error {
+
+	switch options.flavor {
+	case flavorPrometheus, flavorThanos, flavorVictoriaMetrics:
+	case flavorMimir:
+		if options.apiPrefix == "" {
+			options.apiPrefix = defaultMimirApiPrefix
+		}
+	default:
+		return fmt.Errorf("query backend flavor is not supported: %s", options.flavor)
 	}
+
+	options.apiPrefix = strings.TrimRight(options.apiPrefix, "/")
+
+	if options.apiPrefix != "" && !strings.HasPrefix(options.apiPrefix, "/") {
+		return fmt.Errorf("API path prefix must start with a slash: %s", options.apiPrefix)
+	}
+
+	return nil
 }
 
-func newUrlExportLustreMetrics(server string, timeRange string) *urlExportLustreMetrics {
+// buildQueryURL returns the query URL relative to the Prometheus endpoint URL.
+func buildQueryURL(query string, timeRange string, options *promQueryOptions) string {
+	return options.apiPrefix + httpApi + "?" + newQueryParams(query, timeRange, options).Encode()
+}
 
-	validateTimeRange(timeRange)
+// buildRangeQueryURL returns the range query URL relative to the Prometheus endpoint URL.
+func buildRangeQueryURL(query string, timeRange string, options *promQueryOptions, start time.Time, end time.Time, step time.Duration) string {
 
-	serverQueryEndpoint := server + httpApi + queryParameter
+	params := newQueryParams(query, timeRange, options)
+	params.Set("start", strconv.FormatInt(start.Unix(), 10))
+	params.Set("end", strconv.FormatInt(end.Unix(), 10))
+	params.Set("step", strconv.FormatFloat(step.Seconds(), 'f', -1, 64))
+
+	return options.apiPrefix + httpApiRange + "?" + params.Encode()
+}
+
+// newQueryParams returns the query parameters including the ones of the backend flavor.
+func newQueryParams(query string, timeRange string, options *promQueryOptions) url.Values {
+
+	params := url.Values{}
+	params.Set("query", strings.ReplaceAll(query, "__TIME_RANGE__", timeRange))
+
+	switch options.flavor {
+	case flavorThanos:
+		params.Set("dedup", strconv.FormatBool(options.thanosDedup))
+		params.Set("partial_response", strconv.FormatBool(options.thanosPartialResponse))
+	case flavorVictoriaMetrics:
+		if options.vmDenyPartialResponse {
+			params.Set("deny_partial_response", "1")
+		}
+	}
+
+	return params
+}
+
+func newUrlExportLustreMetrics(queries *queriesConfig, options *promQueryOptions) (*urlExportLustreMetrics, error) {
+
+	if err := validateTimeRange(queries.TimeRange); err != nil {
+		return nil, err
+	}
+
+	if err := validateQueryOptions(options); err != nil {
+		return nil, err
+	}
 
 	return &urlExportLustreMetrics{
-		metadataOperations: serverQueryEndpoint + strings.Replace(queryMetadataOperations, "__TIME_RANGE__", timeRange, 1),
-		jobReadBytes:       serverQueryEndpoint + strings.Replace(queryJobReadBytes, "__TIME_RANGE__", timeRange, 1),
-		jobWriteBytes:      serverQueryEndpoint + strings.Replace(queryJobWriteBytes, "__TIME_RANGE__", timeRange, 1),
+		metadataOperations: buildQueryURL(queries.MetadataOperations, queries.TimeRange, options),
+		jobReadBytes:       buildQueryURL(queries.ReadThroughput, queries.TimeRange, options),
+		jobWriteBytes:      buildQueryURL(queries.WriteThroughput, queries.TimeRange, options),
+	}, nil
+}
+
+// splitList splits a comma separated list and removes empty elements.
+func splitList(list string) []string {
+
+	elements := make([]string, 0)
+
+	for _, element := range strings.Split(list, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			elements = append(elements, element)
+		}
+	}
+
+	return elements
+}
+
+// waitForShutdown blocks until SIGTERM or SIGINT is received. Then the server stops
+// accepting scrapes and the in-flight collection is awaited until the timeout,
+// after which still running child processes are killed. The senders pushing the
+// metrics are flushed within the same timeout.
+func waitForShutdown(server *http.Server, e *exporter, timeout time.Duration, senders ...func(context.Context) error) {
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	sig := <-signals
+
+	log.Info("Received signal ", sig, " - Shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Warning("Failed to wait for active requests: ", err)
+	}
+
+	if err := e.shutdown(ctx); err != nil {
+		log.Warning("Failed to wait for the in-flight collection: ", err)
 	}
+
+	for _, shutdownSender := range senders {
+		if err := shutdownSender(ctx); err != nil {
+			log.Warning("Failed to flush the pushed metrics: ", err)
+		}
+	}
+
+	killProcesses()
 }
 
 func main() {
 
 	printVersion := flag.Bool("version", false, "Print version")
-	promServer := flag.String("promserver", "", "[REQUIRED] Prometheus Server to be used e.g. http://prometheus-server:9090")
+	configFile := flag.String("config.file", "", "YAML configuration file of the data sources, queries, labels, filters and identity backends - Settings not given in the file default to the flags")
+	collectionInterval := flag.Duration("collection.interval", 0, "Interval of the background collection - Collects synchronously on each scrape if 0")
+	snapshotMaxAge := flag.Duration("collection.max-age", defaultSnapshotMaxAge, "Maximum age of the background collection snapshot, after which the series are withheld - Disabled if 0")
+	shutdownTimeout := flag.Duration("shutdown.timeout", defaultShutdownTimeout, "Maximum time to wait for the in-flight collection on shutdown, after which running child processes are killed")
+	collectionMaxWait := flag.Duration("collection.max-wait", defaultCollectionWait, "Maximum time a scrape waits for the result of an in-flight synchronous collection started by a concurrent scrape")
+	source := flag.String("source", defaultSource, "Source of the Lustre job metrics - prometheus, lustre-exporter or jobstats")
+	lustreExporterTargets := flag.String("lustre-exporter.targets", "", "Comma separated list of lustre_exporter metrics URLs scraped by the lustre-exporter source e.g. http://mds01:9169/metrics")
+	jobStatsPaths := flag.String("jobstats.paths", defaultJobStatsPaths, "Comma separated list of job_stats file patterns read by the jobstats source")
+	jobStatsLctl := flag.Bool("jobstats.lctl", false, "Read the job_stats with lctl get_param instead of the job_stats files")
+	promServer := flag.String("promserver", "", "[REQUIRED for prometheus source] Prometheus Server to be used e.g. http://prometheus-server:9090 - A comma separated list of HA replicas is used for failover in the given order")
 	logLevel := flag.String("log", defaultLogLevel, "Sets log level - ERROR, WARNING, INFO, DEBUG or TRACE")
 	port := flag.String("port", defaultPort, "The port to listen on for HTTP requests")
+	webListenAddress := flag.String("web.listen-address", "", "Address to listen on for HTTP requests e.g. 127.0.0.1:9846 or unix:/run/cluster-exporter.sock - Overrides the port")
+	webConfigFile := flag.String("web.config.file", "", "Web configuration file with TLS and basic auth settings in the exporter-toolkit web-config.yml format")
 	requestTimeout := flag.Int("timeout", defaultRequestTimeout, "HTTP request timeout in seconds for exporting Lustre Jobstats on Prometheus HTTP API")
+	maxResponseSize := flag.Int64("promserver.max-response-size", defaultMaxResponseSize, "Maximum size in bytes of a response from the Prometheus server")
 	timeRange := flag.String("timerange", defaultTimeRange, "Time range used for rate function on the retrieving Lustre metrics from Prometheus - A three digit number with unit s, m, h or d")
 
-	flag.Parse()
+	clientConfig := promClientConfig{headers: make(headerFlags)}
+	flag.StringVar(&clientConfig.basicAuthUser, "promserver.user", "", "User for basic authentication on the Prometheus server")
+	flag.StringVar(&clientConfig.basicAuthPasswordFile, "promserver.password-file", "", "File containing the password for basic authentication on the Prometheus server")
+	flag.StringVar(&clientConfig.bearerTokenFile, "promserver.bearer-token-file", "", "File containing the bearer token for the Prometheus server, read on each request")
+	flag.StringVar(&clientConfig.caFile, "promserver.ca-file", "", "CA certificate bundle to verify the Prometheus server certificate")
+	flag.StringVar(&clientConfig.certFile, "promserver.cert-file", "", "Client certificate file for TLS authentication on the Prometheus server")
+	flag.StringVar(&clientConfig.keyFile, "promserver.key-file", "", "Client key file for TLS authentication on the Prometheus server")
+	flag.BoolVar(&clientConfig.insecureSkipVerify, "promserver.insecure-skip-verify", false, "Disable verification of the Prometheus server certificate")
+	flag.StringVar(&clientConfig.proxyURL, "promserver.proxy-url", "", "Proxy URL used for requests to the Prometheus server")
+	flag.Var(headerFlags(clientConfig.headers), "promserver.header", "Extra HTTP header 'Name: value' sent to the Prometheus server - Can be repeated")
+
+	queryOptions := promQueryOptions{}
+	flag.StringVar(&queryOptions.flavor, "promserver.flavor", flavorPrometheus, "Flavor of the Prometheus compatible query backend - prometheus, thanos, mimir or victoriametrics")
+	flag.StringVar(&queryOptions.apiPrefix, "promserver.api-prefix", "", "Path prefix in front of /api/v1/query e.g. /prometheus for Mimir, which is also the default for the mimir flavor")
+	flag.BoolVar(&queryOptions.thanosDedup, "promserver.thanos.dedup", true, "Enable deduplication of replicated series on Thanos Query")
+	flag.BoolVar(&queryOptions.thanosPartialResponse, "promserver.thanos.partial-response", false, "Allow partial responses from Thanos Query if a store API is unavailable")
+	flag.BoolVar(&queryOptions.vmDenyPartialResponse, "promserver.victoriametrics.deny-partial-response", false, "Deny partial responses from VictoriaMetrics cluster if a storage node is unavailable")
+	tenant := flag.String("promserver.tenant", "", "Tenant ID sent to multi-tenant query backends such as Mimir")
+	tenantHeader := flag.String("promserver.tenant-header", defaultTenantHeader, "HTTP header used to send the tenant ID")
+
+	retryConfig := promRetryConfig{}
+	flag.IntVar(&retryConfig.retries, "promserver.retries", defaultRetries, "Number of retries over all Prometheus endpoints after a failed request")
+	flag.DurationVar(&retryConfig.backoff, "promserver.retry-backoff", defaultRetryBackoff, "Initial backoff between retries, doubled on each retry with random jitter")
+	flag.DurationVar(&retryConfig.maxBackoff, "promserver.retry-max-backoff", defaultRetryMaxBackoff, "Maximum backoff between retries")
+	flag.DurationVar(&retryConfig.recovery, "promserver.failover-recovery", defaultFailoverRecovery, "Duration a failed Prometheus endpoint is only used after the healthy endpoints")
+
+	remoteWrite := remoteWriteConfig{client: promClientConfig{headers: make(headerFlags)}}
+	flag.StringVar(&remoteWrite.client.url, "remote-write.url", "", "URL of a Prometheus remote write receiver the metrics are pushed to on each background collection e.g. http://prometheus:9090/api/v1/write")
+	flag.IntVar(&remoteWrite.timeout, "remote-write.timeout", defaultRemoteWriteTimeout, "HTTP request timeout in seconds for the remote write receiver")
+	flag.StringVar(&remoteWrite.client.basicAuthUser, "remote-write.user", "", "User for basic authentication on the remote write receiver")
+	flag.StringVar(&remoteWrite.client.basicAuthPasswordFile, "remote-write.password-file", "", "File containing the password for basic authentication on the remote write receiver")
+	flag.StringVar(&remoteWrite.client.bearerTokenFile, "remote-write.bearer-token-file", "", "File containing the bearer token for the remote write receiver, read on each request")
+	flag.StringVar(&remoteWrite.client.caFile, "remote-write.ca-file", "", "CA certificate bundle to verify the remote write receiver certificate")
+	flag.Var(headerFlags(remoteWrite.client.headers), "remote-write.header", "Extra HTTP header 'Name: value' sent to the remote write receiver - Can be repeated")
+	flag.IntVar(&remoteWrite.retry.retries, "remote-write.retries", defaultRemoteWriteRetries, "Number of retries of a failed remote write request")
+	flag.DurationVar(&remoteWrite.retry.backoff, "remote-write.retry-backoff", defaultRetryBackoff, "Initial backoff between remote write retries, doubled on each retry with random jitter")
+	flag.DurationVar(&remoteWrite.retry.maxBackoff, "remote-write.retry-max-backoff", defaultRemoteWriteRetryMaxBackoff, "Maximum backoff between remote write retries")
+	flag.IntVar(&remoteWrite.queueCapacity, "remote-write.queue-capacity", defaultRemoteWriteQueueCapacity, "Maximum count of collections queued for remote write, after which the oldest is dropped")
+
+	otlp := otlpConfig{client: promClientConfig{headers: make(headerFlags)}}
+	flag.StringVar(&otlp.client.url, "otlp.endpoint", "", "URL of an OpenTelemetry collector the metrics are exported to on each background collection e.g. http://otel-collector:4318 for http/protobuf or http://otel-collector:4317 for grpc")
+	flag.StringVar(&otlp.protocol, "otlp.protocol", defaultOTLPProtocol, "Transport protocol of the OTLP export - grpc or http/protobuf")
+	flag.IntVar(&otlp.timeout, "otlp.timeout", defaultOTLPTimeout, "Request timeout in seconds for the OTLP export")
+	flag.StringVar(&otlp.client.caFile, "otlp.ca-file", "", "CA certificate bundle to verify the OpenTelemetry collector certificate")
+	flag.Var(headerFlags(otlp.client.headers), "otlp.header", "Extra header 'Name: value' sent to the OpenTelemetry collector - Can be repeated")
+	flag.IntVar(&otlp.retry.retries, "otlp.retries", defaultOTLPRetries, "Number of retries of a failed OTLP export")
+	otlpResourceAttributes := flag.String("otlp.resource-attributes", "", "Comma separated list of key=value resource attributes of the OTLP export e.g. cluster=virgo,filesystem=hebe")
+
+	pushgateway := pushgatewayConfig{}
+	flag.StringVar(&pushgateway.url, "pushgateway.url", "", "URL of a Pushgateway the metrics are pushed to on each background collection or once with -once e.g. http://pushgateway:9091")
+	flag.StringVar(&pushgateway.job, "pushgateway.job", defaultPushgatewayJob, "Job label of the metrics pushed to the Pushgateway")
+	pushgatewayGrouping := flag.String("pushgateway.grouping", "", "Comma separated list of key=value labels of the grouping key besides the job e.g. cluster=virgo,filesystem=hebe")
+	flag.StringVar(&pushgateway.method, "pushgateway.method", defaultPushgatewayMethod, "Method of the push - put replaces all metrics of the grouping key, post only the metrics with the same names")
+	flag.StringVar(&pushgateway.basicAuthUser, "pushgateway.user", "", "User for basic authentication on the Pushgateway")
+	flag.StringVar(&pushgateway.basicAuthPasswordFile, "pushgateway.password-file", "", "File containing the password for basic authentication on the Pushgateway")
+	flag.IntVar(&pushgateway.timeout, "pushgateway.timeout", defaultPushgatewayTimeout, "HTTP request timeout in seconds for the Pushgateway")
+	flag.IntVar(&pushgateway.retry.retries, "pushgateway.retries", defaultPushgatewayRetries, "Number of retries of a failed push to the Pushgateway")
+
+	apiEnable := flag.Bool("api.enable", false, "Enable the JSON API "+apiPath+" serving the IO of single jobs and users with a short history")
+	apiHistorySize := flag.Int("api.history-size", defaultAPIHistorySize, "Maximum count of collections kept in the history of the JSON API")
+	apiHistoryRetention := flag.Duration("api.history-retention", defaultAPIHistoryRetention, "Maximum age of the collections served from the history of the JSON API")
+
+	once := flag.Bool("once", false, "Run the collection once, print the metrics to stdout, write them into the textfile directory or push them to the Pushgateway and exit - Exits with status 1 if any stage failed")
+	onceFormat := flag.String("once.format", outputFormatText, "Output format of the metrics printed by -once - text or json")
+	recordDir := flag.String("record-dir", "", "Directory, into which the raw inputs of each collection - squeue output, passwd and group maps and Prometheus responses - are recorded as timestamped bundle for the "+commandReplay+" command - Requires the "+sourcePrometheus+" source")
+	recordMaxBundles := flag.Int("record-dir.max-bundles", defaultRecordMaxBundles, "Maximum count of bundles kept in the record directory, whereby the oldest are removed")
+	textfileDir := flag.String("textfile-dir", "", "Directory of the node_exporter textfile collector, into which "+textfileName+" is atomically written on each background collection or once with -once")
+
+	// Commands run instead of the exporter e.g. prometheus-cluster-exporter top -source jobstats.
+	// Their flags are only registered, if the command is given.
+	command, args := "", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	// Arguments of the command may be given before and after its flags.
+	var positional []string
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		positional, args = append(positional, args[0]), args[1:]
+	}
+
+	var top *topOptions
+	var jobReport *jobReportOptions
+	var report *reportOptions
+	var backfill *backfillOptions
+	var replay *replayOptions
+
+	switch command {
+	case "":
+	case commandTop:
+		top = newTopFlags(flag.CommandLine)
+	case commandJobReport:
+		jobReport = newJobReportFlags(flag.CommandLine)
+	case commandReport:
+		report = newReportFlags(flag.CommandLine)
+	case commandBackfill:
+		backfill = newBackfillFlags(flag.CommandLine)
+	case commandReplay:
+		replay = newReplayFlags(flag.CommandLine)
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown command:", command)
+		os.Exit(2)
+	}
+
+	flag.CommandLine.Parse(args)
+	positional = append(positional, flag.Args()...)
+
+	// Only job-report and replay take an argument. Other arguments are rejected
+	// instead of ignored, e.g. a command given after the flags.
+	maxPositional := 0
+	if command == commandJobReport || command == commandReplay {
+		maxPositional = 1
+	}
+
+	if len(positional) > maxPositional {
+		if command == "" {
+			fmt.Fprintln(os.Stderr, "Unexpected arguments:", strings.Join(positional, " "), "- A command must be given before the flags")
+		} else {
+			fmt.Fprintln(os.Stderr, "Unexpected arguments of command", command+":", strings.Join(positional, " "))
+		}
+		os.Exit(2)
+	}
 
 	initLogging(*logLevel)
 
+	// The output of the commands and the metrics printed by -once are kept apart from the log messages.
+	if command != "" || (*once && *textfileDir == "" && pushgateway.url == "") {
+		log.SetOutput(os.Stderr)
+	}
+
 	if *printVersion {
 		fmt.Println("Version:", version)
 		os.Exit(0)
 	}
 
-	if *promServer == "" {
-		log.Fatal("No Prometheus server has been specified")
-	}
-
 	metricsPath := "/metrics"
 	listenAddress := ":" + *port
 
-	log.Info("Exporter started")
+	if *webListenAddress != "" {
+		listenAddress = *webListenAddress
+	}
+
+	if command == "" {
+		log.Info("Exporter started")
+	}
+
+	baseConfig := &config{
+		Source: sourceConfig{
+			Type: *source,
+			Prometheus: promSourceConfig{
+				Servers:                            newPromServerConfigs(splitList(*promServer)),
+				Flavor:                             queryOptions.flavor,
+				APIPrefix:                          queryOptions.apiPrefix,
+				ThanosDedup:                        queryOptions.thanosDedup,
+				ThanosPartialResponse:              queryOptions.thanosPartialResponse,
+				VictoriaMetricsDenyPartialResponse: queryOptions.vmDenyPartialResponse,
+				Tenant:                             *tenant,
+				TenantHeader:                       *tenantHeader,
+				Timeout:                            *requestTimeout,
+				MaxResponseSize:                    *maxResponseSize,
+				BasicAuth: basicAuthConfig{
+					Username:     clientConfig.basicAuthUser,
+					PasswordFile: clientConfig.basicAuthPasswordFile,
+				},
+				BearerTokenFile: clientConfig.bearerTokenFile,
+				TLSConfig: tlsClientConfig{
+					CAFile:             clientConfig.caFile,
+					CertFile:           clientConfig.certFile,
+					KeyFile:            clientConfig.keyFile,
+					InsecureSkipVerify: clientConfig.insecureSkipVerify,
+				},
+				ProxyURL:         clientConfig.proxyURL,
+				Headers:          clientConfig.headers,
+				Retries:          retryConfig.retries,
+				RetryBackoff:     model.Duration(retryConfig.backoff),
+				RetryMaxBackoff:  model.Duration(retryConfig.maxBackoff),
+				FailoverRecovery: model.Duration(retryConfig.recovery),
+			},
+			LustreExporter: lustreExporterSourceConfig{
+				Targets:         splitList(*lustreExporterTargets),
+				Timeout:         *requestTimeout,
+				MaxResponseSize: *maxResponseSize,
+			},
+			JobStats: jobStatsSourceConfig{
+				Paths: splitList(*jobStatsPaths),
+				Lctl:  *jobStatsLctl,
+			},
+		},
+		Queries: queriesConfig{
+			TimeRange:          *timeRange,
+			MetadataOperations: queryMetadataOperations,
+			ReadThroughput:     queryJobReadBytes,
+			WriteThroughput:    queryJobWriteBytes,
+		},
+		Filters: filtersConfig{
+			MetadataTargets: regexMetadataMDT.String(),
+		},
+		Identity: identityConfig{
+			Users:  identityBackendConfig{Backend: identityBackendGetent},
+			Groups: identityBackendConfig{Backend: identityBackendGetent},
+		},
+	}
+
+	// The replay requires no source, since the Prometheus responses are read from the bundle.
+	if command == commandReplay {
+
+		if len(positional) != 1 {
+			fmt.Fprintf(os.Stderr, "Usage: %s %s [flags] <bundle directory>\n", os.Args[0], commandReplay)
+			os.Exit(2)
+		}
+
+		cfg, err := loadConfig(*configFile, baseConfig)
+		if err != nil {
+			log.Fatal("Failed to load configuration: ", err)
+		}
+
+		settings, err := newAttributionSettings(cfg)
+		if err != nil {
+			log.Fatal("Failed to load configuration: ", err)
+		}
+
+		if err := runReplay(settings, positional[0], replay, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+
+		os.Exit(0)
+	}
+
+	settings, err := loadCollectionSettings(*configFile, baseConfig)
+	if err != nil {
+		log.Fatal("Failed to load configuration: ", err)
+	}
+
+	var recorder *bundleRecorder
+
+	if *recordDir != "" {
+
+		// Only the responses of the Prometheus queries can be replayed.
+		if settings.sourceType != sourcePrometheus {
+			log.Fatal("Recording requires the ", sourcePrometheus, " source")
+		}
+
+		recorder, err = newBundleRecorder(*recordDir, *recordMaxBundles)
+		if err != nil {
+			log.Fatal("Failed to create record directory: ", err)
+		}
+	}
+
+	if command == commandTop {
+
+		err := runTop(newExporter(settings, 0, 0, *collectionMaxWait), top, os.Stdin, os.Stdout, isTerminal(os.Stdout))
 
-	urlExports := newUrlExportLustreMetrics(*promServer, *timeRange)
+		killProcesses()
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		os.Exit(0)
+	}
+
+	if command == commandJobReport {
+
+		// In a Slurm epilog the jobid is taken from the environment.
+		jobid := os.Getenv("SLURM_JOB_ID")
+
+		switch {
+		case len(positional) == 1:
+			jobid = positional[0]
+		case len(positional) > 1 || jobid == "":
+			fmt.Fprintf(os.Stderr, "Usage: %s %s [flags] <jobid>\n", os.Args[0], commandJobReport)
+			os.Exit(2)
+		}
+
+		err := runJobReport(settings, jobid, jobReport, os.Stdout)
+
+		killProcesses()
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		os.Exit(0)
+	}
+
+	if command == commandReport {
+
+		err := runReport(settings, report, os.Stdout)
+
+		killProcesses()
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		os.Exit(0)
+	}
+
+	if command == commandBackfill {
+
+		err := runBackfill(settings, backfill)
+
+		killProcesses()
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		os.Exit(0)
+	}
+
+	if pushgateway.url != "" {
+
+		pushgateway.grouping, err = parseKeyValuePairs(*pushgatewayGrouping)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		pushgateway.retry.backoff = defaultRetryBackoff
+		pushgateway.retry.maxBackoff = defaultPushgatewayRetryMaxBackoff
+	}
+
+	if *once {
+
+		if *onceFormat != outputFormatText && *onceFormat != outputFormatJSON {
+			log.Fatal("Unsupported output format: ", *onceFormat)
+		}
+
+		e := newExporter(settings, 0, 0, *collectionMaxWait)
+
+		if recorder != nil {
+			e.onInputs(recorder.handleInputs)
+			go recorder.run()
+		}
+
+		var outputs []func([]*dto.MetricFamily) error
+
+		if *textfileDir != "" {
+			outputs = append(outputs, func(families []*dto.MetricFamily) error {
+				return writeTextfile(*textfileDir, families)
+			})
+		}
+
+		if pushgateway.url != "" {
+
+			pusher, err := newPushgatewayPusher(pushgateway, nil)
+			if err != nil {
+				log.Fatal("Failed to create Pushgateway pusher: ", err)
+			}
+
+			outputs = append(outputs, pusher.push)
+		}
+
+		if len(outputs) == 0 {
+			outputs = append(outputs, func(families []*dto.MetricFamily) error {
+				return writeMetricFamilies(os.Stdout, families, *onceFormat)
+			})
+		}
+
+		err := runOnce(e, outputs...)
+
+		killProcesses()
+
+		if recorder != nil {
+
+			ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+
+			if err := recorder.shutdown(ctx); err != nil {
+				log.Error("Failed to record bundle: ", err)
+			}
+
+			cancel()
+		}
+
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	e := newExporter(settings, *collectionInterval, *snapshotMaxAge, *collectionMaxWait)
+
+	reloader := newConfigReloader(*configFile, baseConfig, e)
+	go reloader.watchSignals()
+
+	var senders []func(context.Context) error
+
+	if recorder != nil {
+
+		e.onInputs(recorder.handleInputs)
+		go recorder.run()
+
+		senders = append(senders, recorder.shutdown)
+
+		log.Info("Recording the collection inputs into: ", *recordDir)
+	}
+
+	if remoteWrite.client.url != "" {
+
+		if *collectionInterval <= 0 {
+			log.Fatal("Remote write requires a collection interval greater than 0")
+		}
+
+		writer, err := newRemoteWriter(remoteWrite)
+		if err != nil {
+			log.Fatal("Failed to create remote writer: ", err)
+		}
+
+		e.onSnapshot(writer.handleSnapshot)
+		go writer.run()
+
+		prometheus.MustRegister(writer)
+		senders = append(senders, writer.shutdown)
+
+		log.Info("Pushing metrics to remote write receiver: ", remoteWrite.client.url)
+	}
+
+	if otlp.client.url != "" {
+
+		if *collectionInterval <= 0 {
+			log.Fatal("OTLP export requires a collection interval greater than 0")
+		}
+
+		otlp.resourceAttributes, err = parseKeyValuePairs(*otlpResourceAttributes)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		otlp.retry.backoff = defaultRetryBackoff
+		otlp.retry.maxBackoff = defaultOTLPRetryMaxBackoff
+
+		otlpExporter, err := newOTLPExporter(otlp, prometheus.DefaultGatherer)
+		if err != nil {
+			log.Fatal("Failed to create OTLP exporter: ", err)
+		}
+
+		e.onSnapshot(otlpExporter.handleSnapshot)
+		go otlpExporter.run()
+
+		prometheus.MustRegister(otlpExporter)
+		senders = append(senders, otlpExporter.shutdown)
+
+		log.Info("Exporting metrics with OTLP ", otlp.protocol, " to: ", otlp.client.url)
+	}
+
+	if pushgateway.url != "" {
+
+		if *collectionInterval <= 0 {
+			log.Fatal("Pushing to the Pushgateway requires a collection interval greater than 0 or -once")
+		}
+
+		gatherer, err := newExporterGatherer(e)
+		if err != nil {
+			log.Fatal("Failed to create Pushgateway gatherer: ", err)
+		}
+
+		pusher, err := newPushgatewayPusher(pushgateway, gatherer)
+		if err != nil {
+			log.Fatal("Failed to create Pushgateway pusher: ", err)
+		}
+
+		e.onSnapshot(pusher.handleSnapshot)
+		go pusher.run()
+
+		prometheus.MustRegister(pusher)
+		senders = append(senders, pusher.shutdown)
+
+		log.Info("Pushing metrics to Pushgateway: ", pushgateway.url)
+	}
+
+	if *textfileDir != "" {
+
+		if *collectionInterval <= 0 {
+			log.Fatal("Writing the textfile requires a collection interval greater than 0 or -once")
+		}
+
+		writer, err := newTextfileWriter(*textfileDir, e)
+		if err != nil {
+			log.Fatal("Failed to create textfile writer: ", err)
+		}
+
+		e.onSnapshot(writer.handleSnapshot)
+
+		log.Info("Writing metrics into textfile directory: ", *textfileDir)
+	}
+
+	var history *jobHistory
+
+	if *apiEnable {
+
+		history, err = newJobHistory(*apiHistorySize, *apiHistoryRetention)
+		if err != nil {
+			log.Fatal("Failed to create JSON API history: ", err)
+		}
+
+		e.onSnapshot(history.handleSnapshot)
+	}
+
+	if *collectionInterval > 0 {
+		go e.run()
+	}
 
-	e := newExporter(*requestTimeout, urlExports.metadataOperations, urlExports.jobReadBytes, urlExports.jobWriteBytes)
 	prometheus.MustRegister(e)
+	prometheus.MustRegister(reloader)
 
 	http.Handle(metricsPath, promhttp.Handler())
+	http.Handle("/-/reload", reloader)
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-             <head><title>Cluster Exporter</title></head>
-             <body>
-             <h1>Cluster Exporter</h1>
-             <p><a href='` + metricsPath + `'>Metrics</a></p>
-             </body>
-             </html>`))
-	})
+	http.HandleFunc("/-/healthy", healthyHandler)
+	http.HandleFunc("/-/ready", newReadyHandler(e))
+	http.HandleFunc("/", newStatusHandler(e, metricsPath))
 
-	if err := http.ListenAndServe(listenAddress, nil); err != nil {
-		log.Error(err)
+	if history != nil {
+		http.Handle(apiPath, history)
 	}
 
+	server := &http.Server{Handler: http.DefaultServeMux}
+
+	go func() {
+		if err := serveWeb(server, listenAddress, *webConfigFile); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	waitForShutdown(server, e, *shutdownTimeout, senders...)
+
 	log.Info("Exporter finished")
 }
@@ -0,0 +1,79 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestBuildQueryURL(t *testing.T) {
+
+	options := promQueryOptions{flavor: flavorMimir}
+	validateQueryOptions(&options)
+
+	got := buildQueryURL(queryJobReadBytes, "2m", &options)
+
+	parsed, err := url.Parse(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.Path != "/prometheus/api/v1/query" {
+		t.Errorf("Expected path /prometheus/api/v1/query - got: %s", parsed.Path)
+	}
+
+	expectedQuery := "sum by(jobid)(irate(lustre_job_read_bytes_total[2m])!=0)"
+
+	if parsed.Query().Get("query") != expectedQuery {
+		t.Errorf("Expected query: %s - got: %s", expectedQuery, parsed.Query().Get("query"))
+	}
+
+	options = promQueryOptions{flavor: flavorThanos, apiPrefix: "/", thanosDedup: true}
+	validateQueryOptions(&options)
+
+	parsed, err = url.Parse(buildQueryURL(queryJobReadBytes, "1m", &options))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.Path != "/api/v1/query" {
+		t.Errorf("Expected path /api/v1/query - got: %s", parsed.Path)
+	}
+	if parsed.Query().Get("dedup") != "true" {
+		t.Errorf("Expected dedup=true - got: %s", parsed.Query().Get("dedup"))
+	}
+	if parsed.Query().Get("partial_response") != "false" {
+		t.Errorf("Expected partial_response=false - got: %s", parsed.Query().Get("partial_response"))
+	}
+}
+
+func TestBuildRangeQueryURL(t *testing.T) {
+
+	options := promQueryOptions{}
+	validateQueryOptions(&options)
+
+	start := time.Unix(1700000060, 0)
+
+	parsed, err := url.Parse(buildRangeQueryURL(queryJobReportReadBytes, "1m", &options, start, start.Add(time.Hour), time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.Path != "/api/v1/query_range" {
+		t.Errorf("Expected path /api/v1/query_range - got: %s", parsed.Path)
+	}
+
+	params := parsed.Query()
+
+	if params.Get("start") != "1700000060" || params.Get("end") != "1700003660" || params.Get("step") != "60" {
+		t.Errorf("Unexpected range parameters: %s", parsed.RawQuery)
+	}
+}
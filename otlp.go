@@ -0,0 +1,625 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Supported OTLP transport protocols.
+const (
+	otlpProtocolGRPC = "grpc"
+	otlpProtocolHTTP = "http/protobuf"
+)
+
+const (
+	otlpDefaultHTTPPath = "/v1/metrics"
+	otlpMaxResponseSize = 1 << 20
+	otlpScopeName       = "github.com/GSI-HPC/prometheus-cluster-exporter"
+	otlpServiceName     = "prometheus-cluster-exporter"
+)
+
+// otlpConfig holds the collector endpoint with the transport settings,
+// the retries of a failed export and the resource attributes.
+type otlpConfig struct {
+	client             promClientConfig
+	protocol           string
+	timeout            int
+	retry              promRetryConfig
+	resourceAttributes map[string]string
+}
+
+// otlpClient sends an export request over a specific OTLP transport.
+type otlpClient interface {
+	export(ctx context.Context, request *colmetricspb.ExportMetricsServiceRequest) error
+	retryable(err error) bool
+	close() error
+}
+
+type otlpHTTPClient struct {
+	endpoint *promEndpoint
+}
+
+type otlpGRPCClient struct {
+	conn    *grpc.ClientConn
+	client  colmetricspb.MetricsServiceClient
+	headers metadata.MD
+}
+
+// otlpExporter exports the cluster metrics gathered after each collection to an
+// OpenTelemetry collector. Only the latest collection is pending, so a slow
+// collector coalesces collections instead of queueing them.
+type otlpExporter struct {
+	client           otlpClient
+	gatherer         prometheus.Gatherer
+	retry            promRetryConfig
+	timeout          time.Duration
+	resource         *resourcepb.Resource
+	startTime        time.Time
+	pending          chan time.Time
+	mutex            sync.Mutex
+	closed           bool
+	done             chan struct{}
+	ctx              context.Context
+	cancel           context.CancelFunc
+	exportsMetric    prometheus.Counter
+	failuresMetric   prometheus.Counter
+	lastExportMetric prometheus.Gauge
+	dataPointsMetric prometheus.Counter
+	coalescedMetric  prometheus.Counter
+}
+
+func newOTLPExporter(config otlpConfig, gatherer prometheus.Gatherer) (*otlpExporter, error) {
+
+	if config.timeout <= 0 {
+		return nil, errors.New("request timeout must be greater then 0")
+	}
+
+	if config.retry.retries < 0 {
+		return nil, errors.New("retries must not be negative")
+	}
+
+	var client otlpClient
+	var err error
+
+	switch config.protocol {
+	case otlpProtocolHTTP:
+		client, err = newOTLPHTTPClient(config)
+	case otlpProtocolGRPC:
+		client, err = newOTLPGRPCClient(config)
+	default:
+		err = fmt.Errorf("unsupported protocol: %s - expected %s or %s", config.protocol, otlpProtocolGRPC, otlpProtocolHTTP)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &otlpExporter{
+		client:    client,
+		gatherer:  gatherer,
+		retry:     config.retry,
+		timeout:   time.Duration(config.timeout) * time.Second,
+		resource:  newOTLPResource(config.resourceAttributes),
+		startTime: time.Now(),
+		pending:   make(chan time.Time, 1),
+		done:      make(chan struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
+		exportsMetric: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespaceInternals,
+			Name:      "otlp_exports_total",
+			Help:      "Total export requests sent to the OTLP collector.",
+		}),
+		failuresMetric: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespaceInternals,
+			Name:      "otlp_export_failures_total",
+			Help:      "Total exports, which failed after all retries.",
+		}),
+		lastExportMetric: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespaceInternals,
+			Name:      "otlp_last_export_timestamp_seconds",
+			Help:      "Timestamp of the last successful export to the OTLP collector.",
+		}),
+		dataPointsMetric: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespaceInternals,
+			Name:      "otlp_exported_data_points_total",
+			Help:      "Total data points successfully exported to the OTLP collector.",
+		}),
+		coalescedMetric: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespaceInternals,
+			Name:      "otlp_coalesced_collections_total",
+			Help:      "Total collections not exported, since a newer collection was pending.",
+		}),
+	}, nil
+}
+
+func newOTLPHTTPClient(config otlpConfig) (*otlpHTTPClient, error) {
+
+	endpointURL, err := url.Parse(config.client.url)
+	if err != nil {
+		return nil, err
+	}
+
+	if endpointURL.Path == "" || endpointURL.Path == "/" {
+		endpointURL.Path = otlpDefaultHTTPPath
+		config.client.url = endpointURL.String()
+	}
+
+	endpoint, err := newPromEndpoint(config.client, config.timeout, otlpMaxResponseSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &otlpHTTPClient{endpoint}, nil
+}
+
+// newOTLPGRPCClient connects to the host and port of the endpoint URL.
+// The scheme https enables TLS, while http uses an insecure connection.
+func newOTLPGRPCClient(config otlpConfig) (*otlpGRPCClient, error) {
+
+	endpointURL, err := url.Parse(config.client.url)
+	if err != nil {
+		return nil, err
+	}
+
+	if endpointURL.Host == "" {
+		return nil, fmt.Errorf("endpoint URL has no host: %s", config.client.url)
+	}
+
+	var transportCredentials credentials.TransportCredentials
+
+	switch endpointURL.Scheme {
+	case "https":
+		tlsConfig, err := newTLSConfig(config.client)
+		if err != nil {
+			return nil, err
+		}
+		transportCredentials = credentials.NewTLS(tlsConfig)
+	case "http":
+		transportCredentials = insecure.NewCredentials()
+	default:
+		return nil, fmt.Errorf("unsupported scheme of endpoint URL: %s", endpointURL.Scheme)
+	}
+
+	conn, err := grpc.Dial(endpointURL.Host,
+		grpc.WithTransportCredentials(transportCredentials),
+		grpc.WithUserAgent(otlpServiceName+"/"+version))
+	if err != nil {
+		return nil, err
+	}
+
+	headers := metadata.MD{}
+	for name, value := range config.client.headers {
+		headers.Set(name, value)
+	}
+
+	return &otlpGRPCClient{
+		conn:    conn,
+		client:  colmetricspb.NewMetricsServiceClient(conn),
+		headers: headers,
+	}, nil
+}
+
+// newOTLPResource describes the exporter with the service attributes and the
+// configured attributes, which take precedence e.g. cluster or filesystem.
+func newOTLPResource(resourceAttributes map[string]string) *resourcepb.Resource {
+
+	attributes := map[string]string{
+		"service.name":    otlpServiceName,
+		"service.version": version,
+	}
+
+	for key, value := range resourceAttributes {
+		attributes[key] = value
+	}
+
+	return &resourcepb.Resource{Attributes: newOTLPAttributes(attributes)}
+}
+
+func newOTLPAttributes(attributes map[string]string) []*commonpb.KeyValue {
+
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	keyValues := make([]*commonpb.KeyValue, 0, len(keys))
+
+	for _, key := range keys {
+		keyValues = append(keyValues, &commonpb.KeyValue{
+			Key:   key,
+			Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: attributes[key]}},
+		})
+	}
+
+	return keyValues
+}
+
+// handleSnapshot marks the collection as pending for export.
+func (o *otlpExporter) handleSnapshot(current *snapshot) {
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.closed {
+		return
+	}
+
+	select {
+	case <-o.pending:
+		o.coalescedMetric.Inc()
+	default:
+	}
+
+	o.pending <- current.timestamp
+}
+
+// run exports the pending collections until the exporter is shut down.
+func (o *otlpExporter) run() {
+
+	defer close(o.done)
+
+	for timestamp := range o.pending {
+
+		families, err := o.gatherer.Gather()
+		if err != nil {
+			log.Warning("Gathering metrics for OTLP export partially failed: ", err)
+		}
+
+		request := newOTLPRequest(families, o.resource, o.startTime, timestamp)
+		dataPoints := countOTLPDataPoints(request)
+
+		o.exportsMetric.Inc()
+
+		if err := o.send(request); err != nil {
+			o.failuresMetric.Inc()
+			log.Error("Failed to export ", dataPoints, " data points to OTLP collector: ", err)
+			continue
+		}
+
+		o.dataPointsMetric.Add(float64(dataPoints))
+		o.lastExportMetric.SetToCurrentTime()
+	}
+}
+
+// send exports the request and retries it with backoff on retryable errors.
+func (o *otlpExporter) send(request *colmetricspb.ExportMetricsServiceRequest) error {
+
+	var err error
+
+	for attempt := 0; attempt <= o.retry.retries; attempt++ {
+
+		if attempt > 0 {
+
+			backoff := retryBackoff(o.retry, attempt-1)
+			log.Debugf("Retrying OTLP export in %s (attempt %d of %d)", backoff, attempt, o.retry.retries)
+
+			select {
+			case <-time.After(backoff):
+			case <-o.ctx.Done():
+				return err
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(o.ctx, o.timeout)
+		err = o.client.export(ctx, request)
+		cancel()
+
+		if err == nil || !o.client.retryable(err) {
+			return err
+		}
+
+		log.Warning("OTLP export failed: ", err)
+	}
+
+	return err
+}
+
+// shutdown stops accepting collections and waits until the pending collection is exported.
+// If the context is done before, the pending export is cancelled.
+func (o *otlpExporter) shutdown(ctx context.Context) error {
+
+	o.mutex.Lock()
+	if !o.closed {
+		o.closed = true
+		close(o.pending)
+	}
+	o.mutex.Unlock()
+
+	var err error
+
+	select {
+	case <-o.done:
+	case <-ctx.Done():
+		o.cancel()
+		err = ctx.Err()
+	}
+
+	if closeErr := o.client.close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func (o *otlpExporter) Describe(ch chan<- *prometheus.Desc) {
+	o.exportsMetric.Describe(ch)
+	o.failuresMetric.Describe(ch)
+	o.lastExportMetric.Describe(ch)
+	o.dataPointsMetric.Describe(ch)
+	o.coalescedMetric.Describe(ch)
+}
+
+func (o *otlpExporter) Collect(ch chan<- prometheus.Metric) {
+	o.exportsMetric.Collect(ch)
+	o.failuresMetric.Collect(ch)
+	o.lastExportMetric.Collect(ch)
+	o.dataPointsMetric.Collect(ch)
+	o.coalescedMetric.Collect(ch)
+}
+
+func (c *otlpHTTPClient) export(ctx context.Context, request *colmetricspb.ExportMetricsServiceRequest) error {
+
+	body, err := proto.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint.config.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", otlpServiceName+"/"+version)
+
+	if err := c.endpoint.authorize(req); err != nil {
+		return err
+	}
+
+	res, err := c.endpoint.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	content, err := ioutil.ReadAll(io.LimitReader(res.Body, c.endpoint.maxResponseSize))
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return newHTTPStatusError(res.StatusCode, content)
+	}
+
+	return nil
+}
+
+// retryable reports the errors, which are retryable by the OTLP specification.
+func (c *otlpHTTPClient) retryable(err error) bool {
+
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.statusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	return true
+}
+
+func (c *otlpHTTPClient) close() error {
+	return nil
+}
+
+func (c *otlpGRPCClient) export(ctx context.Context, request *colmetricspb.ExportMetricsServiceRequest) error {
+	_, err := c.client.Export(metadata.NewOutgoingContext(ctx, c.headers), request)
+	return err
+}
+
+// retryable reports the errors, which are retryable by the OTLP specification.
+func (c *otlpGRPCClient) retryable(err error) bool {
+
+	switch status.Code(err) {
+	case codes.Canceled, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted,
+		codes.OutOfRange, codes.Unavailable, codes.DataLoss:
+		return true
+	}
+
+	return false
+}
+
+func (c *otlpGRPCClient) close() error {
+	return c.conn.Close()
+}
+
+// newOTLPRequest converts the metric families with the prefix of the cluster namespace
+// to OTLP metrics. Counters are cumulative sums starting at the start time.
+func newOTLPRequest(families []*dto.MetricFamily, resource *resourcepb.Resource,
+	startTime time.Time, timestamp time.Time) *colmetricspb.ExportMetricsServiceRequest {
+
+	start := uint64(startTime.UnixNano())
+	now := uint64(timestamp.UnixNano())
+
+	metrics := make([]*metricspb.Metric, 0, len(families))
+
+	for _, family := range families {
+
+		if !strings.HasPrefix(family.GetName(), namespace+"_") {
+			continue
+		}
+
+		metric := &metricspb.Metric{Name: family.GetName(), Description: family.GetHelp()}
+
+		switch family.GetType() {
+
+		case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+			gauge := &metricspb.Gauge{}
+			for _, m := range family.Metric {
+				value := m.GetGauge().GetValue()
+				if family.GetType() == dto.MetricType_UNTYPED {
+					value = m.GetUntyped().GetValue()
+				}
+				gauge.DataPoints = append(gauge.DataPoints, &metricspb.NumberDataPoint{
+					Attributes:   newOTLPLabelAttributes(m.Label),
+					TimeUnixNano: now,
+					Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: value},
+				})
+			}
+			metric.Data = &metricspb.Metric_Gauge{Gauge: gauge}
+
+		case dto.MetricType_COUNTER:
+			sum := &metricspb.Sum{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				IsMonotonic:            true,
+			}
+			for _, m := range family.Metric {
+				sum.DataPoints = append(sum.DataPoints, &metricspb.NumberDataPoint{
+					Attributes:        newOTLPLabelAttributes(m.Label),
+					StartTimeUnixNano: start,
+					TimeUnixNano:      now,
+					Value:             &metricspb.NumberDataPoint_AsDouble{AsDouble: m.GetCounter().GetValue()},
+				})
+			}
+			metric.Data = &metricspb.Metric_Sum{Sum: sum}
+
+		case dto.MetricType_HISTOGRAM:
+			histogram := &metricspb.Histogram{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			}
+			for _, m := range family.Metric {
+				histogram.DataPoints = append(histogram.DataPoints, newOTLPHistogramDataPoint(m, start, now))
+			}
+			metric.Data = &metricspb.Metric_Histogram{Histogram: histogram}
+
+		case dto.MetricType_SUMMARY:
+			summary := &metricspb.Summary{}
+			for _, m := range family.Metric {
+				dataPoint := &metricspb.SummaryDataPoint{
+					Attributes:        newOTLPLabelAttributes(m.Label),
+					StartTimeUnixNano: start,
+					TimeUnixNano:      now,
+					Count:             m.GetSummary().GetSampleCount(),
+					Sum:               m.GetSummary().GetSampleSum(),
+				}
+				for _, quantile := range m.GetSummary().Quantile {
+					dataPoint.QuantileValues = append(dataPoint.QuantileValues, &metricspb.SummaryDataPoint_ValueAtQuantile{
+						Quantile: quantile.GetQuantile(),
+						Value:    quantile.GetValue(),
+					})
+				}
+				summary.DataPoints = append(summary.DataPoints, dataPoint)
+			}
+			metric.Data = &metricspb.Metric_Summary{Summary: summary}
+
+		default:
+			log.Debug("Skipping metric family with unsupported type for OTLP export: ", family.GetName())
+			continue
+		}
+
+		metrics = append(metrics, metric)
+	}
+
+	return &colmetricspb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			Resource: resource,
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Scope:   &commonpb.InstrumentationScope{Name: otlpScopeName, Version: version},
+				Metrics: metrics,
+			}},
+		}},
+	}
+}
+
+// newOTLPHistogramDataPoint converts the cumulative bucket counts
+// of a Prometheus histogram to the OTLP bucket counts.
+func newOTLPHistogramDataPoint(m *dto.Metric, start uint64, now uint64) *metricspb.HistogramDataPoint {
+
+	histogram := m.GetHistogram()
+	sum := histogram.GetSampleSum()
+
+	dataPoint := &metricspb.HistogramDataPoint{
+		Attributes:        newOTLPLabelAttributes(m.Label),
+		StartTimeUnixNano: start,
+		TimeUnixNano:      now,
+		Count:             histogram.GetSampleCount(),
+		Sum:               &sum,
+	}
+
+	var previous uint64
+
+	for _, bucket := range histogram.Bucket {
+		dataPoint.ExplicitBounds = append(dataPoint.ExplicitBounds, bucket.GetUpperBound())
+		dataPoint.BucketCounts = append(dataPoint.BucketCounts, bucket.GetCumulativeCount()-previous)
+		previous = bucket.GetCumulativeCount()
+	}
+
+	dataPoint.BucketCounts = append(dataPoint.BucketCounts, histogram.GetSampleCount()-previous)
+
+	return dataPoint
+}
+
+func newOTLPLabelAttributes(labels []*dto.LabelPair) []*commonpb.KeyValue {
+
+	attributes := make(map[string]string, len(labels))
+	for _, label := range labels {
+		attributes[label.GetName()] = label.GetValue()
+	}
+
+	return newOTLPAttributes(attributes)
+}
+
+func countOTLPDataPoints(request *colmetricspb.ExportMetricsServiceRequest) int {
+
+	count := 0
+
+	for _, resourceMetrics := range request.ResourceMetrics {
+		for _, scopeMetrics := range resourceMetrics.ScopeMetrics {
+			for _, metric := range scopeMetrics.Metrics {
+				count += len(metric.GetGauge().GetDataPoints()) + len(metric.GetSum().GetDataPoints()) +
+					len(metric.GetHistogram().GetDataPoints()) + len(metric.GetSummary().GetDataPoints())
+			}
+		}
+	}
+
+	return count
+}
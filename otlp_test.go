@@ -0,0 +1,213 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// testMetricsService is an OTLP collector stand-in receiving the export requests.
+type testMetricsService struct {
+	colmetricspb.UnimplementedMetricsServiceServer
+	requests chan *colmetricspb.ExportMetricsServiceRequest
+	headers  chan metadata.MD
+}
+
+func (s *testMetricsService) Export(ctx context.Context, request *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	headers, _ := metadata.FromIncomingContext(ctx)
+	s.headers <- headers
+	s.requests <- request
+	return &colmetricspb.ExportMetricsServiceResponse{}, nil
+}
+
+func newTestOTLPGatherer() prometheus.Gatherer {
+
+	registry := prometheus.NewRegistry()
+
+	metrics := newCollectionMetrics(nil)
+	metrics.jobReadThroughputMetric.WithLabelValues("hpc", "alice").Set(1024)
+	registry.MustRegister(metrics.jobReadThroughputMetric)
+
+	stages := newStageMetrics()
+	stages.record("retrieve_running_jobs", 0.1, nil)
+	registry.MustRegister(stages.collectors()...)
+
+	registry.MustRegister(prometheus.NewGoCollector())
+
+	return registry
+}
+
+// checkOTLPRequest checks the resource attributes and the exported metrics.
+func checkOTLPRequest(t *testing.T, request *colmetricspb.ExportMetricsServiceRequest) {
+
+	if len(request.ResourceMetrics) != 1 {
+		t.Fatalf("Expected 1 resource metrics - got: %d", len(request.ResourceMetrics))
+	}
+
+	resourceMetrics := request.ResourceMetrics[0]
+
+	attributes := make(map[string]string)
+	for _, attribute := range resourceMetrics.Resource.Attributes {
+		attributes[attribute.Key] = attribute.Value.GetStringValue()
+	}
+
+	if attributes["cluster"] != "virgo" || attributes["service.name"] != otlpServiceName {
+		t.Errorf("Unexpected resource attributes: %v", attributes)
+	}
+
+	metrics := make(map[string]bool)
+
+	for _, metric := range resourceMetrics.ScopeMetrics[0].Metrics {
+
+		metrics[metric.Name] = true
+
+		switch metric.Name {
+		case "cluster_job_read_throughput_bytes":
+			dataPoint := metric.GetGauge().GetDataPoints()[0]
+			if dataPoint.GetAsDouble() != 1024 || len(dataPoint.Attributes) != 2 {
+				t.Errorf("Unexpected data point: %v", dataPoint)
+			}
+		case "cluster_exporter_stage_runs_total":
+			if !metric.GetSum().GetIsMonotonic() {
+				t.Error("Expected counter as monotonic sum")
+			}
+		case "cluster_exporter_stage_duration_seconds":
+			dataPoint := metric.GetHistogram().GetDataPoints()[0]
+			if len(dataPoint.BucketCounts) != len(dataPoint.ExplicitBounds)+1 || dataPoint.Count != 1 {
+				t.Errorf("Unexpected histogram data point: %v", dataPoint)
+			}
+		}
+	}
+
+	for _, name := range []string{"cluster_job_read_throughput_bytes", "cluster_exporter_stage_runs_total", "cluster_exporter_stage_duration_seconds"} {
+		if !metrics[name] {
+			t.Errorf("Expected metric %s to be exported", name)
+		}
+	}
+
+	for name := range metrics {
+		if name == "go_goroutines" {
+			t.Error("Expected metrics without cluster prefix not to be exported")
+		}
+	}
+}
+
+func TestOTLPExportHTTP(t *testing.T) {
+
+	requests := make(chan *colmetricspb.ExportMetricsServiceRequest, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.URL.Path != otlpDefaultHTTPPath || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		request := &colmetricspb.ExportMetricsServiceRequest{}
+		if err := proto.Unmarshal(body, request); err != nil {
+			t.Error(err)
+		}
+
+		requests <- request
+	}))
+	defer server.Close()
+
+	exporter, err := newOTLPExporter(otlpConfig{
+		client:             promClientConfig{url: server.URL},
+		protocol:           otlpProtocolHTTP,
+		timeout:            1,
+		resourceAttributes: map[string]string{"cluster": "virgo"},
+	}, newTestOTLPGatherer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go exporter.run()
+
+	exporter.handleSnapshot(&snapshot{timestamp: time.Now()})
+
+	if err := exporter.shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case request := <-requests:
+		checkOTLPRequest(t, request)
+	default:
+		t.Fatal("Expected export request")
+	}
+}
+
+func TestOTLPExportGRPC(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := &testMetricsService{
+		requests: make(chan *colmetricspb.ExportMetricsServiceRequest, 1),
+		headers:  make(chan metadata.MD, 1),
+	}
+
+	server := grpc.NewServer()
+	colmetricspb.RegisterMetricsServiceServer(server, service)
+
+	go server.Serve(listener)
+	defer server.Stop()
+
+	exporter, err := newOTLPExporter(otlpConfig{
+		client: promClientConfig{
+			url:     "http://" + listener.Addr().String(),
+			headers: map[string]string{"X-Scope-OrgID": "hpc"},
+		},
+		protocol:           otlpProtocolGRPC,
+		timeout:            5,
+		resourceAttributes: map[string]string{"cluster": "virgo"},
+	}, newTestOTLPGatherer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go exporter.run()
+
+	exporter.handleSnapshot(&snapshot{timestamp: time.Now()})
+
+	if err := exporter.shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case request := <-service.requests:
+		checkOTLPRequest(t, request)
+	default:
+		t.Fatal("Expected export request")
+	}
+
+	if headers := <-service.headers; len(headers.Get("X-Scope-OrgID")) != 1 || headers.Get("X-Scope-OrgID")[0] != "hpc" {
+		t.Errorf("Expected header X-Scope-OrgID - got: %v", headers)
+	}
+}
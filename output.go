@@ -0,0 +1,249 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// Supported formats of the one-shot output.
+const (
+	outputFormatText = "text"
+	outputFormatJSON = "json"
+)
+
+// Name of the file written into the textfile directory of the node_exporter.
+const textfileName = "cluster_exporter.prom"
+
+type jsonMetricFamily struct {
+	Name    string       `json:"name"`
+	Help    string       `json:"help"`
+	Type    string       `json:"type"`
+	Metrics []jsonMetric `json:"metrics"`
+}
+
+type jsonMetric struct {
+	Labels    map[string]string  `json:"labels,omitempty"`
+	Value     *float64           `json:"value,omitempty"`
+	Count     *uint64            `json:"count,omitempty"`
+	Sum       *float64           `json:"sum,omitempty"`
+	Buckets   map[string]uint64  `json:"buckets,omitempty"`
+	Quantiles map[string]float64 `json:"quantiles,omitempty"`
+}
+
+// textfileWriter writes the metrics of each collection into the textfile directory.
+type textfileWriter struct {
+	dir      string
+	gatherer prometheus.Gatherer
+}
+
+// newExporterGatherer returns a gatherer of the exporter metrics only, so the
+// output does not collide with the Go runtime metrics of other exporters.
+func newExporterGatherer(e *exporter) (prometheus.Gatherer, error) {
+
+	registry := prometheus.NewRegistry()
+
+	if err := registry.Register(e); err != nil {
+		return nil, err
+	}
+
+	return registry, nil
+}
+
+// runOnce runs a single collection and passes the metrics to the outputs
+// e.g. to print them or write them into the textfile directory.
+// An error is returned, if the collection failed in any stage.
+func runOnce(e *exporter, outputs ...func([]*dto.MetricFamily) error) error {
+
+	gatherer, err := newExporterGatherer(e)
+	if err != nil {
+		return err
+	}
+
+	families, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	for _, output := range outputs {
+		if err := output(families); err != nil {
+			return err
+		}
+	}
+
+	current, _ := e.snapshot.Load().(*snapshot)
+	if current == nil {
+		return errors.New("no collection has been run")
+	}
+
+	if !current.scrapeOK {
+		return fmt.Errorf("collection failed in stages: %s", strings.Join(current.failedStages(), ", "))
+	}
+
+	return nil
+}
+
+func newTextfileWriter(dir string, e *exporter) (*textfileWriter, error) {
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return nil, fmt.Errorf("not a directory: %s", dir)
+	}
+
+	gatherer, err := newExporterGatherer(e)
+	if err != nil {
+		return nil, err
+	}
+
+	return &textfileWriter{dir: dir, gatherer: gatherer}, nil
+}
+
+// handleSnapshot writes the metrics, which include the latest snapshot.
+// It requires the background collection, since a synchronous collection
+// would wait for itself on gathering the exporter.
+func (w *textfileWriter) handleSnapshot(current *snapshot) {
+
+	families, err := w.gatherer.Gather()
+	if err != nil {
+		log.Warning("Gathering metrics for textfile partially failed: ", err)
+	}
+
+	if err := writeTextfile(w.dir, families); err != nil {
+		log.Error("Failed to write textfile: ", err)
+	}
+}
+
+// writeTextfile atomically replaces the textfile with the metric families,
+// so the node_exporter never reads a partially written file.
+func writeTextfile(dir string, families []*dto.MetricFamily) error {
+
+	tmp, err := ioutil.TempFile(dir, "."+textfileName+".*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if err := writeMetricFamilies(tmp, families, outputFormatText); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(dir, textfileName))
+}
+
+func writeMetricFamilies(output io.Writer, families []*dto.MetricFamily, format string) error {
+
+	switch format {
+
+	case outputFormatText:
+		for _, family := range families {
+			if _, err := expfmt.MetricFamilyToText(output, family); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case outputFormatJSON:
+		encoder := json.NewEncoder(output)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(newJSONMetricFamilies(families))
+
+	default:
+		return fmt.Errorf("unsupported output format: %s - expected %s or %s", format, outputFormatText, outputFormatJSON)
+	}
+}
+
+func newJSONMetricFamilies(families []*dto.MetricFamily) []jsonMetricFamily {
+
+	jsonFamilies := make([]jsonMetricFamily, 0, len(families))
+
+	for _, family := range families {
+
+		jsonFamily := jsonMetricFamily{
+			Name:    family.GetName(),
+			Help:    family.GetHelp(),
+			Type:    strings.ToLower(family.GetType().String()),
+			Metrics: make([]jsonMetric, 0, len(family.Metric)),
+		}
+
+		for _, metric := range family.Metric {
+
+			jsonMetric := jsonMetric{}
+
+			if len(metric.Label) > 0 {
+				jsonMetric.Labels = make(map[string]string, len(metric.Label))
+				for _, label := range metric.Label {
+					jsonMetric.Labels[label.GetName()] = label.GetValue()
+				}
+			}
+
+			switch family.GetType() {
+
+			case dto.MetricType_COUNTER:
+				jsonMetric.Value = metric.GetCounter().Value
+
+			case dto.MetricType_GAUGE:
+				jsonMetric.Value = metric.GetGauge().Value
+
+			case dto.MetricType_UNTYPED:
+				jsonMetric.Value = metric.GetUntyped().Value
+
+			case dto.MetricType_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				jsonMetric.Count = histogram.SampleCount
+				jsonMetric.Sum = histogram.SampleSum
+				jsonMetric.Buckets = make(map[string]uint64, len(histogram.Bucket))
+				for _, bucket := range histogram.Bucket {
+					jsonMetric.Buckets[formatFloat(bucket.GetUpperBound())] = bucket.GetCumulativeCount()
+				}
+
+			case dto.MetricType_SUMMARY:
+				summary := metric.GetSummary()
+				jsonMetric.Count = summary.SampleCount
+				jsonMetric.Sum = summary.SampleSum
+				jsonMetric.Quantiles = make(map[string]float64, len(summary.Quantile))
+				for _, quantile := range summary.Quantile {
+					jsonMetric.Quantiles[formatFloat(quantile.GetQuantile())] = quantile.GetValue()
+				}
+			}
+
+			jsonFamily.Metrics = append(jsonFamily.Metrics, jsonMetric)
+		}
+
+		jsonFamilies = append(jsonFamilies, jsonFamily)
+	}
+
+	return jsonFamilies
+}
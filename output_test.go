@@ -0,0 +1,101 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestRunOnce(t *testing.T) {
+
+	if _, err := exec.LookPath(SQUEUE); err == nil {
+		t.Skip("Requires squeue to be missing for a failing stage")
+	}
+
+	var output bytes.Buffer
+
+	err := runOnce(newExporter(newTestSettings(), 0, 0, time.Minute), func(families []*dto.MetricFamily) error {
+		return writeMetricFamilies(&output, families, outputFormatText)
+	})
+
+	if err == nil || !strings.Contains(err.Error(), "retrieve_running_jobs") {
+		t.Errorf("Expected error for the failed stage retrieve_running_jobs - got: %v", err)
+	}
+
+	if !strings.Contains(output.String(), "cluster_exporter_scrape_ok 0") {
+		t.Errorf("Expected metrics in text format - got: %s", output.String())
+	}
+
+	dir := t.TempDir()
+
+	if err := runOnce(newExporter(newTestSettings(), 0, 0, time.Minute), func(families []*dto.MetricFamily) error {
+		return writeTextfile(dir, families)
+	}); err == nil {
+		t.Error("Expected error for the failed stage")
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, textfileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(content), "# TYPE cluster_exporter_scrape_ok gauge") {
+		t.Errorf("Expected metrics in textfile - got: %s", content)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 {
+		t.Errorf("Expected only the textfile in the directory - got: %d files", len(files))
+	}
+}
+
+func TestWriteMetricFamiliesJSON(t *testing.T) {
+
+	families, err := newTestSnapshot().metricFamilies()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+
+	if err := writeMetricFamilies(&output, families, outputFormatJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded []jsonMetricFamily
+
+	if err := json.Unmarshal(output.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, family := range decoded {
+		if family.Name == "cluster_job_read_throughput_bytes" {
+			metric := family.Metrics[0]
+			if family.Type != "gauge" || *metric.Value != 1024 || metric.Labels["account"] != "hpc" {
+				t.Errorf("Unexpected metric family: %+v", family)
+			}
+			return
+		}
+	}
+
+	t.Error("Expected metric family cluster_job_read_throughput_bytes")
+}
@@ -0,0 +1,267 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// Supported methods of pushing to the Pushgateway.
+const (
+	pushMethodPut  = "put"
+	pushMethodPost = "post"
+)
+
+// pushgatewayConfig holds the Pushgateway URL with the job and grouping key,
+// the push method, the basic auth credentials and the retries of a failed push.
+type pushgatewayConfig struct {
+	url                   string
+	job                   string
+	grouping              map[string]string
+	method                string
+	basicAuthUser         string
+	basicAuthPasswordFile string
+	timeout               int
+	retry                 promRetryConfig
+}
+
+// pushgatewayPusher pushes the metrics of the exporter to a Pushgateway.
+// With PUT all metrics of the grouping key are replaced, while POST only
+// replaces the metrics with the same names.
+type pushgatewayPusher struct {
+	config            pushgatewayConfig
+	basicAuthPassword string
+	client            *http.Client
+	gatherer          prometheus.Gatherer
+	pending           chan struct{}
+	mutex             sync.Mutex
+	closed            bool
+	done              chan struct{}
+	ctx               context.Context
+	cancel            context.CancelFunc
+	pushesMetric      prometheus.Counter
+	failuresMetric    prometheus.Counter
+	lastPushMetric    prometheus.Gauge
+}
+
+func newPushgatewayPusher(config pushgatewayConfig, gatherer prometheus.Gatherer) (*pushgatewayPusher, error) {
+
+	if config.url == "" {
+		return nil, errors.New("Pushgateway URL is empty")
+	}
+
+	if config.job == "" {
+		return nil, errors.New("job must not be empty")
+	}
+
+	if config.method != pushMethodPut && config.method != pushMethodPost {
+		return nil, fmt.Errorf("unsupported method: %s - expected %s or %s", config.method, pushMethodPut, pushMethodPost)
+	}
+
+	if config.timeout <= 0 {
+		return nil, errors.New("request timeout must be greater then 0")
+	}
+
+	if config.retry.retries < 0 {
+		return nil, errors.New("retries must not be negative")
+	}
+
+	var basicAuthPassword string
+
+	if config.basicAuthPasswordFile != "" {
+
+		if config.basicAuthUser == "" {
+			return nil, errors.New("basic auth password file is set without a user")
+		}
+
+		var err error
+
+		basicAuthPassword, err = readSecretFile(config.basicAuthPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &pushgatewayPusher{
+		config:            config,
+		basicAuthPassword: basicAuthPassword,
+		client:            &http.Client{Timeout: time.Duration(config.timeout) * time.Second},
+		gatherer:          gatherer,
+		pending:           make(chan struct{}, 1),
+		done:              make(chan struct{}),
+		ctx:               ctx,
+		cancel:            cancel,
+		pushesMetric: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespaceInternals,
+			Name:      "pushgateway_pushes_total",
+			Help:      "Total pushes of the metrics to the Pushgateway.",
+		}),
+		failuresMetric: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespaceInternals,
+			Name:      "pushgateway_push_failures_total",
+			Help:      "Total pushes to the Pushgateway, which failed after all retries.",
+		}),
+		lastPushMetric: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespaceInternals,
+			Name:      "pushgateway_last_push_timestamp_seconds",
+			Help:      "Timestamp of the last successful push to the Pushgateway.",
+		}),
+	}, nil
+}
+
+// push pushes the metric families and retries it with backoff on errors.
+func (p *pushgatewayPusher) push(families []*dto.MetricFamily) error {
+
+	pusher := push.New(p.config.url, p.config.job).
+		Client(p.client).
+		Gatherer(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return families, nil }))
+
+	for key, value := range p.config.grouping {
+		pusher = pusher.Grouping(key, value)
+	}
+
+	if p.config.basicAuthUser != "" {
+		pusher = pusher.BasicAuth(p.config.basicAuthUser, p.basicAuthPassword)
+	}
+
+	p.pushesMetric.Inc()
+
+	var err error
+
+	for attempt := 0; attempt <= p.config.retry.retries; attempt++ {
+
+		if attempt > 0 {
+
+			backoff := retryBackoff(p.config.retry, attempt-1)
+			log.Debugf("Retrying push to Pushgateway in %s (attempt %d of %d)", backoff, attempt, p.config.retry.retries)
+
+			select {
+			case <-time.After(backoff):
+			case <-p.ctx.Done():
+				p.failuresMetric.Inc()
+				return err
+			}
+		}
+
+		if p.config.method == pushMethodPost {
+			err = pusher.Add()
+		} else {
+			err = pusher.Push()
+		}
+
+		if err == nil {
+			p.lastPushMetric.SetToCurrentTime()
+			return nil
+		}
+
+		log.Warning("Push to Pushgateway failed: ", err)
+	}
+
+	p.failuresMetric.Inc()
+
+	return err
+}
+
+// handleSnapshot marks the collection as pending for push.
+func (p *pushgatewayPusher) handleSnapshot(current *snapshot) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return
+	}
+
+	select {
+	case p.pending <- struct{}{}:
+	default:
+	}
+}
+
+// run pushes the metrics of the pending collections until the pusher is shut down.
+func (p *pushgatewayPusher) run() {
+
+	defer close(p.done)
+
+	for range p.pending {
+
+		families, err := p.gatherer.Gather()
+		if err != nil {
+			log.Warning("Gathering metrics for Pushgateway partially failed: ", err)
+		}
+
+		if err := p.push(families); err != nil {
+			log.Error("Failed to push metrics to Pushgateway: ", err)
+		}
+	}
+}
+
+// shutdown stops accepting collections and waits until the pending push finished.
+// If the context is done before, the pending push is cancelled.
+func (p *pushgatewayPusher) shutdown(ctx context.Context) error {
+
+	p.mutex.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.pending)
+	}
+	p.mutex.Unlock()
+
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		p.cancel()
+		return ctx.Err()
+	}
+}
+
+func (p *pushgatewayPusher) Describe(ch chan<- *prometheus.Desc) {
+	p.pushesMetric.Describe(ch)
+	p.failuresMetric.Describe(ch)
+	p.lastPushMetric.Describe(ch)
+}
+
+func (p *pushgatewayPusher) Collect(ch chan<- prometheus.Metric) {
+	p.pushesMetric.Collect(ch)
+	p.failuresMetric.Collect(ch)
+	p.lastPushMetric.Collect(ch)
+}
+
+// parseKeyValuePairs parses a comma separated list of key=value pairs.
+func parseKeyValuePairs(list string) (map[string]string, error) {
+
+	pairs := make(map[string]string)
+
+	for _, pair := range splitList(list) {
+
+		fields := strings.SplitN(pair, "=", 2)
+
+		if len(fields) != 2 || strings.TrimSpace(fields[0]) == "" {
+			return nil, fmt.Errorf("pair must be given as key=value: %s", pair)
+		}
+
+		pairs[strings.TrimSpace(fields[0])] = strings.TrimSpace(fields[1])
+	}
+
+	return pairs, nil
+}
@@ -0,0 +1,137 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testPush struct {
+	method string
+	path   string
+	user   string
+}
+
+func TestPushgatewayPush(t *testing.T) {
+
+	pushes := make(chan testPush, 3)
+	attempts := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		attempts++
+
+		if attempts == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		user, password, _ := r.BasicAuth()
+		if password != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		pushes <- testPush{method: r.Method, path: r.URL.Path, user: user}
+	}))
+	defer server.Close()
+
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := ioutil.WriteFile(passwordFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := pushgatewayConfig{
+		url:                   server.URL,
+		job:                   "cluster_exporter",
+		grouping:              map[string]string{"filesystem": "hebe", "cluster": "virgo"},
+		method:                pushMethodPut,
+		basicAuthUser:         "alice",
+		basicAuthPasswordFile: passwordFile,
+		timeout:               1,
+		retry:                 promRetryConfig{retries: 1, backoff: time.Millisecond, maxBackoff: time.Millisecond},
+	}
+
+	families, err := newTestSnapshot().metricFamilies()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pusher, err := newPushgatewayPusher(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pusher.push(families); err != nil {
+		t.Fatal(err)
+	}
+
+	push := <-pushes
+
+	if push.method != http.MethodPut || push.user != "alice" {
+		t.Errorf("Unexpected push: %s by %s", push.method, push.user)
+	}
+
+	// The order of the grouping labels in the path is not defined.
+	if !strings.HasPrefix(push.path, "/metrics/job/cluster_exporter/") ||
+		!strings.Contains(push.path, "/cluster/virgo") || !strings.Contains(push.path, "/filesystem/hebe") {
+		t.Errorf("Unexpected grouping key path: %s", push.path)
+	}
+
+	if attempts != 2 {
+		t.Errorf("Expected push to be retried once - got: %d attempts", attempts)
+	}
+
+	config.method = pushMethodPost
+
+	pusher, err = newPushgatewayPusher(config, newTestOTLPGatherer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go pusher.run()
+
+	pusher.handleSnapshot(&snapshot{timestamp: time.Now()})
+
+	if err := pusher.shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case push := <-pushes:
+		if push.method != http.MethodPost || !strings.Contains(push.path, "/job/cluster_exporter") {
+			t.Errorf("Unexpected push: %s %s", push.method, push.path)
+		}
+	default:
+		t.Fatal("Expected push on collection")
+	}
+}
+
+func TestParseKeyValuePairs(t *testing.T) {
+
+	pairs, err := parseKeyValuePairs("cluster=virgo, filesystem=hebe")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pairs["cluster"] != "virgo" || pairs["filesystem"] != "hebe" {
+		t.Errorf("Unexpected pairs: %v", pairs)
+	}
+
+	if _, err := parseKeyValuePairs("cluster"); err == nil {
+		t.Error("Expected error for pair without value")
+	}
+}
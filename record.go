@@ -0,0 +1,383 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const commandReplay = "replay"
+
+const defaultRecordMaxBundles = 100
+
+// Count of collections waiting to be recorded, above which the bundles are dropped.
+const recordQueueCapacity = 10
+
+// Files of the raw inputs in a bundle. The Prometheus responses are
+// named by the query e.g. metadata_operations.json.
+const (
+	bundleRunningJobsFile = "squeue.txt"
+	bundleUsersFile       = "passwd"
+	bundleGroupsFile      = "group"
+	bundleResponseSuffix  = ".json"
+)
+
+// Time format of the bundle directories, which sorts by time.
+const bundleTimeFormat = "20060102T150405.000Z"
+
+// collectionInputs are the raw inputs of a collection. An input is nil,
+// if it could not be retrieved.
+type collectionInputs struct {
+	timestamp   time.Time
+	runningJobs []byte
+	users       []byte
+	groups      []byte
+	responses   map[string][]byte
+}
+
+// bundleRecorder records the inputs of each collection into a bundle
+// directory and removes the oldest bundles above the maximum count.
+// The bundles are written by a single goroutine, so the disk latency is not
+// added to the collection. If the queue is full, the inputs are dropped.
+type bundleRecorder struct {
+	dir        string
+	maxBundles int
+	queue      chan *collectionInputs
+	done       chan struct{}
+	mutex      sync.Mutex
+	closed     bool
+}
+
+type replayOptions struct {
+	format string
+}
+
+func newBundleRecorder(dir string, maxBundles int) (*bundleRecorder, error) {
+
+	if maxBundles <= 0 {
+		return nil, errors.New("maximum count of bundles must be greater than 0")
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &bundleRecorder{
+		dir:        dir,
+		maxBundles: maxBundles,
+		queue:      make(chan *collectionInputs, recordQueueCapacity),
+		done:       make(chan struct{}),
+	}, nil
+}
+
+func newReplayFlags(flags *flag.FlagSet) *replayOptions {
+
+	options := &replayOptions{}
+
+	flags.StringVar(&options.format, "replay.format", outputFormatText, "Output format of the replayed metrics - text or json")
+
+	return options
+}
+
+// handleInputs enqueues the inputs for recording without blocking the collection.
+func (r *bundleRecorder) handleInputs(inputs *collectionInputs) {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	select {
+	case r.queue <- inputs:
+	default:
+		log.Warning("Record queue is full - Dropping bundle of ", inputs.timestamp.UTC().Format(bundleTimeFormat))
+	}
+}
+
+// run records the queued inputs until the recorder is shut down.
+func (r *bundleRecorder) run() {
+
+	defer close(r.done)
+
+	for inputs := range r.queue {
+		r.record(inputs)
+	}
+}
+
+// record writes the bundle of the inputs. Errors are only logged.
+func (r *bundleRecorder) record(inputs *collectionInputs) {
+
+	path, err := writeBundle(r.dir, inputs)
+	if err != nil {
+		log.Error("Failed to record bundle: ", err)
+		return
+	}
+
+	log.Debug("Recorded bundle ", path)
+
+	if err := pruneBundles(r.dir, r.maxBundles); err != nil {
+		log.Error("Failed to remove old bundles: ", err)
+	}
+}
+
+// shutdown stops accepting inputs and waits until the queued bundles are
+// written or the context is done.
+func (r *bundleRecorder) shutdown(ctx context.Context) error {
+
+	r.mutex.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.queue)
+	}
+	r.mutex.Unlock()
+
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// writeBundle writes the inputs into a temporary directory, which is
+// renamed to the timestamp, so a bundle is never read partially written.
+func writeBundle(dir string, inputs *collectionInputs) (string, error) {
+
+	tmp, err := ioutil.TempDir(dir, ".bundle.*")
+	if err != nil {
+		return "", err
+	}
+
+	defer os.RemoveAll(tmp)
+
+	files := map[string][]byte{
+		bundleRunningJobsFile: inputs.runningJobs,
+		bundleUsersFile:       inputs.users,
+		bundleGroupsFile:      inputs.groups,
+	}
+
+	for name, response := range inputs.responses {
+		files[name+bundleResponseSuffix] = response
+	}
+
+	for name, content := range files {
+		if content == nil {
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(tmp, name), content, 0644); err != nil {
+			return "", err
+		}
+	}
+
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, inputs.timestamp.UTC().Format(bundleTimeFormat))
+
+	return path, os.Rename(tmp, path)
+}
+
+// pruneBundles removes the oldest bundles above the maximum count.
+func pruneBundles(dir string, maxBundles int) error {
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	bundles := make([]string, 0, len(entries))
+
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			bundles = append(bundles, entry.Name())
+		}
+	}
+
+	sort.Strings(bundles)
+
+	for len(bundles) > maxBundles {
+
+		if err := os.RemoveAll(filepath.Join(dir, bundles[0])); err != nil {
+			return err
+		}
+
+		bundles = bundles[1:]
+	}
+
+	return nil
+}
+
+// readBundle reads the inputs of a bundle directory. Missing files are nil.
+func readBundle(path string) (*collectionInputs, error) {
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return nil, fmt.Errorf("bundle is not a directory: %s", path)
+	}
+
+	read := func(name string) ([]byte, error) {
+		content, err := ioutil.ReadFile(filepath.Join(path, name))
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return content, err
+	}
+
+	inputs := &collectionInputs{timestamp: info.ModTime(), responses: make(map[string][]byte)}
+
+	if timestamp, err := time.Parse(bundleTimeFormat, filepath.Base(path)); err == nil {
+		inputs.timestamp = timestamp
+	}
+
+	if inputs.runningJobs, err = read(bundleRunningJobsFile); err != nil {
+		return nil, err
+	}
+
+	if inputs.users, err = read(bundleUsersFile); err != nil {
+		return nil, err
+	}
+
+	if inputs.groups, err = read(bundleGroupsFile); err != nil {
+		return nil, err
+	}
+
+	for _, name := range []string{queryNameMetadataOperations, queryNameReadThroughput, queryNameWriteThroughput} {
+
+		response, err := read(name + bundleResponseSuffix)
+		if err != nil {
+			return nil, err
+		}
+
+		if response != nil {
+			inputs.responses[name] = response
+		}
+	}
+
+	return inputs, nil
+}
+
+// runReplay runs the attribution of a collection on the inputs of the
+// bundle with the current configuration and writes the metrics.
+func runReplay(settings *collectionSettings, path string, options *replayOptions, output io.Writer) error {
+
+	if options.format != outputFormatText && options.format != outputFormatJSON {
+		return fmt.Errorf("unsupported output format: %s - expected %s or %s", options.format, outputFormatText, outputFormatJSON)
+	}
+
+	inputs, err := readBundle(path)
+	if err != nil {
+		return err
+	}
+
+	metrics, err := replayBundle(settings, inputs)
+	if err != nil {
+		return err
+	}
+
+	families, err := (&snapshot{metrics: metrics.gather()}).metricFamilies()
+	if err != nil {
+		return err
+	}
+
+	return writeMetricFamilies(output, families, options.format)
+}
+
+// replayBundle parses the inputs like a collection and runs the build
+// functions on them. Missing Prometheus responses are left out like
+// failed queries.
+func replayBundle(settings *collectionSettings, inputs *collectionInputs) (*collectionMetrics, error) {
+
+	if inputs.runningJobs == nil || inputs.users == nil || inputs.groups == nil {
+		return nil, fmt.Errorf("bundle requires %s, %s and %s", bundleRunningJobsFile, bundleUsersFile, bundleGroupsFile)
+	}
+
+	if len(inputs.responses) == 0 {
+		return nil, errors.New("bundle contains no Prometheus responses")
+	}
+
+	users, err := parseUserInfoMap(inputs.users)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", bundleUsersFile, err)
+	}
+
+	groups, err := parseGroupInfoMap(inputs.groups)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", bundleGroupsFile, err)
+	}
+
+	// The responses are validated like by the queries of a collection.
+	for name, response := range inputs.responses {
+		if err := checkQueryResponse(&response); err != nil && !isPartialResult(err) {
+			return nil, fmt.Errorf("%s: %w", name+bundleResponseSuffix, err)
+		}
+	}
+
+	attribution := newAttributionInputs()
+
+	if response, ok := inputs.responses[queryNameMetadataOperations]; ok {
+
+		metadataOperations, err := parseLustreMetadataOperations(&response, settings.metadataTargets, attribution.dropped)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", queryNameMetadataOperations+bundleResponseSuffix, err)
+		}
+
+		attribution.metadataOperations = *metadataOperations
+	}
+
+	for _, read := range []bool{true, false} {
+
+		name := queryNameWriteThroughput
+		if read {
+			name = queryNameReadThroughput
+		}
+
+		response, ok := inputs.responses[name]
+		if !ok {
+			continue
+		}
+
+		throughput, err := parseLustreTotalBytes(&response, read, attribution.dropped)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name+bundleResponseSuffix, err)
+		}
+
+		if read {
+			attribution.readThroughput = *throughput
+		} else {
+			attribution.writeThroughput = *throughput
+		}
+	}
+
+	jobs, err := parseRunningJobs(inputs.runningJobs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", bundleRunningJobsFile, err)
+	}
+
+	return attribution.attribute(settings, jobs, users, groups)
+}
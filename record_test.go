@@ -0,0 +1,113 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordAndReplayBundle(t *testing.T) {
+
+	dir := t.TempDir()
+
+	recorder, err := newBundleRecorder(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go recorder.run()
+
+	start := time.Date(2023, 5, 2, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		recorder.handleInputs(&collectionInputs{
+			timestamp:   start.Add(time.Duration(i) * time.Minute),
+			runningJobs: []byte("1001 hpc alice\n"),
+			users:       []byte("alice:x:1001:100::/home/alice:/bin/sh\n"),
+			groups:      []byte("staff:x:100:\n"),
+			responses: map[string][]byte{
+				queryNameMetadataOperations: []byte(`{"status":"success","data":{"resultType":"vector","result":[
+					{"metric":{"jobid":"1001","target":"hebe-MDT0000"},"value":[1683028800,"30"]},
+					{"metric":{"jobid":"cp.1001","target":"hebe-MDT0000"},"value":[1683028800,"5"]}]}}`),
+				queryNameReadThroughput: []byte(`{"status":"success","data":{"resultType":"vector","result":[
+					{"metric":{"jobid":"1002"},"value":[1683028800,"100"]}]}}`),
+			},
+		})
+	}
+
+	if err := recorder.shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Inputs after the shutdown are ignored.
+	recorder.handleInputs(&collectionInputs{timestamp: start.Add(time.Hour)})
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 || entries[0].Name() != "20230502T120100.000Z" {
+		t.Fatalf("Expected the 2 latest bundles - got: %v", entries)
+	}
+
+	inputs, err := readBundle(filepath.Join(dir, entries[1].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !inputs.timestamp.Equal(start.Add(2*time.Minute)) || len(inputs.responses) != 2 {
+		t.Errorf("Unexpected bundle: %s with %d responses", inputs.timestamp, len(inputs.responses))
+	}
+
+	settings := &collectionSettings{metadataTargets: regexMetadataMDT, filters: &collectionFilters{}}
+
+	var output bytes.Buffer
+
+	if err := runReplay(settings, filepath.Join(dir, entries[1].Name()), &replayOptions{format: outputFormatText}, &output); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`cluster_job_metadata_operations{account="hpc",target="hebe-MDT0000",user="alice"} 30`,
+		`cluster_proc_metadata_operations{group_name="staff",proc_name="cp",target="hebe-MDT0000",user_name="alice"} 5`,
+		`cluster_unattributed_read_throughput_bytes 100`,
+		`cluster_exporter_dropped_volume{metric="read_throughput",reason="jobid_not_in_squeue"} 100`,
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(output.String(), line) {
+			t.Errorf("Expected line %s in replayed metrics:\n%s", line, output.String())
+		}
+	}
+
+	if _, err := replayBundle(settings, &collectionInputs{runningJobs: []byte{}, users: inputs.users, groups: inputs.groups}); err == nil {
+		t.Error("Expected error for bundle without Prometheus responses")
+	}
+
+	if _, err := replayBundle(settings, &collectionInputs{runningJobs: []byte("1001 hpc\n"), users: inputs.users, groups: inputs.groups, responses: inputs.responses}); err == nil {
+		t.Error("Expected error for squeue line with missing fields")
+	}
+
+	// A bundle recorded without running jobs attributes nothing to jobs.
+	metrics, err := replayBundle(settings, &collectionInputs{runningJobs: []byte{}, users: inputs.users, groups: inputs.groups, responses: inputs.responses})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(metrics.jobs) != 0 || len(metrics.procs) != 1 {
+		t.Errorf("Expected no jobs and 1 process - got: %d jobs and %d processes", len(metrics.jobs), len(metrics.procs))
+	}
+}
@@ -0,0 +1,417 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Maximum size of an error response of the remote write receiver, which is logged.
+const remoteWriteMaxResponseSize = 1 << 20
+
+// remoteWriteConfig holds the receiver URL with the authentication and transport
+// settings, the retries of a failed request and the capacity of the send queue.
+type remoteWriteConfig struct {
+	client        promClientConfig
+	timeout       int
+	retry         promRetryConfig
+	queueCapacity int
+}
+
+// remoteWriteRequest is a snappy compressed protobuf WriteRequest.
+type remoteWriteRequest struct {
+	body    []byte
+	samples int
+}
+
+type remoteWriteLabel struct {
+	name  string
+	value string
+}
+
+// remoteWriter pushes the snapshot of each collection with the Prometheus remote
+// write protocol. Requests are sent in order by a single sender. If the receiver
+// is unavailable longer than the queue capacity allows, the oldest request is dropped.
+type remoteWriter struct {
+	endpoint             *promEndpoint
+	retry                promRetryConfig
+	queue                chan *remoteWriteRequest
+	mutex                sync.Mutex
+	closed               bool
+	done                 chan struct{}
+	ctx                  context.Context
+	cancel               context.CancelFunc
+	sentSamplesMetric    prometheus.Counter
+	failedSamplesMetric  prometheus.Counter
+	droppedSamplesMetric prometheus.Counter
+	retriesMetric        prometheus.Counter
+	lastSendMetric       prometheus.Gauge
+	queueLengthMetric    prometheus.GaugeFunc
+}
+
+func newRemoteWriter(config remoteWriteConfig) (*remoteWriter, error) {
+
+	if config.timeout <= 0 {
+		return nil, errors.New("request timeout must be greater then 0")
+	}
+
+	if config.queueCapacity <= 0 {
+		return nil, errors.New("queue capacity must be greater then 0")
+	}
+
+	if config.retry.retries < 0 {
+		return nil, errors.New("retries must not be negative")
+	}
+
+	endpoint, err := newPromEndpoint(config.client, config.timeout, remoteWriteMaxResponseSize)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	w := &remoteWriter{
+		endpoint: endpoint,
+		retry:    config.retry,
+		queue:    make(chan *remoteWriteRequest, config.queueCapacity),
+		done:     make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+		sentSamplesMetric: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespaceInternals,
+			Name:      "remote_write_sent_samples_total",
+			Help:      "Total samples sent to the remote write receiver.",
+		}),
+		failedSamplesMetric: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespaceInternals,
+			Name:      "remote_write_failed_samples_total",
+			Help:      "Total samples, which failed to be sent to the remote write receiver after all retries.",
+		}),
+		droppedSamplesMetric: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespaceInternals,
+			Name:      "remote_write_dropped_samples_total",
+			Help:      "Total samples dropped, since the remote write queue was full.",
+		}),
+		retriesMetric: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespaceInternals,
+			Name:      "remote_write_retries_total",
+			Help:      "Total retried requests to the remote write receiver.",
+		}),
+		lastSendMetric: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespaceInternals,
+			Name:      "remote_write_last_send_timestamp_seconds",
+			Help:      "Timestamp of the last successful request to the remote write receiver.",
+		}),
+	}
+
+	w.queueLengthMetric = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespaceInternals,
+		Name:      "remote_write_queue_length",
+		Help:      "Count of requests waiting in the remote write queue.",
+	}, func() float64 { return float64(len(w.queue)) })
+
+	return w, nil
+}
+
+// handleSnapshot encodes and enqueues the metrics of a snapshot.
+func (w *remoteWriter) handleSnapshot(current *snapshot) {
+
+	families, err := current.metricFamilies()
+	if err != nil {
+		log.Error("Failed to gather metrics for remote write: ", err)
+		return
+	}
+
+	request, err := newRemoteWriteRequest(families, current.timestamp)
+	if err != nil {
+		log.Error("Failed to encode remote write request: ", err)
+		return
+	}
+
+	w.enqueue(request)
+}
+
+func (w *remoteWriter) enqueue(request *remoteWriteRequest) {
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		w.droppedSamplesMetric.Add(float64(request.samples))
+		return
+	}
+
+	for {
+		select {
+		case w.queue <- request:
+			return
+		default:
+		}
+
+		select {
+		case oldest := <-w.queue:
+			w.droppedSamplesMetric.Add(float64(oldest.samples))
+			log.Warning("Remote write queue is full - Dropping oldest request with ", oldest.samples, " samples")
+		default:
+		}
+	}
+}
+
+// run sends the queued requests until the remote writer is shut down.
+func (w *remoteWriter) run() {
+
+	defer close(w.done)
+
+	for request := range w.queue {
+
+		if err := w.send(request); err != nil {
+			w.failedSamplesMetric.Add(float64(request.samples))
+			log.Error("Failed to send ", request.samples, " samples to remote write receiver: ", err)
+			continue
+		}
+
+		w.sentSamplesMetric.Add(float64(request.samples))
+		w.lastSendMetric.SetToCurrentTime()
+	}
+}
+
+// send posts the request and retries it with backoff on recoverable errors.
+func (w *remoteWriter) send(request *remoteWriteRequest) error {
+
+	var err error
+
+	for attempt := 0; attempt <= w.retry.retries; attempt++ {
+
+		if attempt > 0 {
+
+			backoff := retryBackoff(w.retry, attempt-1)
+			log.Debugf("Retrying remote write request in %s (attempt %d of %d)", backoff, attempt, w.retry.retries)
+
+			select {
+			case <-time.After(backoff):
+			case <-w.ctx.Done():
+				return err
+			}
+
+			w.retriesMetric.Inc()
+		}
+
+		err = w.post(request.body)
+
+		if !isEndpointFailure(err) && !isTooManyRequests(err) {
+			return err
+		}
+
+		log.Warning("Remote write request failed: ", err)
+	}
+
+	return err
+}
+
+func (w *remoteWriter) post(body []byte) error {
+
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, w.endpoint.config.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "prometheus-cluster-exporter/"+version)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	if err := w.endpoint.authorize(req); err != nil {
+		return err
+	}
+
+	res, err := w.endpoint.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	content, err := ioutil.ReadAll(io.LimitReader(res.Body, w.endpoint.maxResponseSize))
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return newHTTPStatusError(res.StatusCode, content)
+	}
+
+	return nil
+}
+
+func isTooManyRequests(err error) bool {
+	var statusErr *httpStatusError
+	return errors.As(err, &statusErr) && statusErr.statusCode == http.StatusTooManyRequests
+}
+
+// shutdown stops accepting requests and waits until the queued requests are sent.
+// If the context is done before, the pending request is cancelled.
+func (w *remoteWriter) shutdown(ctx context.Context) error {
+
+	w.mutex.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mutex.Unlock()
+
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		w.cancel()
+		return ctx.Err()
+	}
+}
+
+func (w *remoteWriter) Describe(ch chan<- *prometheus.Desc) {
+	w.sentSamplesMetric.Describe(ch)
+	w.failedSamplesMetric.Describe(ch)
+	w.droppedSamplesMetric.Describe(ch)
+	w.retriesMetric.Describe(ch)
+	w.lastSendMetric.Describe(ch)
+	w.queueLengthMetric.Describe(ch)
+}
+
+func (w *remoteWriter) Collect(ch chan<- prometheus.Metric) {
+	w.sentSamplesMetric.Collect(ch)
+	w.failedSamplesMetric.Collect(ch)
+	w.droppedSamplesMetric.Collect(ch)
+	w.retriesMetric.Collect(ch)
+	w.lastSendMetric.Collect(ch)
+	w.queueLengthMetric.Collect(ch)
+}
+
+// newRemoteWriteRequest encodes the metric families as snappy compressed
+// protobuf WriteRequest with all samples at the given timestamp.
+// Histograms and summaries are written as their classic series.
+func newRemoteWriteRequest(families []*dto.MetricFamily, timestamp time.Time) (*remoteWriteRequest, error) {
+
+	var buf []byte
+
+	samples := 0
+	milliseconds := timestamp.UnixNano() / int64(time.Millisecond)
+
+	appendSample := func(name string, metric *dto.Metric, value float64, extra ...remoteWriteLabel) {
+
+		labels := make([]remoteWriteLabel, 0, len(metric.Label)+len(extra)+1)
+		labels = append(labels, remoteWriteLabel{"__name__", name})
+
+		for _, pair := range metric.Label {
+			labels = append(labels, remoteWriteLabel{pair.GetName(), pair.GetValue()})
+		}
+
+		labels = append(labels, extra...)
+
+		buf = appendTimeSeries(buf, labels, value, milliseconds)
+		samples++
+	}
+
+	for _, family := range families {
+
+		name := family.GetName()
+
+		for _, metric := range family.Metric {
+
+			switch family.GetType() {
+
+			case dto.MetricType_COUNTER:
+				appendSample(name, metric, metric.GetCounter().GetValue())
+
+			case dto.MetricType_GAUGE:
+				appendSample(name, metric, metric.GetGauge().GetValue())
+
+			case dto.MetricType_UNTYPED:
+				appendSample(name, metric, metric.GetUntyped().GetValue())
+
+			case dto.MetricType_SUMMARY:
+				summary := metric.GetSummary()
+				for _, quantile := range summary.Quantile {
+					appendSample(name, metric, quantile.GetValue(),
+						remoteWriteLabel{"quantile", formatFloat(quantile.GetQuantile())})
+				}
+				appendSample(name+"_sum", metric, summary.GetSampleSum())
+				appendSample(name+"_count", metric, float64(summary.GetSampleCount()))
+
+			case dto.MetricType_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				for _, bucket := range histogram.Bucket {
+					appendSample(name+"_bucket", metric, float64(bucket.GetCumulativeCount()),
+						remoteWriteLabel{"le", formatFloat(bucket.GetUpperBound())})
+				}
+				appendSample(name+"_bucket", metric, float64(histogram.GetSampleCount()),
+					remoteWriteLabel{"le", "+Inf"})
+				appendSample(name+"_sum", metric, histogram.GetSampleSum())
+				appendSample(name+"_count", metric, float64(histogram.GetSampleCount()))
+
+			default:
+				return nil, fmt.Errorf("unsupported type of metric family %s: %s", name, family.GetType())
+			}
+		}
+	}
+
+	return &remoteWriteRequest{body: snappy.Encode(nil, buf), samples: samples}, nil
+}
+
+// appendTimeSeries appends a TimeSeries with a single sample to a WriteRequest.
+// The labels are sorted by name as required by the remote write protocol.
+func appendTimeSeries(buf []byte, labels []remoteWriteLabel, value float64, timestamp int64) []byte {
+
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+
+	var series []byte
+
+	for _, label := range labels {
+		var pair []byte
+		pair = protowire.AppendTag(pair, 1, protowire.BytesType)
+		pair = protowire.AppendString(pair, label.name)
+		pair = protowire.AppendTag(pair, 2, protowire.BytesType)
+		pair = protowire.AppendString(pair, label.value)
+
+		series = protowire.AppendTag(series, 1, protowire.BytesType)
+		series = protowire.AppendBytes(series, pair)
+	}
+
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(timestamp))
+
+	series = protowire.AppendTag(series, 2, protowire.BytesType)
+	series = protowire.AppendBytes(series, sample)
+
+	buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+	return protowire.AppendBytes(buf, series)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
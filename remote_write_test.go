@@ -0,0 +1,222 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodeWriteRequest decodes a snappy compressed WriteRequest into
+// a map of the series in text format to the sample value.
+func decodeWriteRequest(t *testing.T, body []byte) map[string]float64 {
+
+	buf, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := make(map[string]float64)
+
+	forEachField := func(buf []byte, fn func(number protowire.Number, value []byte, fixed uint64)) {
+		for len(buf) > 0 {
+			number, wireType, n := protowire.ConsumeTag(buf)
+			if n < 0 {
+				t.Fatal(protowire.ParseError(n))
+			}
+			buf = buf[n:]
+			switch wireType {
+			case protowire.BytesType:
+				value, n := protowire.ConsumeBytes(buf)
+				fn(number, value, 0)
+				buf = buf[n:]
+			case protowire.Fixed64Type:
+				value, n := protowire.ConsumeFixed64(buf)
+				fn(number, nil, value)
+				buf = buf[n:]
+			case protowire.VarintType:
+				value, n := protowire.ConsumeVarint(buf)
+				fn(number, nil, value)
+				buf = buf[n:]
+			default:
+				t.Fatalf("Unexpected wire type: %d", wireType)
+			}
+		}
+	}
+
+	forEachField(buf, func(_ protowire.Number, series []byte, _ uint64) {
+
+		var name string
+		var labels []string
+		var value float64
+
+		forEachField(series, func(number protowire.Number, field []byte, _ uint64) {
+			if number == 1 {
+				var pair [2]string
+				forEachField(field, func(number protowire.Number, value []byte, _ uint64) {
+					pair[number-1] = string(value)
+				})
+				if pair[0] == "__name__" {
+					name = pair[1]
+				} else {
+					labels = append(labels, pair[0]+"=\""+pair[1]+"\"")
+				}
+			} else {
+				forEachField(field, func(number protowire.Number, _ []byte, fixed uint64) {
+					if number == 1 {
+						value = math.Float64frombits(fixed)
+					}
+				})
+			}
+		})
+
+		sort.Strings(labels)
+		result[name+"{"+strings.Join(labels, ",")+"}"] = value
+	})
+
+	return result
+}
+
+func newTestSnapshot() *snapshot {
+
+	metrics := newCollectionMetrics(nil)
+	metrics.jobReadThroughputMetric.WithLabelValues("hpc", "alice").Set(1024)
+	metrics.jobMetadataOperationsMetric.WithLabelValues("hpc", "alice", "hebe-MDT0000").Set(42)
+
+	return &snapshot{timestamp: time.Now(), scrapeOK: true, metrics: metrics.gather()}
+}
+
+func TestRemoteWrite(t *testing.T) {
+
+	var mutex sync.Mutex
+	var requests int
+	var series map[string]float64
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		requests++
+
+		// The first request fails to test the retry.
+		if requests == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "invalid headers", http.StatusBadRequest)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		series = decodeWriteRequest(t, body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	writer, err := newRemoteWriter(remoteWriteConfig{
+		client: promClientConfig{
+			url:     server.URL,
+			headers: map[string]string{"Authorization": "Bearer token"},
+		},
+		timeout:       1,
+		retry:         promRetryConfig{retries: 1, backoff: time.Millisecond, maxBackoff: time.Millisecond},
+		queueCapacity: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go writer.run()
+
+	writer.handleSnapshot(newTestSnapshot())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := writer.shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]float64{
+		`cluster_job_read_throughput_bytes{account="hpc",user="alice"}`:                     1024,
+		`cluster_job_metadata_operations{account="hpc",target="hebe-MDT0000",user="alice"}`: 42,
+	}
+
+	for name, value := range expected {
+		if got, ok := series[name]; !ok || got != value {
+			t.Errorf("Expected series %s with value %f - got: %f", name, value, got)
+		}
+	}
+
+	if got := testutil.ToFloat64(writer.retriesMetric); got != 1 {
+		t.Errorf("Expected 1 retry - got: %f", got)
+	}
+	if got := testutil.ToFloat64(writer.sentSamplesMetric); got != 2 {
+		t.Errorf("Expected 2 sent samples - got: %f", got)
+	}
+}
+
+func TestRemoteWriteQueue(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	writer, err := newRemoteWriter(remoteWriteConfig{
+		client:        promClientConfig{url: server.URL},
+		timeout:       1,
+		retry:         promRetryConfig{retries: 3, backoff: time.Millisecond, maxBackoff: time.Millisecond},
+		queueCapacity: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The sender is not running yet, so the first request is dropped.
+	writer.handleSnapshot(newTestSnapshot())
+	writer.handleSnapshot(newTestSnapshot())
+
+	if got := testutil.ToFloat64(writer.droppedSamplesMetric); got != 2 {
+		t.Errorf("Expected 2 dropped samples - got: %f", got)
+	}
+
+	go writer.run()
+
+	if err := writer.shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Client errors are not retried.
+	if got := testutil.ToFloat64(writer.retriesMetric); got != 0 {
+		t.Errorf("Expected no retries - got: %f", got)
+	}
+	if got := testutil.ToFloat64(writer.failedSamplesMetric); got != 2 {
+		t.Errorf("Expected 2 failed samples - got: %f", got)
+	}
+}
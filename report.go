@@ -0,0 +1,477 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+	log "github.com/sirupsen/logrus"
+)
+
+const commandReport = "report"
+
+// Supported formats of the usage report.
+const (
+	reportFormatCSV  = "csv"
+	reportFormatJSON = outputFormatJSON
+)
+
+// PromQL range queries of the usage report - __TIME_RANGE__ is replaced by the step,
+// so the rates of the steps cover the period.
+const (
+	queryReportMetadataOperations = "sum by(target,jobid)(rate(lustre_job_stats_total[__TIME_RANGE__]))"
+	queryReportReadBytes          = "sum by(jobid)(rate(lustre_job_read_bytes_total[__TIME_RANGE__]))"
+	queryReportWriteBytes         = "sum by(jobid)(rate(lustre_job_write_bytes_total[__TIME_RANGE__]))"
+)
+
+const (
+	defaultReportStep  = 5 * time.Minute
+	defaultReportChunk = 24 * time.Hour
+)
+
+// Layouts of the start and end of the report period in the local time.
+var reportTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"}
+
+type reportOptions struct {
+	start         string
+	end           string
+	step          time.Duration
+	chunk         time.Duration
+	format        string
+	metadataQuery string
+	readQuery     string
+	writeQuery    string
+}
+
+// usageReport is the Lustre IO of the Slurm jobs per account and user in a period.
+// The totals are integrated from the rates of the steps, so they are approximate.
+type usageReport struct {
+	Start        time.Time      `json:"start"`
+	End          time.Time      `json:"end"`
+	StepSeconds  float64        `json:"step_seconds"`
+	Accounts     []accountUsage `json:"accounts"`
+	Unattributed ioUsage        `json:"unattributed"`
+}
+
+type accountUsage struct {
+	Account string `json:"account"`
+	ioUsage
+	Users []userUsage `json:"users"`
+}
+
+type userUsage struct {
+	User string `json:"user"`
+	ioUsage
+}
+
+type ioUsage struct {
+	Jobs               int                `json:"jobs"`
+	ReadBytes          float64            `json:"read_bytes"`
+	WriteBytes         float64            `json:"write_bytes"`
+	MetadataOperations float64            `json:"metadata_operations"`
+	TargetOperations   map[string]float64 `json:"metadata_operations_per_target"`
+}
+
+func newReportFlags(flags *flag.FlagSet) *reportOptions {
+
+	options := &reportOptions{}
+
+	flags.StringVar(&options.start, "report.start", "", "[REQUIRED] Start of the report period in local time e.g. 2023-05-01 or 2023-05-01T08:00:00")
+	flags.StringVar(&options.end, "report.end", "", "End of the report period in local time e.g. 2023-06-01 - Now if empty")
+	flags.DurationVar(&options.step, "report.step", defaultReportStep, "Step of the range queries, which is increased for long chunks to stay below the maximum points of a query")
+	flags.DurationVar(&options.chunk, "report.chunk", defaultReportChunk, "Length of the parts of the period, which are queried and attributed one after another to limit the response size")
+	flags.StringVar(&options.format, "report.format", reportFormatCSV, "Output format of the report - csv or json")
+	flags.StringVar(&options.metadataQuery, "report.metadata-query", queryReportMetadataOperations, "PromQL range query of the metadata operations per target and jobid - __TIME_RANGE__ is replaced by the step")
+	flags.StringVar(&options.readQuery, "report.read-query", queryReportReadBytes, "PromQL range query of the read throughput per jobid in bytes per second")
+	flags.StringVar(&options.writeQuery, "report.write-query", queryReportWriteBytes, "PromQL range query of the write throughput per jobid in bytes per second")
+
+	return options
+}
+
+// runReport writes the usage report of the period. The jobs of the period
+// are retrieved from sacct.
+func runReport(settings *collectionSettings, options *reportOptions, output io.Writer) error {
+
+	source, ok := settings.source.(*promSource)
+	if !ok {
+		return fmt.Errorf("%s requires the %s source", commandReport, sourcePrometheus)
+	}
+
+	if options.format != reportFormatCSV && options.format != reportFormatJSON {
+		return fmt.Errorf("unsupported output format: %s - expected %s or %s", options.format, reportFormatCSV, reportFormatJSON)
+	}
+
+	start, end, err := parseReportPeriod(options.start, options.end, time.Now())
+	if err != nil {
+		return err
+	}
+
+	records, err := runSacct("--allusers",
+		"--starttime", start.In(time.Local).Format(sacctTimeFormat),
+		"--endtime", end.In(time.Local).Format(sacctTimeFormat))
+	if err != nil {
+		return err
+	}
+
+	users, groups, err := retrieveIdentityMaps(settings)
+	if err != nil {
+		return err
+	}
+
+	report, err := newUsageReport(source, settings, records, users, groups, start, end, options)
+	if err != nil {
+		return err
+	}
+
+	if options.format == reportFormatJSON {
+		encoder := json.NewEncoder(output)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+
+	return writeUsageReportCSV(output, report)
+}
+
+// parseReportPeriod parses the start and end of the period, whereby an empty end is now.
+func parseReportPeriod(start string, end string, now time.Time) (time.Time, time.Time, error) {
+
+	if start == "" {
+		return time.Time{}, time.Time{}, errors.New("start of the report period is not set")
+	}
+
+	startTime, err := parseReportTime(start)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid start: %w", err)
+	}
+
+	endTime := now
+
+	if end != "" {
+		if endTime, err = parseReportTime(end); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid end: %w", err)
+		}
+	}
+
+	if !endTime.After(startTime) {
+		return time.Time{}, time.Time{}, errors.New("end of the report period must be after its start")
+	}
+
+	return startTime, endTime, nil
+}
+
+func parseReportTime(value string) (time.Time, error) {
+
+	for _, layout := range reportTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("unsupported time: %s - expected e.g. 2023-05-01 or %s", value, time.RFC3339)
+}
+
+// retrieveIdentityMaps retrieves the user and group maps required by the attribution.
+func retrieveIdentityMaps(settings *collectionSettings) (userInfoMap, groupInfoMap, error) {
+
+	channelUserInfo := make(chan userInfoMapResult, 1)
+	channelGroupInfo := make(chan groupInfoMapResult, 1)
+
+	go createUserInfoMap(channelUserInfo, settings.users)
+	go createGroupInfoMap(channelGroupInfo, settings.groups)
+
+	userInfoResult := <-channelUserInfo
+	groupInfoResult := <-channelGroupInfo
+
+	if userInfoResult.err != nil {
+		return nil, nil, fmt.Errorf("retrieving user names failed: %w", userInfoResult.err)
+	}
+
+	if groupInfoResult.err != nil {
+		return nil, nil, fmt.Errorf("retrieving group names failed: %w", groupInfoResult.err)
+	}
+
+	return userInfoResult.users, groupInfoResult.groups, nil
+}
+
+// newUsageReport queries the period in chunks and attributes the totals of
+// each chunk to the jobs running in it like a collection of the exporter,
+// so the filters of the configuration are applied as well.
+func newUsageReport(source *promSource, settings *collectionSettings, records []jobRecord, users userInfoMap, groups groupInfoMap,
+	start time.Time, end time.Time, options *reportOptions) (*usageReport, error) {
+
+	if options.step <= 0 || options.chunk <= 0 {
+		return nil, errors.New("step and chunk must be greater than 0")
+	}
+
+	// Chunks are whole steps, so the rates of successive chunks do not overlap.
+	step := rangeQueryStep(start, start.Add(options.chunk), options.step)
+	chunk := options.chunk.Truncate(step)
+	if chunk < step {
+		chunk = step
+	}
+
+	timeRange := model.Duration(step).String()
+
+	usage := make(map[string]map[string]*ioUsage)
+	jobs := make(map[string]map[string]bool)
+	unattributed := newIOUsage()
+
+	for chunkStart := start; chunkStart.Before(end); chunkStart = chunkStart.Add(chunk) {
+
+		chunkEnd := chunkStart.Add(chunk)
+		if chunkEnd.After(end) {
+			chunkEnd = end
+		}
+
+		log.Debug("Report chunk ", chunkStart.Format(time.RFC3339), " - ", chunkEnd.Format(time.RFC3339))
+
+		first, last := rangeQueryBounds(chunkStart, chunkEnd, step)
+
+		// The last step must not cover the time after the period.
+		if last.After(end) {
+			last = last.Add(-step)
+		}
+
+		if last.Before(first) {
+			continue
+		}
+
+		metadataSeries, err := source.queryRange("report_metadata_operations", options.metadataQuery, timeRange, first, last, step)
+		if err != nil {
+			return nil, err
+		}
+
+		readSeries, err := source.queryRange("report_read_throughput", options.readQuery, timeRange, first, last, step)
+		if err != nil {
+			return nil, err
+		}
+
+		writeSeries, err := source.queryRange("report_write_throughput", options.writeQuery, timeRange, first, last, step)
+		if err != nil {
+			return nil, err
+		}
+
+		// The throughput of the attribution is the bytes of the chunk here.
+		inputs := newAttributionInputs()
+
+		for _, series := range metadataSeries {
+			total, _ := integrateSeries(series, step)
+			inputs.addMetadataOperations(series.labels, int64(math.Round(total)), source.metadataTargets)
+		}
+
+		for _, series := range readSeries {
+			total, _ := integrateSeries(series, step)
+			inputs.addThroughput(series.labels, total, true)
+		}
+
+		for _, series := range writeSeries {
+			total, _ := integrateSeries(series, step)
+			inputs.addThroughput(series.labels, total, false)
+		}
+
+		// The IO of a chunk must not be missing in the report.
+		metrics, err := inputs.attribute(settings, runningJobs(records, chunkStart, chunkEnd), users, groups)
+		if err != nil {
+			return nil, fmt.Errorf("attribution between %s and %s failed: %w", chunkStart.Format(time.RFC3339), chunkEnd.Format(time.RFC3339), err)
+		}
+
+		for _, job := range metrics.jobs {
+
+			if usage[job.account] == nil {
+				usage[job.account] = make(map[string]*ioUsage)
+				jobs[job.account] = make(map[string]bool)
+			}
+
+			user, ok := usage[job.account][job.user]
+			if !ok {
+				user = newIOUsage()
+				usage[job.account][job.user] = user
+			}
+
+			user.add(job.metadataOperations, job.readThroughput, job.writeThroughput)
+
+			if !jobs[job.account][job.jobid] {
+				jobs[job.account][job.jobid] = true
+				user.Jobs++
+			}
+		}
+
+		unattributed.ReadBytes += inputs.dropped.values[dropKey{droppedReadThroughput, dropReasonJobNotInSqueue}]
+		unattributed.WriteBytes += inputs.dropped.values[dropKey{droppedWriteThroughput, dropReasonJobNotInSqueue}]
+		unattributed.MetadataOperations += inputs.dropped.values[dropKey{droppedMetadataOperations, dropReasonJobNotInSqueue}]
+	}
+
+	report := &usageReport{
+		Start:        start,
+		End:          end,
+		StepSeconds:  step.Seconds(),
+		Accounts:     make([]accountUsage, 0, len(usage)),
+		Unattributed: *unattributed,
+	}
+
+	for accountName, users := range usage {
+
+		account := accountUsage{Account: accountName, ioUsage: *newIOUsage()}
+
+		for userName, user := range users {
+			account.add(user.TargetOperations, user.ReadBytes, user.WriteBytes)
+			account.Jobs += user.Jobs
+			account.Users = append(account.Users, userUsage{User: userName, ioUsage: *user})
+		}
+
+		sort.Slice(account.Users, func(i, j int) bool { return account.Users[i].User < account.Users[j].User })
+
+		report.Accounts = append(report.Accounts, account)
+	}
+
+	sort.Slice(report.Accounts, func(i, j int) bool { return report.Accounts[i].Account < report.Accounts[j].Account })
+
+	return report, nil
+}
+
+// attributionInputs are the Lustre job metrics of a collection, which are
+// attributed to the jobs by the build functions of the exporter.
+type attributionInputs struct {
+	metadataOperations []metadataInfo
+	readThroughput     []throughputInfo
+	writeThroughput    []throughputInfo
+	dropped            *droppedEntries
+}
+
+func newAttributionInputs() *attributionInputs {
+	return &attributionInputs{
+		metadataOperations: make([]metadataInfo, 0),
+		readThroughput:     make([]throughputInfo, 0),
+		writeThroughput:    make([]throughputInfo, 0),
+		dropped:            newDroppedEntries(),
+	}
+}
+
+// addMetadataOperations adds the operations of the series labels like
+// parseLustreMetadataOperations does for an instant query.
+func (a *attributionInputs) addMetadataOperations(labels map[string]string, operations int64, metadataTargets *regexp.Regexp) {
+
+	jobid, target := labels["jobid"], labels["target"]
+
+	switch {
+	case operations == 0:
+	case jobid == "":
+		a.dropped.add(droppedMetadataOperations, dropReasonMissingJobID, float64(operations), jobid)
+	case !metadataTargets.MatchString(target):
+		a.dropped.add(droppedMetadataOperations, dropReasonNonMDTTarget, float64(operations), jobid)
+	default:
+		a.metadataOperations = append(a.metadataOperations, metadataInfo{jobid, target, operations})
+	}
+}
+
+// addThroughput adds the throughput of the series labels like
+// parseLustreTotalBytes does for an instant query.
+func (a *attributionInputs) addThroughput(labels map[string]string, throughput float64, read bool) {
+
+	jobid := labels["jobid"]
+
+	switch {
+	case throughput == 0:
+	case jobid == "":
+		a.dropped.add(droppedThroughputMetric(read), dropReasonMissingJobID, throughput, jobid)
+	case read:
+		a.readThroughput = append(a.readThroughput, throughputInfo{jobid, throughput})
+	default:
+		a.writeThroughput = append(a.writeThroughput, throughputInfo{jobid, throughput})
+	}
+}
+
+// attribute runs the build functions of a collection on the inputs.
+func (a *attributionInputs) attribute(settings *collectionSettings, jobs []jobInfo, users userInfoMap, groups groupInfoMap) (*collectionMetrics, error) {
+
+	metrics := newCollectionMetrics(settings.externalLabels)
+
+	if err := metrics.buildLustreMetadataMetrics(&a.metadataOperations, jobs, users, groups, settings.filters, a.dropped); err != nil {
+		return nil, err
+	}
+
+	if err := metrics.buildLustreThroughputMetrics(&a.readThroughput, jobs, users, groups, settings.filters, a.dropped, true); err != nil {
+		return nil, err
+	}
+
+	if err := metrics.buildLustreThroughputMetrics(&a.writeThroughput, jobs, users, groups, settings.filters, a.dropped, false); err != nil {
+		return nil, err
+	}
+
+	for _, key := range a.dropped.keys() {
+		metrics.droppedVolumeMetric.WithLabelValues(key.metric, key.reason).Set(a.dropped.values[key])
+	}
+
+	return metrics, nil
+}
+
+// runningJobs returns the jobs of the records running between start and end,
+// whereby a job starting at the end is included for a single point in time.
+func runningJobs(records []jobRecord, start time.Time, end time.Time) []jobInfo {
+
+	jobs := make([]jobInfo, 0)
+
+	for _, record := range records {
+		if !record.start.After(end) && record.end.After(start) {
+			jobs = append(jobs, record.jobInfo)
+		}
+	}
+
+	return jobs
+}
+
+func newIOUsage() *ioUsage {
+	return &ioUsage{TargetOperations: make(map[string]float64)}
+}
+
+func (u *ioUsage) add(metadataOperations map[string]float64, readBytes float64, writeBytes float64) {
+
+	for target, value := range metadataOperations {
+		u.TargetOperations[target] += value
+		u.MetadataOperations += value
+	}
+
+	u.ReadBytes += readBytes
+	u.WriteBytes += writeBytes
+}
+
+// writeUsageReportCSV writes a row per account and user.
+func writeUsageReportCSV(output io.Writer, report *usageReport) error {
+
+	writer := csv.NewWriter(output)
+
+	writer.Write([]string{"start", "end", "account", "user", "jobs", "read_bytes", "write_bytes", "metadata_operations"})
+
+	start, end := report.Start.Format(time.RFC3339), report.End.Format(time.RFC3339)
+
+	for _, account := range report.Accounts {
+		for _, user := range account.Users {
+			writer.Write([]string{start, end, account.Account, user.User,
+				strconv.Itoa(user.Jobs),
+				strconv.FormatFloat(user.ReadBytes, 'f', 0, 64),
+				strconv.FormatFloat(user.WriteBytes, 'f', 0, 64),
+				strconv.FormatFloat(user.MetadataOperations, 'f', 0, 64)})
+		}
+	}
+
+	writer.Flush()
+
+	return writer.Error()
+}
@@ -0,0 +1,167 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewUsageReport(t *testing.T) {
+
+	start := time.Unix(1700000000, 0)
+
+	// The series of each query and chunk with a constant rate over the chunk.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		query := r.URL.Query().Get("query")
+		first, _ := strconv.ParseInt(r.URL.Query().Get("start"), 10, 64)
+		last, _ := strconv.ParseInt(r.URL.Query().Get("end"), 10, 64)
+		firstChunk := first <= start.Add(time.Hour).Unix()
+
+		if last > start.Add(2*time.Hour).Unix() {
+			t.Errorf("Expected range query within the period - got end: %d", last)
+		}
+
+		values := func(value string) string {
+			samples := make([]string, 0)
+			for timestamp := first; timestamp <= last; timestamp += 60 {
+				samples = append(samples, fmt.Sprintf(`[%d,"%s"]`, timestamp, value))
+			}
+			return strings.Join(samples, ",")
+		}
+
+		series := make([]string, 0)
+
+		switch {
+		case strings.Contains(query, "lustre_job_stats_total") && firstChunk:
+			series = append(series,
+				`{"metric":{"jobid":"1001","target":"hebe-MDT0000"},"values":[`+values("10")+`]}`,
+				`{"metric":{"jobid":"9999","target":"hebe-MDT0000"},"values":[`+values("1")+`]}`,
+				`{"metric":{"jobid":"1001","target":"hebe-OST0000"},"values":[`+values("10")+`]}`)
+		case strings.Contains(query, "lustre_job_read_bytes_total"):
+			series = append(series, `{"metric":{"jobid":"1002"},"values":[`+values("100")+`]}`)
+		case strings.Contains(query, "lustre_job_write_bytes_total") && !firstChunk:
+			series = append(series, `{"metric":{"jobid":"1003"},"values":[`+values("50")+`]}`)
+		}
+
+		w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[` + strings.Join(series, ",") + `]}}`))
+	}))
+	defer server.Close()
+
+	client, err := newPromClient([]promClientConfig{{url: server.URL}}, 5, 64*testMaxResponseSize, promRetryConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := newPromSource(client, nil, promQueryOptions{}, regexMetadataMDT)
+	settings := &collectionSettings{source: source, filters: &collectionFilters{}}
+
+	// The IO of the array job 1000_3 is recorded under its raw jobid 1003.
+	sacct := func(offset time.Duration) string { return start.Add(offset).Format(sacctTimeFormat) }
+
+	records, err := parseSacctRecords([]byte(
+		"1001|1001|hpc|alice|"+sacct(0)+"|"+sacct(30*time.Minute)+"|COMPLETED\n"+
+			"1002|1002|hpc|bob|"+sacct(30*time.Minute)+"|"+sacct(2*time.Hour)+"|COMPLETED\n"+
+			"1000_3|1003|phys|carol|"+sacct(90*time.Minute)+"|Unknown|RUNNING\n"), start.Add(3*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := userInfoMap{1001: userInfo{user: "alice", uid: 1001, gid: 100}}
+	groups := groupInfoMap{100: groupInfo{group: "staff", gid: 100}}
+
+	options := &reportOptions{
+		step:          time.Minute,
+		chunk:         time.Hour,
+		metadataQuery: queryReportMetadataOperations,
+		readQuery:     queryReportReadBytes,
+		writeQuery:    queryReportWriteBytes,
+	}
+
+	// The last partial step of the period is not queried.
+	report, err := newUsageReport(source, settings, records, users, groups, start, start.Add(2*time.Hour+30*time.Second), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Accounts) != 2 || report.Accounts[0].Account != "hpc" || report.Accounts[1].Account != "phys" {
+		t.Fatalf("Expected accounts hpc and phys - got: %+v", report.Accounts)
+	}
+
+	hpc := report.Accounts[0]
+
+	if hpc.Jobs != 2 || hpc.MetadataOperations != 36000 || hpc.ReadBytes != 720000 || hpc.WriteBytes != 0 {
+		t.Errorf("Unexpected usage of account hpc: %+v", hpc.ioUsage)
+	}
+
+	if len(hpc.Users) != 2 || hpc.Users[0].User != "alice" || hpc.Users[1].User != "bob" || hpc.Users[1].ReadBytes != 720000 {
+		t.Errorf("Unexpected users of account hpc: %+v", hpc.Users)
+	}
+
+	if phys := report.Accounts[1]; phys.WriteBytes != 180000 || phys.Users[0].User != "carol" {
+		t.Errorf("Unexpected usage of account phys: %+v", phys)
+	}
+
+	if report.Unattributed.MetadataOperations != 3600 {
+		t.Errorf("Expected 3600 unattributed metadata operations - got: %f", report.Unattributed.MetadataOperations)
+	}
+
+	// Without running jobs the IO is unattributed instead of missing.
+	idle, err := newUsageReport(source, settings, []jobRecord{}, users, groups, start, start.Add(time.Hour), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(idle.Accounts) != 0 || idle.Unattributed.MetadataOperations != 39600 || idle.Unattributed.ReadBytes != 360000 {
+		t.Errorf("Expected the IO of the chunk without jobs to be unattributed - got: %+v", idle.Unattributed)
+	}
+
+	var output bytes.Buffer
+
+	if err := writeUsageReportCSV(&output, report); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+
+	if len(lines) != 4 || !strings.HasSuffix(lines[2], ",hpc,bob,1,720000,0,0") {
+		t.Errorf("Unexpected CSV report:\n%s", output.String())
+	}
+}
+
+func TestParseReportPeriod(t *testing.T) {
+
+	now := time.Date(2023, 6, 15, 12, 0, 0, 0, time.Local)
+
+	start, end, err := parseReportPeriod("2023-05-01", "2023-06-01T00:00:00", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !start.Equal(time.Date(2023, 5, 1, 0, 0, 0, 0, time.Local)) || !end.Equal(time.Date(2023, 6, 1, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("Unexpected period: %s - %s", start, end)
+	}
+
+	if _, end, _ = parseReportPeriod("2023-06-01", "", now); !end.Equal(now) {
+		t.Errorf("Expected end now - got: %s", end)
+	}
+
+	for _, period := range [][2]string{{"", ""}, {"May", ""}, {"2023-06-01", "2023-05-01"}} {
+		if _, _, err := parseReportPeriod(period[0], period[1], now); err == nil {
+			t.Errorf("Expected error for period %v", period)
+		}
+	}
+}
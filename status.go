@@ -0,0 +1,132 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var statusTemplate = template.Must(template.New("status").Parse(`<html>
+<head><title>Cluster Exporter</title></head>
+<body>
+<h1>Cluster Exporter</h1>
+<p><a href='{{.MetricsPath}}'>Metrics</a> - <a href='/-/healthy'>Healthy</a> - <a href='/-/ready'>Ready</a></p>
+<h2>Status</h2>
+<table>
+<tr><td>Version</td><td>{{.Version}}</td></tr>
+<tr><td>Source</td><td>{{.Source}}</td></tr>
+<tr><td>Ready</td><td>{{.Ready}}</td></tr>
+<tr><td>Last collection</td><td>{{.LastCollection}}</td></tr>
+<tr><td>Last successful collection</td><td>{{.LastSuccess}}</td></tr>
+</table>
+{{if .Stages}}
+<h2>Stages of the last collection</h2>
+<table>
+<tr><th>Stage</th><th>Duration</th><th>Error</th></tr>
+{{range .Stages}}<tr><td>{{.Name}}</td><td>{{.Duration}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
+
+type statusPage struct {
+	MetricsPath    string
+	Version        string
+	Source         string
+	Ready          string
+	LastCollection string
+	LastSuccess    string
+	Stages         []statusPageStage
+}
+
+type statusPageStage struct {
+	Name     string
+	Duration string
+	Error    string
+}
+
+// healthyHandler reports the exporter as healthy as long as it serves requests.
+func healthyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("Healthy\n"))
+}
+
+// newReadyHandler reports the exporter as ready once a successful collection
+// completed and the sources of the last collection were reachable.
+func newReadyHandler(e *exporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if err := e.ready(); err != nil {
+			http.Error(w, "Not ready: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Write([]byte("Ready\n"))
+	}
+}
+
+// newStatusHandler shows the time, stage durations and errors of the last collection.
+func newStatusHandler(e *exporter, metricsPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		page := statusPage{
+			MetricsPath:    metricsPath,
+			Version:        version,
+			Source:         e.currentSettings().sourceType,
+			Ready:          "yes",
+			LastCollection: "never",
+			LastSuccess:    "never",
+		}
+
+		if err := e.ready(); err != nil {
+			page.Ready = "no - " + err.Error()
+		}
+
+		if current, ok := e.snapshot.Load().(*snapshot); ok {
+
+			page.LastCollection = formatStatusTime(current.timestamp)
+
+			for _, stage := range current.stages {
+
+				pageStage := statusPageStage{
+					Name:     stage.name,
+					Duration: fmt.Sprintf("%.3fs", stage.elapsed),
+				}
+
+				if stage.err != nil {
+					pageStage.Error = stage.err.Error()
+				}
+
+				page.Stages = append(page.Stages, pageStage)
+			}
+		}
+
+		if lastSuccess, ok := e.lastSuccess.Load().(time.Time); ok {
+			page.LastSuccess = formatStatusTime(lastSuccess)
+		}
+
+		if err := statusTemplate.Execute(w, page); err != nil {
+			log.Error("Failed to render status page: ", err)
+		}
+	}
+}
+
+func formatStatusTime(t time.Time) string {
+	return t.Format(time.RFC3339) + " (" + time.Since(t).Truncate(time.Second).String() + " ago)"
+}
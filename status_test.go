@@ -0,0 +1,112 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadyHandler(t *testing.T) {
+
+	e := newExporter(newTestSettings(), time.Minute, 5*time.Minute, time.Minute)
+	handler := newReadyHandler(e)
+
+	ready := func() int {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodGet, "/-/ready", nil))
+		return recorder.Code
+	}
+
+	if got := ready(); got != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 before the first collection - got: %d", got)
+	}
+
+	e.storeSnapshot(&snapshot{timestamp: time.Now(), scrapeOK: true})
+
+	if got := ready(); got != http.StatusOK {
+		t.Errorf("Expected status 200 after a successful collection - got: %d", got)
+	}
+
+	e.storeSnapshot(&snapshot{
+		timestamp: time.Now(),
+		stages:    []stageStatus{{"retrieve_running_jobs", 0.1, errors.New("squeue failed")}},
+	})
+
+	if got := ready(); got != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 after a failed collection - got: %d", got)
+	}
+}
+
+func TestStatusPage(t *testing.T) {
+
+	e := newExporter(newTestSettings(), 0, 0, time.Minute)
+
+	e.storeSnapshot(&snapshot{timestamp: time.Now().Add(-time.Minute), scrapeOK: true})
+	e.storeSnapshot(&snapshot{
+		timestamp: time.Now(),
+		stages: []stageStatus{
+			{"retrieve_running_jobs", 0.25, nil},
+			{"retrieve_user_name_info", 0.5, errors.New("getent <failed>")},
+		},
+	})
+
+	recorder := httptest.NewRecorder()
+	newStatusHandler(e, "/metrics")(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	body := recorder.Body.String()
+
+	for _, expected := range []string{"retrieve_running_jobs", "0.250s", "getent &lt;failed&gt;", "no - last collection failed in stages: retrieve_user_name_info"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected status page to contain '%s'", expected)
+		}
+	}
+
+	recorder = httptest.NewRecorder()
+	newStatusHandler(e, "/metrics")(recorder, httptest.NewRequest(http.MethodGet, "/unknown", nil))
+
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for unknown path - got: %d", recorder.Code)
+	}
+}
+
+func TestExporterShutdown(t *testing.T) {
+
+	e := newExporter(newTestSettings(), 0, 0, time.Minute)
+
+	// Simulates an in-flight collection.
+	if !e.beginCollection() {
+		t.Fatal("Expected collection to begin")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := e.shutdown(ctx); err == nil {
+		t.Error("Expected timeout while the collection is in-flight")
+	}
+
+	if e.beginCollection() {
+		t.Error("Expected no new collection after shutdown")
+	}
+	if got := e.collectSynchronous(); got != nil {
+		t.Error("Expected no synchronous collection after shutdown")
+	}
+
+	e.collections.Done()
+
+	if err := e.shutdown(context.Background()); err != nil {
+		t.Errorf("Unexpected error after the collection finished: %v", err)
+	}
+}
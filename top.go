@@ -0,0 +1,418 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+const commandTop = "top"
+
+// Columns the top view can be sorted by.
+const (
+	topSortMetadata = "metadata"
+	topSortRead     = "read"
+	topSortWrite    = "write"
+)
+
+// Consumers the top view can be grouped by.
+const (
+	topGroupJob     = "job"
+	topGroupUser    = "user"
+	topGroupAccount = "account"
+	topGroupProc    = "proc"
+)
+
+const (
+	defaultTopInterval = 5 * time.Second
+	defaultTopLimit    = 30
+)
+
+// ANSI escape sequence moving the cursor home and clearing the screen.
+const clearScreen = "\033[H\033[2J"
+
+var topHeaders = map[string][]string{
+	topGroupJob:     {"JOBID", "ACCOUNT", "USER"},
+	topGroupUser:    {"USER"},
+	topGroupAccount: {"ACCOUNT"},
+	topGroupProc:    {"PROC_NAME", "USER", "GROUP"},
+}
+
+// Single key commands of the top view, which are entered with Enter.
+var topCommands = map[string]func(*topView){
+	"m": func(v *topView) { v.sort = topSortMetadata },
+	"r": func(v *topView) { v.sort = topSortRead },
+	"w": func(v *topView) { v.sort = topSortWrite },
+	"j": func(v *topView) { v.group = topGroupJob },
+	"u": func(v *topView) { v.group = topGroupUser },
+	"a": func(v *topView) { v.group = topGroupAccount },
+	"p": func(v *topView) { v.group = topGroupProc },
+}
+
+type topOptions struct {
+	interval   time.Duration
+	sort       string
+	group      string
+	target     string
+	account    string
+	limit      int
+	iterations int
+}
+
+// topView renders the Lustre consumers of a collection as table.
+// The metadata operations are only counted on the targets matching the
+// target filter, which does not apply to the throughput. Process names have
+// no account, so they are hidden by the account filter.
+type topView struct {
+	sort     string
+	group    string
+	targets  *regexp.Regexp
+	accounts *regexp.Regexp
+	limit    int
+	message  string
+}
+
+type topRow struct {
+	labels             []string
+	metadataOperations float64
+	readThroughput     float64
+	writeThroughput    float64
+}
+
+// topTotals are the sums over all consumers shown in the view.
+type topTotals struct {
+	metadataOperations map[string]float64
+	readThroughput     float64
+	writeThroughput    float64
+}
+
+func newTopFlags(flags *flag.FlagSet) *topOptions {
+
+	options := &topOptions{}
+
+	flags.DurationVar(&options.interval, "top.interval", defaultTopInterval, "Interval of the collection refreshing the top view")
+	flags.StringVar(&options.sort, "top.sort", topSortMetadata, "Column the top view is sorted by - metadata, read or write")
+	flags.StringVar(&options.group, "top.group", topGroupJob, "Consumers shown in the top view - job, user, account or proc")
+	flags.StringVar(&options.target, "top.target", "", "Regular expression of the targets, on which the metadata operations are shown e.g. hebe-MDT000[01]")
+	flags.StringVar(&options.account, "top.account", "", "Regular expression of the accounts shown - Hides the process names")
+	flags.IntVar(&options.limit, "top.limit", defaultTopLimit, "Maximum count of rows shown - Unlimited if 0")
+	flags.IntVar(&options.iterations, "top.iterations", 0, "Count of collections shown, after which top exits - Runs until quit if 0")
+
+	return options
+}
+
+func newTopView(options *topOptions) (*topView, error) {
+
+	view := &topView{sort: options.sort, group: options.group, limit: options.limit}
+
+	switch options.sort {
+	case topSortMetadata, topSortRead, topSortWrite:
+	default:
+		return nil, fmt.Errorf("unsupported sort column: %s - expected %s, %s or %s", options.sort, topSortMetadata, topSortRead, topSortWrite)
+	}
+
+	if _, ok := topHeaders[options.group]; !ok {
+		return nil, fmt.Errorf("unsupported group: %s - expected %s, %s, %s or %s", options.group, topGroupJob, topGroupUser, topGroupAccount, topGroupProc)
+	}
+
+	if options.interval <= 0 {
+		return nil, errors.New("interval must be greater than 0")
+	}
+
+	if options.limit < 0 {
+		return nil, errors.New("limit must not be negative")
+	}
+
+	var err error
+
+	if options.target != "" {
+		if view.targets, err = compileAnchoredRegexp(options.target); err != nil {
+			return nil, fmt.Errorf("target filter: %w", err)
+		}
+	}
+
+	if options.account != "" {
+		if view.accounts, err = compileAnchoredRegexp(options.account); err != nil {
+			return nil, fmt.Errorf("account filter: %w", err)
+		}
+	}
+
+	return view, nil
+}
+
+// runTop collects on the interval and renders the view until it is quit,
+// the iterations are done or a signal is received. The commands are read
+// line by line from the input.
+func runTop(e *exporter, options *topOptions, input io.Reader, output io.Writer, clear bool) error {
+
+	view, err := newTopView(options)
+	if err != nil {
+		return err
+	}
+
+	commands := make(chan string)
+	go readTopCommands(input, commands)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+
+	ticker := time.NewTicker(options.interval)
+	defer ticker.Stop()
+
+	current := e.collect()
+	iteration := 1
+
+	for {
+		if clear {
+			io.WriteString(output, clearScreen)
+		}
+
+		if err := view.render(output, current); err != nil {
+			return err
+		}
+
+		if options.iterations > 0 && iteration >= options.iterations {
+			return nil
+		}
+
+		select {
+
+		case <-ticker.C:
+			current = e.collect()
+			iteration++
+
+		case command, ok := <-commands:
+			if !ok {
+				commands = nil
+				continue
+			}
+			if command == "q" {
+				return nil
+			}
+			view.apply(command)
+
+		case <-signals:
+			return nil
+		}
+	}
+}
+
+func readTopCommands(input io.Reader, commands chan<- string) {
+
+	defer close(commands)
+
+	scanner := bufio.NewScanner(input)
+
+	for scanner.Scan() {
+		commands <- strings.TrimSpace(scanner.Text())
+	}
+}
+
+// apply changes the sort column or group by the command.
+func (v *topView) apply(command string) {
+
+	v.message = ""
+
+	if change, ok := topCommands[command]; ok {
+		change(v)
+	} else if command != "" {
+		v.message = "Unknown command: " + command
+	}
+}
+
+func (v *topView) render(output io.Writer, current *snapshot) error {
+
+	rows, totals := v.rows(current)
+
+	writer := tabwriter.NewWriter(output, 0, 0, 2, ' ', tabwriter.AlignRight)
+
+	fmt.Fprintf(output, "Cluster Exporter top - %s - group: %s - sort: %s\n", current.timestamp.Format(time.RFC3339), v.group, v.sort)
+
+	if failed := current.failedStages(); len(failed) > 0 {
+		fmt.Fprintf(output, "Failed stages: %s\n", strings.Join(failed, ", "))
+	}
+
+	targets := make([]string, 0, len(totals.metadataOperations))
+	for target := range totals.metadataOperations {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	for _, target := range targets {
+		fmt.Fprintf(output, "%s: %s ops/s  ", target, formatOperations(totals.metadataOperations[target]))
+	}
+
+	fmt.Fprintf(output, "Read: %s/s  Write: %s/s\n\n", formatBytes(totals.readThroughput), formatBytes(totals.writeThroughput))
+
+	headers := append(append([]string{}, topHeaders[v.group]...), "META OPS/S", "READ/S", "WRITE/S")
+	fmt.Fprintln(writer, strings.Join(headers, "\t")+"\t")
+
+	for _, row := range rows {
+		fmt.Fprintln(writer, strings.Join(row.labels, "\t")+"\t"+
+			formatOperations(row.metadataOperations)+"\t"+
+			formatBytes(row.readThroughput)+"\t"+
+			formatBytes(row.writeThroughput)+"\t")
+	}
+
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	if v.message != "" {
+		fmt.Fprintf(output, "\n%s\n", v.message)
+	}
+
+	_, err := fmt.Fprintln(output, "\nEnter m, r or w to sort by metadata, read or write - j, u, a or p to group by job, user, account or proc - q to quit")
+
+	return err
+}
+
+// rows returns the sorted and limited rows of the group together with the totals.
+func (v *topView) rows(current *snapshot) ([]topRow, *topTotals) {
+
+	totals := &topTotals{metadataOperations: make(map[string]float64)}
+	grouped := make(map[string]*topRow)
+
+	add := func(labels []string, metadataOperations map[string]float64, read float64, write float64) {
+
+		operations := 0.0
+
+		// The throughput is not available per target, so the consumers
+		// without metadata operations on the targets are still shown.
+		for target, value := range metadataOperations {
+			if v.targets == nil || v.targets.MatchString(target) {
+				operations += value
+				totals.metadataOperations[target] += value
+			}
+		}
+
+		totals.readThroughput += read
+		totals.writeThroughput += write
+
+		key := strings.Join(labels, "\x00")
+
+		row, ok := grouped[key]
+		if !ok {
+			row = &topRow{labels: labels}
+			grouped[key] = row
+		}
+
+		row.metadataOperations += operations
+		row.readThroughput += read
+		row.writeThroughput += write
+	}
+
+	for _, job := range current.jobs {
+
+		if v.accounts != nil && !v.accounts.MatchString(job.account) {
+			continue
+		}
+
+		var labels []string
+
+		switch v.group {
+		case topGroupJob:
+			labels = []string{job.jobid, job.account, job.user}
+		case topGroupUser:
+			labels = []string{job.user}
+		case topGroupAccount:
+			labels = []string{job.account}
+		default:
+			continue
+		}
+
+		add(labels, job.metadataOperations, job.readThroughput, job.writeThroughput)
+	}
+
+	if v.accounts == nil {
+		for _, proc := range current.procs {
+
+			var labels []string
+
+			switch v.group {
+			case topGroupUser:
+				labels = []string{proc.userName}
+			case topGroupProc:
+				labels = []string{proc.procName, proc.userName, proc.groupName}
+			default:
+				continue
+			}
+
+			add(labels, proc.metadataOperations, proc.readThroughput, proc.writeThroughput)
+		}
+	}
+
+	rows := make([]topRow, 0, len(grouped))
+	for _, row := range grouped {
+		rows = append(rows, *row)
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		if a, b := v.sortValue(&rows[i]), v.sortValue(&rows[j]); a != b {
+			return a > b
+		}
+		return strings.Join(rows[i].labels, " ") < strings.Join(rows[j].labels, " ")
+	})
+
+	if v.limit > 0 && len(rows) > v.limit {
+		rows = rows[:v.limit]
+	}
+
+	return rows, totals
+}
+
+func (v *topView) sortValue(row *topRow) float64 {
+	switch v.sort {
+	case topSortRead:
+		return row.readThroughput
+	case topSortWrite:
+		return row.writeThroughput
+	default:
+		return row.metadataOperations
+	}
+}
+
+// formatBytes formats the bytes with a binary unit prefix.
+func formatBytes(bytes float64) string {
+
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	unit := 0
+
+	for bytes >= 1024 && unit < len(units)-1 {
+		bytes /= 1024
+		unit++
+	}
+
+	return strconv.FormatFloat(bytes, 'f', 1, 64) + " " + units[unit]
+}
+
+// isTerminal returns true if the file is a character device like a terminal.
+func isTerminal(file *os.File) bool {
+
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
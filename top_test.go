@@ -0,0 +1,119 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestTopSnapshot() *snapshot {
+	return &snapshot{
+		timestamp: time.Now(),
+		scrapeOK:  true,
+		jobs: jobIOMap{
+			"1": {jobid: "1", account: "hpc", user: "alice", metadataOperations: map[string]float64{"hebe-MDT0000": 100, "hebe-MDT0001": 5}, readThroughput: 10},
+			"2": {jobid: "2", account: "hpc", user: "bob", metadataOperations: map[string]float64{"hebe-MDT0001": 50}, readThroughput: 2048},
+			"3": {jobid: "3", account: "physics", user: "alice", metadataOperations: map[string]float64{}, writeThroughput: 4096},
+		},
+		procs: procIOMap{
+			"cp.1001": {procName: "cp", userName: "alice", groupName: "staff", metadataOperations: map[string]float64{"hebe-MDT0000": 20}},
+		},
+	}
+}
+
+func TestTopViewRows(t *testing.T) {
+
+	tests := []struct {
+		options  topOptions
+		expected []string
+	}{
+		{topOptions{group: topGroupJob, sort: topSortMetadata}, []string{"1", "2", "3"}},
+		{topOptions{group: topGroupJob, sort: topSortRead}, []string{"2", "1", "3"}},
+		{topOptions{group: topGroupJob, sort: topSortMetadata, limit: 1}, []string{"1"}},
+		{topOptions{group: topGroupUser, sort: topSortMetadata}, []string{"alice", "bob"}},
+		{topOptions{group: topGroupAccount, sort: topSortWrite}, []string{"physics", "hpc"}},
+		{topOptions{group: topGroupProc, sort: topSortMetadata}, []string{"cp"}},
+		{topOptions{group: topGroupJob, sort: topSortMetadata, target: "hebe-MDT0001"}, []string{"2", "1", "3"}},
+		{topOptions{group: topGroupJob, sort: topSortWrite, target: "hebe-MDT0001"}, []string{"3", "1", "2"}},
+		{topOptions{group: topGroupUser, sort: topSortMetadata, account: "hpc"}, []string{"alice", "bob"}},
+		{topOptions{group: topGroupProc, sort: topSortMetadata, account: "hpc"}, []string{}},
+	}
+
+	for _, test := range tests {
+
+		test.options.interval = time.Second
+
+		view, err := newTopView(&test.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rows, _ := view.rows(newTestTopSnapshot())
+
+		got := make([]string, 0, len(rows))
+		for _, row := range rows {
+			got = append(got, row.labels[0])
+		}
+
+		if strings.Join(got, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("%+v: expected rows %v - got: %v", test.options, test.expected, got)
+		}
+	}
+
+	view, err := newTopView(&topOptions{group: topGroupUser, sort: topSortMetadata, interval: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, totals := view.rows(newTestTopSnapshot())
+
+	if rows[0].metadataOperations != 125 || rows[0].writeThroughput != 4096 {
+		t.Errorf("Expected jobs and processes summed per user - got: %+v", rows[0])
+	}
+
+	if totals.metadataOperations["hebe-MDT0000"] != 120 || totals.readThroughput != 2058 {
+		t.Errorf("Unexpected totals: %+v", totals)
+	}
+
+	if _, err := newTopView(&topOptions{group: "node", sort: topSortMetadata, interval: time.Second}); err == nil {
+		t.Error("Expected error for unsupported group")
+	}
+}
+
+func TestTopViewRender(t *testing.T) {
+
+	view, err := newTopView(&topOptions{group: topGroupJob, sort: topSortMetadata, interval: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	view.apply("a")
+	view.apply("w")
+
+	var output bytes.Buffer
+
+	if err := view.render(&output, newTestTopSnapshot()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"group: account - sort: write", "hebe-MDT0000: 100 ops/s", "ACCOUNT", "physics", "4.0 KiB"} {
+		if !strings.Contains(output.String(), expected) {
+			t.Errorf("Expected output to contain '%s' - got: %s", expected, output.String())
+		}
+	}
+
+	view.apply("x")
+
+	if view.message != "Unknown command: x" {
+		t.Errorf("Expected message for unknown command - got: %s", view.message)
+	}
+}
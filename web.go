@@ -0,0 +1,363 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	unixSocketPrefix = "unix:"
+	maxAuthCacheSize = 100
+)
+
+// Verified against if the user is unknown, so the response time does not reveal valid users.
+var dummyPasswordHash = []byte("$2a$10$NGJ39itPuKNLKkORNj5ae.CtVY5dCQvwRfn9399mMTcqHIfmQQxp6")
+
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+var tlsClientAuthTypes = map[string]tls.ClientAuthType{
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"CurveP256": tls.CurveP256,
+	"CurveP384": tls.CurveP384,
+	"CurveP521": tls.CurveP521,
+	"X25519":    tls.X25519,
+}
+
+// webConfig is the web configuration file of the exporter endpoint
+// in the format of the Prometheus exporter-toolkit web-config.yml.
+type webConfig struct {
+	TLSConfig  webTLSConfig      `yaml:"tls_server_config"`
+	HTTPConfig webHTTPConfig     `yaml:"http_server_config"`
+	Users      map[string]string `yaml:"basic_auth_users"`
+}
+
+type webTLSConfig struct {
+	CertFile                 string   `yaml:"cert_file"`
+	KeyFile                  string   `yaml:"key_file"`
+	ClientAuth               string   `yaml:"client_auth_type"`
+	ClientCAs                string   `yaml:"client_ca_file"`
+	CipherSuites             []string `yaml:"cipher_suites"`
+	CurvePreferences         []string `yaml:"curve_preferences"`
+	MinVersion               string   `yaml:"min_version"`
+	MaxVersion               string   `yaml:"max_version"`
+	PreferServerCipherSuites bool     `yaml:"prefer_server_cipher_suites"`
+}
+
+type webHTTPConfig struct {
+	HTTP2   bool              `yaml:"http2"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+// loadWebConfig reads the web configuration file and validates the password hashes.
+// Without a file TLS and basic auth are disabled.
+func loadWebConfig(path string) (*webConfig, error) {
+
+	cfg := &webConfig{
+		TLSConfig:  webTLSConfig{ClientAuth: "NoClientCert", MinVersion: "TLS12"},
+		HTTPConfig: webHTTPConfig{HTTP2: true},
+	}
+
+	if path == "" {
+		return cfg, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	for user, hash := range cfg.Users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("basic_auth_users: invalid bcrypt hash of user %s: %w", user, err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// newWebTLSConfig loads the certificates and creates the TLS server config.
+func newWebTLSConfig(cfg *webTLSConfig, http2 bool) (*tls.Config, error) {
+
+	if cfg.CertFile == "" {
+		return nil, errors.New("missing cert_file")
+	}
+
+	if cfg.KeyFile == "" {
+		return nil, errors.New("missing key_file")
+	}
+
+	certificate, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates:             []tls.Certificate{certificate},
+		PreferServerCipherSuites: cfg.PreferServerCipherSuites,
+		NextProtos:               []string{"http/1.1"},
+	}
+
+	if http2 {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	var ok bool
+
+	if tlsConfig.MinVersion, ok = tlsVersions[cfg.MinVersion]; !ok {
+		return nil, fmt.Errorf("unknown min_version: %s", cfg.MinVersion)
+	}
+
+	if cfg.MaxVersion != "" {
+		if tlsConfig.MaxVersion, ok = tlsVersions[cfg.MaxVersion]; !ok {
+			return nil, fmt.Errorf("unknown max_version: %s", cfg.MaxVersion)
+		}
+	}
+
+	if tlsConfig.ClientAuth, ok = tlsClientAuthTypes[cfg.ClientAuth]; !ok {
+		return nil, fmt.Errorf("unknown client_auth_type: %s", cfg.ClientAuth)
+	}
+
+	if cfg.ClientCAs != "" {
+
+		if tlsConfig.ClientAuth == tls.NoClientCert {
+			return nil, errors.New("client_ca_file is set without a client_auth_type")
+		}
+
+		content, err := ioutil.ReadFile(cfg.ClientCAs)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.ClientCAs = x509.NewCertPool()
+
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificate found in client_ca_file: %s", cfg.ClientCAs)
+		}
+
+	} else if tlsConfig.ClientAuth == tls.VerifyClientCertIfGiven || tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert {
+		return nil, fmt.Errorf("client_ca_file is required for client_auth_type %s", cfg.ClientAuth)
+	}
+
+	for _, name := range cfg.CipherSuites {
+
+		id, err := cipherSuiteID(name)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+
+	for _, name := range cfg.CurvePreferences {
+
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve: %s", name)
+		}
+
+		tlsConfig.CurvePreferences = append(tlsConfig.CurvePreferences, curve)
+	}
+
+	return tlsConfig, nil
+}
+
+func cipherSuiteID(name string) (uint16, error) {
+
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, nil
+		}
+	}
+
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.Name == name {
+			return suite.ID, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown cipher suite: %s", name)
+}
+
+// webHandler sets the configured headers and requires basic auth if users are configured.
+// The web configuration file is read on each request, so changes apply without a restart.
+type webHandler struct {
+	configPath string
+	handler    http.Handler
+	cacheMutex sync.Mutex
+	authCache  map[[sha256.Size]byte]bool
+}
+
+func newWebHandler(configPath string, handler http.Handler) *webHandler {
+	return &webHandler{
+		configPath: configPath,
+		handler:    handler,
+		authCache:  make(map[[sha256.Size]byte]bool),
+	}
+}
+
+func (h *webHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	cfg, err := loadWebConfig(h.configPath)
+	if err != nil {
+		log.Error("Failed to load web configuration: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	for name, value := range cfg.HTTPConfig.Headers {
+		w.Header().Set(name, value)
+	}
+
+	if len(cfg.Users) == 0 {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	user, password, ok := r.BasicAuth()
+
+	if ok {
+
+		hash, validUser := cfg.Users[user]
+		if !validUser {
+			hash = string(dummyPasswordHash)
+		}
+
+		if h.verifyPassword(user, hash, password) && validUser {
+			h.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	w.Header().Set("WWW-Authenticate", "Basic")
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+// verifyPassword compares the password with the bcrypt hash. Results are cached,
+// since bcrypt is deliberately expensive and scrapes send the credentials each time.
+func (h *webHandler) verifyPassword(user string, hash string, password string) bool {
+
+	key := sha256.Sum256([]byte(user + "\x00" + hash + "\x00" + password))
+
+	h.cacheMutex.Lock()
+	verified, ok := h.authCache[key]
+	h.cacheMutex.Unlock()
+
+	if ok {
+		return verified
+	}
+
+	verified = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+
+	h.cacheMutex.Lock()
+	if len(h.authCache) >= maxAuthCacheSize {
+		h.authCache = make(map[[sha256.Size]byte]bool)
+	}
+	h.authCache[key] = verified
+	h.cacheMutex.Unlock()
+
+	return verified
+}
+
+// newWebListener listens on a TCP address or on a unix socket given as unix:/path/to/socket.
+func newWebListener(address string) (net.Listener, error) {
+
+	if !strings.HasPrefix(address, unixSocketPrefix) {
+		return net.Listen("tcp", address)
+	}
+
+	path := strings.TrimPrefix(strings.TrimPrefix(address, unixSocketPrefix), "//")
+
+	// A socket left over by a previous process prevents the listen.
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return net.Listen("unix", path)
+}
+
+// serveWeb serves the handler of the server on the listen address with TLS and
+// basic auth as configured in the web configuration file. The certificates are
+// loaded on each TLS handshake, so renewed certificates are used without a restart.
+func serveWeb(server *http.Server, address string, configPath string) error {
+
+	cfg, err := loadWebConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	useTLS := cfg.TLSConfig.CertFile != "" || cfg.TLSConfig.KeyFile != ""
+
+	if useTLS {
+		if _, err := newWebTLSConfig(&cfg.TLSConfig, cfg.HTTPConfig.HTTP2); err != nil {
+			return fmt.Errorf("tls_server_config: %w", err)
+		}
+	}
+
+	listener, err := newWebListener(address)
+	if err != nil {
+		return err
+	}
+
+	defer listener.Close()
+
+	server.Handler = newWebHandler(configPath, server.Handler)
+
+	if !useTLS {
+		log.Info("Listening on ", address)
+		return server.Serve(listener)
+	}
+
+	tlsConfig := &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg, err := loadWebConfig(configPath)
+			if err != nil {
+				log.Error("Failed to load web configuration: ", err)
+				return nil, err
+			}
+			return newWebTLSConfig(&cfg.TLSConfig, cfg.HTTPConfig.HTTP2)
+		},
+	}
+
+	log.Info("Listening on ", address, " with TLS")
+
+	return server.Serve(tls.NewListener(listener, tlsConfig))
+}
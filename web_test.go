@@ -0,0 +1,206 @@
+// -*- coding: utf-8 -*-
+//
+// © Copyright 2023 GSI Helmholtzzentrum für Schwerionenforschung
+//
+// This software is distributed under
+// the terms of the GNU General Public Licence version 3 (GPL Version 3),
+// copied verbatim in the file "LICENCE".
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	certPEM     []byte
+	keyPEM      []byte
+}
+
+// newTestCertificate creates a certificate signed by the parent or a self-signed CA if parent is nil.
+func newTestCertificate(t *testing.T, name string, parent *testCertificate) *testCertificate {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := template, key
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.certificate, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCertificate{
+		certificate: certificate,
+		key:         key,
+		certPEM:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:      pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func TestWebBasicAuth(t *testing.T) {
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := writeTestFile(t, "web-config.yml", `
+basic_auth_users:
+  alice: `+string(hash)+`
+http_server_config:
+  headers:
+    X-Frame-Options: deny
+`)
+
+	handler := newWebHandler(path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	tests := []struct {
+		user     string
+		password string
+		expected int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"alice", "wrong", http.StatusUnauthorized},
+		{"bob", "secret", http.StatusUnauthorized},
+		{"alice", "secret", http.StatusOK},
+		{"alice", "secret", http.StatusOK},
+	}
+
+	for _, test := range tests {
+
+		request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if test.user != "" {
+			request.SetBasicAuth(test.user, test.password)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.expected {
+			t.Errorf("Expected status %d for user '%s' - got: %d", test.expected, test.user, recorder.Code)
+		}
+		if recorder.Header().Get("X-Frame-Options") != "deny" {
+			t.Error("Expected configured header X-Frame-Options")
+		}
+	}
+
+	if _, err := loadWebConfig(writeTestFile(t, "invalid.yml", "basic_auth_users:\n  alice: plain\n")); err == nil {
+		t.Error("Expected error for password without bcrypt hash")
+	}
+}
+
+func TestServeWebMutualTLS(t *testing.T) {
+
+	ca := newTestCertificate(t, "ca", nil)
+	serverCert := newTestCertificate(t, "localhost", ca)
+	clientCert := newTestCertificate(t, "client", ca)
+
+	path := writeTestFile(t, "web-config.yml", `
+tls_server_config:
+  cert_file: `+writeTestFile(t, "server.pem", string(serverCert.certPEM))+`
+  key_file: `+writeTestFile(t, "server.key", string(serverCert.keyPEM))+`
+  client_auth_type: RequireAndVerifyClientCert
+  client_ca_file: `+writeTestFile(t, "ca.pem", string(ca.certPEM))+`
+`)
+
+	socket := filepath.Join(t.TempDir(), "exporter.sock")
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})}
+
+	go serveWeb(server, unixSocketPrefix+socket, path)
+	defer server.Close()
+
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+	}
+
+	// Wait for the listener.
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+
+	newClient := func(certificates []tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			DialContext:     dial,
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certificates},
+		}}
+	}
+
+	if _, err := newClient(nil).Get("https://localhost/metrics"); err == nil {
+		t.Error("Expected TLS error without client certificate")
+	}
+
+	keyPair, err := tls.X509KeyPair(clientCert.certPEM, clientCert.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := newClient([]tls.Certificate{keyPair}).Get("https://localhost/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 with client certificate - got: %d", res.StatusCode)
+	}
+}